@@ -0,0 +1,278 @@
+// Package admin provides an HTTP API to inspect the DNS records and the state
+// of syncing them with the cluster, and to trigger syncs.
+package admin
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ahmetalpbalkan/wagl/clusterdns"
+	"github.com/ahmetalpbalkan/wagl/clusterdns/staleness"
+	"github.com/ahmetalpbalkan/wagl/rrstore"
+	"github.com/miekg/dns"
+)
+
+// Timeouts of the admin server, so that slow or idle clients cannot hold on to
+// their connections.
+const (
+	readHeaderTimeout = 5 * time.Second
+	readTimeout       = 10 * time.Second
+	writeTimeout      = 30 * time.Second
+	idleTimeout       = 60 * time.Second
+)
+
+// Cluster provides the state of syncing the records with the cluster.
+type Cluster interface {
+	// Status returns the status of the syncs.
+	Status() clusterdns.Status
+
+	// Refresh makes the next sync happen right away.
+	Refresh()
+}
+
+// Handler serves the admin API:
+//
+//	GET  /records     records, filtered by ?name= and ?type= if specified
+//	GET  /bad-tasks   tasks not eligible for DNS records and the reasons
+//	GET  /status      status of the syncs and the staleness of the records
+//	POST /refresh     triggers a sync
+type Handler struct {
+	rr      rrstore.RRReader
+	cl      Cluster
+	tracker *staleness.Tracker
+	policy  staleness.Policy
+	mux     *http.ServeMux
+}
+
+// NewHandler creates a Handler serving the records in rr and the state of
+// syncing them with the cluster, using the tracker to report staleness.
+func NewHandler(rr rrstore.RRReader, cl Cluster, tracker *staleness.Tracker, policy staleness.Policy) *Handler {
+	h := &Handler{rr: rr, cl: cl, tracker: tracker, policy: policy, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/records", h.get(h.records))
+	h.mux.HandleFunc("/bad-tasks", h.get(h.badTasks))
+	h.mux.HandleFunc("/status", h.get(h.status))
+	h.mux.HandleFunc("/refresh", h.refresh)
+	return h
+}
+
+// New creates an HTTP server listening on the specified host:port that serves
+// the admin API using h. If token is not empty, requests must present it as a
+// bearer token. If config is not nil, the server is to be started with
+// ListenAndServeTLS("", ""), and config may require client certificates.
+// Without config, the token is sent in clear text, so the server should
+// listen only on a loopback address. The server times out reading slow
+// requests and closes idle connections.
+func New(addr string, config *tls.Config, token string, h http.Handler) *http.Server {
+	if token != "" {
+		h = RequireToken(token, h)
+	}
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		TLSConfig:         config,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+}
+
+// RequireToken wraps the HTTP handler h so that only the requests with the
+// token in the "Authorization: Bearer" header are handed to h.
+func RequireToken(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// get adapts f that gives the JSON response of a GET request, or an error
+// message for bad requests, into an HTTP handler.
+func (h *Handler) get(f func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "expected GET", http.StatusMethodNotAllowed)
+			return
+		}
+		v, err := f(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, v)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+type record struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Addr     net.IP   `json:"addr,omitempty"`
+	Port     uint16   `json:"port,omitempty"`
+	Target   string   `json:"target,omitempty"`
+	Priority uint16   `json:"priority,omitempty"`
+	Weight   uint16   `json:"weight,omitempty"`
+	TTL      uint32   `json:"ttl"`
+	Text     []string `json:"text,omitempty"`
+	TaskID   string   `json:"task,omitempty"`
+	RR       string   `json:"rr"`
+}
+
+type recordsResponse struct {
+	Generation uint64   `json:"generation"`
+	Records    []record `json:"records"`
+}
+
+// records lists the records sorted by name and type, filtered by the name
+// and type parameters if specified.
+func (h *Handler) records(r *http.Request) (interface{}, error) {
+	var (
+		name  = strings.ToLower(r.URL.Query().Get("name"))
+		qType uint16
+	)
+	if name != "" {
+		name = dns.Fqdn(name)
+	}
+	if s := r.URL.Query().Get("type"); s != "" {
+		t, ok := dns.StringToType[strings.ToUpper(s)]
+		if !ok {
+			return nil, fmt.Errorf("unknown record type %q", s)
+		}
+		qType = t
+	}
+
+	gen, rl := h.rr.Records()
+	out := recordsResponse{Generation: gen, Records: []record{}}
+	for t, names := range rl {
+		if qType != 0 && t != qType {
+			continue
+		}
+		for n, recs := range names {
+			if name != "" && n != name {
+				continue
+			}
+			for _, rec := range recs {
+				out.Records = append(out.Records, record{
+					Name:     n,
+					Type:     dns.TypeToString[t],
+					Addr:     rec.Addr,
+					Port:     rec.Port,
+					Target:   rec.Target,
+					Priority: rec.Priority,
+					Weight:   rec.Weight,
+					TTL:      rec.TTL,
+					Text:     rec.Text,
+					TaskID:   rec.TaskID,
+					RR:       rec.RR().String(),
+				})
+			}
+		}
+	}
+	sort.SliceStable(out.Records, func(i, j int) bool {
+		a, b := out.Records[i], out.Records[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.RR < b.RR
+	})
+	return out, nil
+}
+
+type badTask struct {
+	ID      string `json:"id"`
+	Service string `json:"service,omitempty"`
+	Domain  string `json:"domain,omitempty"`
+	Filter  string `json:"filter"`
+	Reason  string `json:"reason"`
+}
+
+// badTasks lists the tasks not eligible for DNS records as of the last sync.
+func (h *Handler) badTasks(r *http.Request) (interface{}, error) {
+	out := []badTask{}
+	for _, t := range h.cl.Status().BadTasks {
+		out = append(out, badTask{
+			ID:      t.Id,
+			Service: t.Service,
+			Domain:  t.Domain,
+			Filter:  t.Filter,
+			Reason:  t.Reason,
+		})
+	}
+	return out, nil
+}
+
+type statusResponse struct {
+	Generation    uint64     `json:"generation"`
+	LastSync      *time.Time `json:"lastSync"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+	Failures      int        `json:"failures"`
+	Tasks         int        `json:"tasks"`
+	BadTasks      int        `json:"badTasks"`
+	Stale         bool       `json:"stale"`
+	StalePolicy   string     `json:"stalePolicy"`
+}
+
+// status describes the syncs and the staleness of the records.
+func (h *Handler) status(r *http.Request) (interface{}, error) {
+	st := h.cl.Status()
+	out := statusResponse{
+		Generation:  h.rr.Generation(),
+		LastSync:    optionalTime(st.LastSync),
+		Failures:    st.Failures,
+		Tasks:       st.Tasks,
+		BadTasks:    len(st.BadTasks),
+		Stale:       h.tracker.Stale(),
+		StalePolicy: string(h.policy),
+	}
+	if st.LastError != nil {
+		out.LastError = st.LastError.Error()
+		out.LastErrorTime = optionalTime(st.LastErrorTime)
+	}
+	return out, nil
+}
+
+// refresh triggers a sync without waiting for it.
+func (h *Handler) refresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "expected POST", http.StatusMethodNotAllowed)
+		return
+	}
+	h.cl.Refresh()
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "refresh triggered"})
+}
+
+// optionalTime gives nil for zero times so that they are encoded as null.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,177 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ahmetalpbalkan/wagl/clusterdns"
+	"github.com/ahmetalpbalkan/wagl/clusterdns/staleness"
+	"github.com/ahmetalpbalkan/wagl/rrgen"
+	"github.com/ahmetalpbalkan/wagl/rrstore"
+	"github.com/ahmetalpbalkan/wagl/task"
+	"github.com/miekg/dns"
+)
+
+type fakeCluster struct {
+	status    clusterdns.Status
+	refreshes int
+}
+
+func (f *fakeCluster) Status() clusterdns.Status { return f.status }
+func (f *fakeCluster) Refresh()                  { f.refreshes++ }
+
+func testHandler(t *testing.T) (*Handler, *fakeCluster) {
+	rr := rrstore.New()
+	err := rr.Set(42, rrstore.RRs{
+		dns.TypeA: {
+			"api.domain.": {{Addr: net.ParseIP("10.0.0.2"), TaskID: "web2"}, {Addr: net.ParseIP("10.0.0.1"), TaskID: "web1"}},
+			"db.domain.":  {{Addr: net.ParseIP("10.0.0.3"), TaskID: "db"}},
+		},
+		dns.TypeSRV: {
+			"_api._tcp.domain.": {{Addr: net.ParseIP("10.0.0.1"), Port: 80, TaskID: "web1"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &fakeCluster{status: clusterdns.Status{
+		LastSync:      time.Now(),
+		LastError:     errors.New("connection refused"),
+		LastErrorTime: time.Now().Add(-time.Minute),
+		Tasks:         4,
+		BadTasks: []rrgen.BadTask{
+			{Task: task.Task{Id: "cache"}, Filter: "no-dns-name", Reason: "has no DNS name specified"},
+		},
+	}}
+	return NewHandler(rr, cl, staleness.New(time.Minute), staleness.ServeStale), cl
+}
+
+func get(t *testing.T, h http.Handler, url string, v interface{}) int {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("cannot parse response to %s: %v", url, err)
+		}
+	}
+	return w.Code
+}
+
+func TestRecords(t *testing.T) {
+	h, _ := testHandler(t)
+
+	cases := []struct {
+		url   string
+		code  int
+		names []string
+	}{
+		{"/records", http.StatusOK, []string{"_api._tcp.domain.", "api.domain.", "api.domain.", "db.domain."}},
+		{"/records?name=API.Domain", http.StatusOK, []string{"api.domain.", "api.domain."}},
+		{"/records?type=srv", http.StatusOK, []string{"_api._tcp.domain."}},
+		{"/records?name=db.domain.&type=SRV", http.StatusOK, []string{}},
+		{"/records?type=FOO", http.StatusBadRequest, nil},
+	}
+	for _, c := range cases {
+		var resp recordsResponse
+		if code := get(t, h, c.url, &resp); code != c.code {
+			t.Fatalf("%s: wrong status: %d", c.url, code)
+		} else if code != http.StatusOK {
+			continue
+		}
+		if resp.Generation != 42 {
+			t.Fatalf("%s: wrong generation: %d", c.url, resp.Generation)
+		}
+		if len(resp.Records) != len(c.names) {
+			t.Fatalf("%s: wrong records: %+v", c.url, resp.Records)
+		}
+		for i, n := range c.names {
+			if resp.Records[i].Name != n {
+				t.Fatalf("%s: wrong records: %+v", c.url, resp.Records)
+			}
+		}
+	}
+
+	var resp recordsResponse
+	get(t, h, "/records?name=api.domain", &resp)
+	if r := resp.Records[0]; r.TaskID != "web1" || r.RR != "api.domain.\t0\tIN\tA\t10.0.0.1" {
+		t.Fatalf("records are not sorted or wrong: %+v", resp.Records)
+	}
+}
+
+func TestBadTasks(t *testing.T) {
+	h, _ := testHandler(t)
+	var resp []badTask
+	if code := get(t, h, "/bad-tasks", &resp); code != http.StatusOK {
+		t.Fatalf("wrong status: %d", code)
+	}
+	if len(resp) != 1 || resp[0].ID != "cache" || resp[0].Filter != "no-dns-name" {
+		t.Fatalf("wrong bad tasks: %+v", resp)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	h, _ := testHandler(t)
+	var resp statusResponse
+	if code := get(t, h, "/status", &resp); code != http.StatusOK {
+		t.Fatalf("wrong status: %d", code)
+	}
+	if resp.Generation != 42 || resp.LastSync == nil || resp.LastError != "connection refused" ||
+		resp.Tasks != 4 || resp.BadTasks != 1 || resp.Stale || resp.StalePolicy != "serve-stale" {
+		t.Fatalf("wrong status: %+v", resp)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	h, cl := testHandler(t)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/refresh", nil))
+	if w.Code != http.StatusMethodNotAllowed || cl.refreshes != 0 {
+		t.Fatalf("refresh with GET: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/refresh", nil))
+	if w.Code != http.StatusAccepted || cl.refreshes != 1 {
+		t.Fatalf("refresh is not triggered: %d", w.Code)
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	h, _ := testHandler(t)
+	srv := New(":0", nil, "s3cret", h)
+
+	cases := []struct {
+		auth string
+		code int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"s3cret", http.StatusUnauthorized},
+		{"Bearer s3cret", http.StatusOK},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/status", nil)
+		if c.auth != "" {
+			r.Header.Set("Authorization", c.auth)
+		}
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Fatalf("authorization %q: wrong status: %d", c.auth, w.Code)
+		}
+	}
+}
+
+func TestNew_timeouts(t *testing.T) {
+	h, _ := testHandler(t)
+	srv := New(":0", nil, "", h)
+	if srv.ReadHeaderTimeout == 0 || srv.ReadTimeout == 0 || srv.WriteTimeout == 0 || srv.IdleTimeout == 0 {
+		t.Fatalf("server does not time out: %+v", srv)
+	}
+}
@@ -1,22 +1,29 @@
 package clusterdns
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ahmetalpbalkan/wagl/clusterdns/refresh"
+	"github.com/ahmetalpbalkan/wagl/metrics"
 	"github.com/ahmetalpbalkan/wagl/rrgen"
 	"github.com/ahmetalpbalkan/wagl/rrstore"
 	"github.com/ahmetalpbalkan/wagl/task"
+	"github.com/miekg/dns"
 )
 
 // ClusterDriver describes a distributed task execution environment.
 type ClusterDriver interface {
 	// Tasks gives the active tasks in the cluster which may or may not be
 	// eligible for load balancing due to various reasons such as  having no
-	// ports exposed or invalid characters in service/domain names.
-	Tasks() (task.ClusterState, error)
+	// ports exposed or invalid characters in service/domain names. Calls
+	// must return promptly with an error once ctx is done.
+	Tasks(ctx context.Context) (task.ClusterState, error)
 }
 
 // ClusterDNS keeps the DNS records in sync with Cluster state.
@@ -24,34 +31,230 @@ type ClusterDNS struct {
 	domain string
 	rr     rrstore.RRWriter
 	cl     ClusterDriver
+
+	// SnapshotFile is the file the records are saved to after every
+	// successful sync, so that they can be served after a restart until
+	// the cluster is reachable.
+	SnapshotFile string
+
+	// Logger logs the syncs.
+	Logger *slog.Logger
+
+	// Metrics are the metrics the syncs are counted in, created in a
+	// registry of their own by New. They must not be changed once the
+	// records are synced.
+	Metrics *Metrics
+
+	ready     chan struct{}
+	readyOnce sync.Once
+	refresh   *refresh.Loop
+	lastGen   uint64 // generation of the last sync started, atomic
+
+	m      sync.Mutex
+	status Status
+	config Config
+}
+
+// Config is the configuration of the records that can be changed while the
+// records are synced with SetConfig. Changes are applied with the next sync.
+type Config struct {
+	// TTL is the TTL of the records generated from the tasks.
+	TTL uint32
+
+	// Static are the records served in addition to the ones generated from
+	// the tasks. They must not be modified.
+	Static rrstore.RRs
+}
+
+// Status describes the syncs of the records with the cluster.
+type Status struct {
+	LastSync      time.Time       // last successful sync, zero if never
+	LastError     error           // error of the last failed sync, if any
+	LastErrorTime time.Time       // time of the last failed sync
+	Failures      int             // failed syncs since the last successful one
+	Tasks         int             // tasks in the cluster as of the last sync
+	BadTasks      []rrgen.BadTask // tasks not eligible for DNS records
 }
 
 func New(domain string, rr rrstore.RRWriter, cl ClusterDriver) *ClusterDNS {
-	return &ClusterDNS{domain, rr, cl}
+	return &ClusterDNS{
+		domain:  domain,
+		rr:      rr,
+		cl:      cl,
+		ready:   make(chan struct{}),
+		Logger:  slog.Default(),
+		Metrics: NewMetrics(metrics.NewRegistry()),
+	}
+}
+
+// Ready returns a channel that is closed once the records are synced with the
+// cluster for the first time.
+func (c *ClusterDNS) Ready() <-chan struct{} {
+	return c.ready
+}
+
+// Status returns the status of the syncs with the cluster.
+func (c *ClusterDNS) Status() Status {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.status
+}
+
+// SetConfig replaces the configuration of the records.
+func (c *ClusterDNS) SetConfig(cfg Config) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.config = cfg
+}
+
+func (c *ClusterDNS) getConfig() Config {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.config
+}
+
+// synced records a successful sync in the status.
+func (c *ClusterDNS) synced(state task.ClusterState, bad []rrgen.BadTask) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.status.LastSync = time.Now()
+	c.status.Failures = 0
+	c.status.Tasks = len(state)
+	c.status.BadTasks = bad
+}
+
+// failed records a failed sync in the status and returns err.
+func (c *ClusterDNS) failed(err error) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.status.LastError = err
+	c.status.LastErrorTime = time.Now()
+	c.status.Failures++
+	return err
+}
+
+// Handler wraps the DNS handler h so that the queries for the names in the
+// domain are answered with SERVFAIL until the records are synced for the first
+// time, instead of NXDOMAIN answers that resolvers may cache.
+func (c *ClusterDNS) Handler(h dns.Handler) dns.Handler {
+	domain := strings.ToLower(dns.Fqdn(c.domain))
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		select {
+		case <-c.ready:
+		default:
+			if len(r.Question) > 0 && dns.IsSubDomain(domain, strings.ToLower(r.Question[0].Name)) {
+				m := new(dns.Msg)
+				m.SetRcode(r, dns.RcodeServerFailure)
+				w.WriteMsg(m)
+				return
+			}
+		}
+		h.ServeDNS(w, r)
+	})
+}
+
+// SeedGeneration makes the syncs version their records with generations
+// greater than gen, e.g. the one of the records loaded from a snapshot, so
+// that they are not discarded as older than the records in the table.
+func (c *ClusterDNS) SeedGeneration(gen uint64) {
+	for {
+		last := atomic.LoadUint64(&c.lastGen)
+		if last >= gen || atomic.CompareAndSwapUint64(&c.lastGen, last, gen) {
+			return
+		}
+	}
 }
 
 // SyncRecords syncs the DNS records in the RR table with the cluster by
-// querying the cluster and updating the RR table.
-func (c *ClusterDNS) SyncRecords() error {
-	state, err := c.cl.Tasks()
+// querying the cluster and updating the RR table. The records are versioned
+// with a counter incremented when a sync starts, rather than the clock which
+// can step back, so if a sync that started later has already updated the
+// table, the records are discarded and refresh.ErrSkipped is returned, as the
+// sync neither fails nor refreshes the records. Otherwise the records are
+// saved to the SnapshotFile, if set. If ctx is done before the records are
+// updated, the sync is abandoned without updating the table.
+func (c *ClusterDNS) SyncRecords(ctx context.Context) error {
+	gen := atomic.AddUint64(&c.lastGen, 1)
+	state, err := c.cl.Tasks(ctx)
 	if err != nil {
-		return fmt.Errorf("error fetching cluster state: %v", err)
+		return c.failed(fmt.Errorf("error fetching cluster state: %v", err))
+	}
+	if err := ctx.Err(); err != nil {
+		return c.failed(fmt.Errorf("error fetching cluster state: %v", err))
+	}
+	rl, bad := Records(c.Logger, c.domain, state, c.getConfig())
+	if err := c.rr.Set(gen, rl); err == rrstore.ErrStale {
+		c.Logger.Warn("Discarding records older than the current records", "generation", gen)
+		return refresh.ErrSkipped
+	} else if err != nil {
+		return c.failed(fmt.Errorf("error updating records: %v", err))
+	}
+	c.readyOnce.Do(func() { close(c.ready) })
+	c.synced(state, bad)
+	c.Metrics.observeSync(state, rl, bad)
+
+	if c.SnapshotFile != "" {
+		if err := rrstore.WriteFile(c.SnapshotFile, gen, rl); err != nil {
+			c.Logger.Error("Error saving records", "file", c.SnapshotFile, "error", err)
+		}
 	}
-	c.rr.Set(rrgen.RRs(c.domain, state))
 	return nil
 }
 
-func (c *ClusterDNS) StartRefreshing(interval, timeout time.Duration, cancel <-chan struct{}) (<-chan error, <-chan struct{}) {
-	t := time.NewTicker(interval)
-	go func() { // garbage collect the ticker
-		<-cancel
-		t.Stop()
-	}()
+// Records generates the records of the tasks in the cluster state as syncs do
+// with the configuration cfg, and returns them with the tasks not eligible for
+// DNS records.
+func Records(logger *slog.Logger, domain string, state task.ClusterState, cfg Config) (rrstore.RRs, []rrgen.BadTask) {
+	rl, bad := rrgen.RRs(logger, domain, state)
+	addConfig(rl, cfg)
+	return rl, bad
+}
+
+// addConfig sets the TTL of the generated records rl and adds the static
+// records to them.
+func addConfig(rl rrstore.RRs, cfg Config) {
+	for _, names := range rl {
+		for _, recs := range names {
+			for i := range recs {
+				recs[i].TTL = cfg.TTL
+			}
+		}
+	}
+	for t, names := range cfg.Static {
+		if rl[t] == nil {
+			rl[t] = make(map[string][]rrstore.Record)
+		}
+		for name, recs := range names {
+			rl[t][name] = append(rl[t][name], recs...)
+		}
+	}
+}
+
+// StartRefreshing starts syncing the records every interval in the background
+// until cancel is closed. Syncs never overlap and back off up to maxBackoff
+// after consecutive failures. It returns the channels the results of the
+// syncs are sent to.
+func (c *ClusterDNS) StartRefreshing(interval, timeout, maxBackoff time.Duration, cancel <-chan struct{}) (<-chan error, <-chan struct{}) {
+	c.refresh = refresh.New(func(ctx context.Context) error {
+		c.Logger.Debug("Refreshing DNS records")
+		return c.SyncRecords(ctx)
+	}, interval, timeout)
+	c.refresh.MaxBackoff = maxBackoff
+	c.refresh.Metrics = c.Metrics.refresh
+
+	c.Logger.Info("Starting to refresh DNS records", "interval", interval, "timeout", timeout, "max_backoff", maxBackoff)
+	return c.refresh.Start(cancel)
+}
+
+// Stopped returns a channel that is closed once refreshing stops after it is
+// cancelled, and the sync in progress, if any, is abandoned. It must be called
+// after StartRefreshing.
+func (c *ClusterDNS) Stopped() <-chan struct{} {
+	return c.refresh.Done()
+}
 
-	log.Printf("Starting to refresh DNS records every %v...", interval)
-	return refresh.New(func(cancel <-chan struct{}) error {
-		// TODO see if we can plumb the cancellation to SyncRecords
-		log.Println("Refreshing DNS records...")
-		return c.SyncRecords()
-	}, t.C, timeout, cancel)
+// Refresh makes the next sync happen right away rather than after the refresh
+// interval. It must be called after StartRefreshing.
+func (c *ClusterDNS) Refresh() {
+	c.refresh.Trigger()
 }
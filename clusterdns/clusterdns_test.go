@@ -1,3 +1,310 @@
 package clusterdns
 
-// TODO implement tests
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ahmetalpbalkan/wagl/clusterdns/clusterdnstest"
+	"github.com/ahmetalpbalkan/wagl/clusterdns/refresh"
+	"github.com/ahmetalpbalkan/wagl/rrstore"
+	"github.com/ahmetalpbalkan/wagl/task"
+	"github.com/miekg/dns"
+)
+
+func TestSyncRecords_slowSyncDoesNotOverwrite(t *testing.T) {
+	cl := &clusterdnstest.Cluster{Calls: make(chan chan task.ClusterState)}
+	rr := rrstore.New()
+	c := New("domain", rr, cl)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() { // slow sync, starts first
+		defer wg.Done()
+		if err := c.SyncRecords(context.Background()); err != refresh.ErrSkipped {
+			t.Errorf("wrong error of the slow sync. expected: %v got: %v", refresh.ErrSkipped, err)
+		}
+	}()
+	slow := <-cl.Calls
+
+	wg.Add(1)
+	go func() { // fast sync, starts later
+		defer wg.Done()
+		if err := c.SyncRecords(context.Background()); err != nil {
+			t.Error(err)
+		}
+	}()
+	fast := <-cl.Calls
+
+	// Both syncs are waiting on the cluster now. Finish the later one first.
+	fast <- clusterdnstest.APITasks("10.0.0.2")
+	waitGeneration(t, rr, 1)
+	gen := rr.Generation()
+	slow <- clusterdnstest.APITasks("10.0.0.1")
+	wg.Wait()
+
+	if g := rr.Generation(); g != gen {
+		t.Fatalf("generation changed by the slow sync: %d, expected: %d", g, gen)
+	}
+	if v, _ := rr.Get("api.domain.", dns.TypeA); len(v) != 1 || !v[0].Addr.Equal(net.ParseIP("10.0.0.2")) {
+		t.Fatalf("newer records are overwritten: %v", v)
+	}
+}
+
+func TestSyncRecords_seedGeneration(t *testing.T) {
+	cl := &clusterdnstest.Cluster{Calls: make(chan chan task.ClusterState)}
+	rr := rrstore.New()
+	// records loaded from a snapshot written with a generation far ahead,
+	// e.g. the time on a host with its clock ahead
+	ahead := uint64(time.Now().Add(time.Hour).UnixNano())
+	if err := rr.Set(ahead, rrstore.RRs{}); err != nil {
+		t.Fatal(err)
+	}
+	c := New("domain", rr, cl)
+	c.SeedGeneration(rr.Generation())
+	for i := 0; i < 2; i++ {
+		go func() { (<-cl.Calls) <- clusterdnstest.APITasks("10.0.0.1") }()
+		if err := c.SyncRecords(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if g := rr.Generation(); g != ahead+uint64(i)+1 {
+			t.Fatalf("records are not updated, generation: %d", g)
+		}
+	}
+}
+
+func TestSyncRecords_savesSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wagl-clusterdns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cl := &clusterdnstest.Cluster{Calls: make(chan chan task.ClusterState)}
+	rr := rrstore.New()
+	c := New("domain", rr, cl)
+	c.SnapshotFile = filepath.Join(dir, "records.json")
+	go func() { (<-cl.Calls) <- clusterdnstest.APITasks("10.0.0.1") }()
+	if err := c.SyncRecords(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	gen, rl, _, err := rrstore.ReadFile(c.SnapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gen != rr.Generation() {
+		t.Fatalf("wrong generation saved: %d, expected: %d", gen, rr.Generation())
+	}
+	if v := rl[dns.TypeA]["api.domain."]; len(v) != 1 || !v[0].Addr.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("wrong records saved: %v", rl)
+	}
+}
+
+func TestSyncRecords_config(t *testing.T) {
+	cl := &clusterdnstest.Cluster{Calls: make(chan chan task.ClusterState)}
+	rr := rrstore.New()
+	c := New("domain", rr, cl)
+	static := rrstore.RRs{
+		dns.TypeA: {
+			"api.domain.": {{Addr: net.ParseIP("10.0.0.9"), TTL: 5}},
+			"db.domain.":  {{Addr: net.ParseIP("10.0.1.1"), TTL: 5}},
+		},
+		dns.TypeTXT: {"info.domain.": {{Text: []string{"hello"}, TTL: 5}}},
+	}
+	c.SetConfig(Config{TTL: 30, Static: static})
+	go func() { (<-cl.Calls) <- clusterdnstest.APITasks("10.0.0.1") }()
+	if err := c.SyncRecords(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ttls := func(t uint16, name string) []uint32 {
+		recs, _ := rr.Get(name, t)
+		var l []uint32
+		for _, r := range recs {
+			l = append(l, r.RR().Header().Ttl)
+		}
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		return l
+	}
+	for _, c := range []struct {
+		t        uint16
+		name     string
+		expected []uint32
+	}{
+		{dns.TypeA, "api.domain.", []uint32{5, 30}}, // static and generated
+		{dns.TypeSRV, "_api._tcp.domain.", []uint32{30}},
+		{dns.TypeA, "db.domain.", []uint32{5}},
+		{dns.TypeTXT, "info.domain.", []uint32{5}},
+	} {
+		if got := ttls(c.t, c.name); !reflect.DeepEqual(got, c.expected) {
+			t.Fatalf("wrong TTLs of %s %s. expected: %v got: %v", dns.TypeToString[c.t], c.name, c.expected, got)
+		}
+	}
+	if l := static[dns.TypeA]["api.domain."]; len(l) != 1 {
+		t.Fatalf("static records are modified: %v", l)
+	}
+}
+
+func TestSyncRecords_statusAndMetrics(t *testing.T) {
+	cl := &clusterdnstest.Cluster{Calls: make(chan chan task.ClusterState)}
+	c := New("domain", rrstore.New(), cl)
+	state := append(clusterdnstest.APITasks("10.0.0.1"), task.Task{Id: "db", Service: "db"})
+	go func() { (<-cl.Calls) <- state }()
+	if err := c.SyncRecords(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if st := c.Status(); st.LastSync.IsZero() || st.Tasks != 2 || len(st.BadTasks) != 1 || st.BadTasks[0].Id != "db" {
+		t.Fatalf("wrong status: %+v", st)
+	}
+	if v := c.Metrics.tasks.Value(); v != 2 {
+		t.Fatalf("wrong task count: %v", v)
+	}
+	if v := c.Metrics.badTasks.With("no-ports").Value(); v != 1 {
+		t.Fatalf("wrong bad task count: %v", v)
+	}
+	if v := c.Metrics.badTasks.With("no-dns-name").Value(); v != 0 {
+		t.Fatalf("wrong bad task count: %v", v)
+	}
+	if a, srv := c.Metrics.records.With("A").Value(), c.Metrics.records.With("SRV").Value(); a != 1 || srv != 1 {
+		t.Fatalf("wrong record counts: A=%v SRV=%v", a, srv)
+	}
+}
+
+func TestHandler_untilReady(t *testing.T) {
+	cl := &clusterdnstest.Cluster{Calls: make(chan chan task.ClusterState)}
+	c := New("domain", rrstore.New(), cl)
+	h := c.Handler(dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNameError)
+		w.WriteMsg(m)
+	}))
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- c.SyncRecords(context.Background()) }()
+	first := <-cl.Calls // cluster is slow to respond
+
+	if rcode := serve(h, "api.domain."); rcode != dns.RcodeServerFailure {
+		t.Fatalf("wrong rcode before sync: %s", dns.RcodeToString[rcode])
+	}
+	if rcode := serve(h, "API.Domain."); rcode != dns.RcodeServerFailure {
+		t.Fatalf("wrong rcode before sync: %s", dns.RcodeToString[rcode])
+	}
+	if rcode := serve(h, "example.com."); rcode != dns.RcodeNameError {
+		t.Fatalf("external query is not passed before sync: %s", dns.RcodeToString[rcode])
+	}
+	select {
+	case <-c.Ready():
+		t.Fatal("ready before sync")
+	default:
+	}
+
+	first <- clusterdnstest.APITasks("10.0.0.1")
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c.Ready():
+	case <-time.After(time.Second):
+		t.Fatal("not ready after sync")
+	}
+	if rcode := serve(h, "api.domain."); rcode != dns.RcodeNameError {
+		t.Fatalf("query is not passed after sync: %s", dns.RcodeToString[rcode])
+	}
+}
+
+func TestStartRefreshing_timeoutAbortsSync(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	cl := &clusterdnstest.Cluster{Calls: make(chan chan task.ClusterState, 10)}
+	rr := rrstore.New()
+	c := New("domain", rr, cl)
+	cancel := make(chan struct{})
+	errCh, okCh := c.StartRefreshing(time.Millisecond*10, time.Millisecond*20, time.Millisecond*10, cancel)
+
+	// the cluster never responds
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatal("nil error on timeout")
+		}
+	case <-okCh:
+		t.Fatal("sync succeeded without the cluster state")
+	case <-time.After(time.Second):
+		t.Fatal("sync did not time out")
+	}
+	close(cancel)
+
+	// stop draining so that no new syncs stay blocked on the channels
+	go func() {
+		for {
+			select {
+			case <-errCh:
+			case <-okCh:
+			case <-time.After(time.Millisecond * 100):
+				return
+			}
+		}
+	}()
+	waitGoroutines(t, before)
+	if rr.Generation() != 0 {
+		t.Fatal("records are written by timed out syncs")
+	}
+	if st := c.Status(); st.Failures == 0 || st.LastError == nil || !st.LastSync.IsZero() {
+		t.Fatalf("wrong status: %+v", st)
+	}
+}
+
+// waitGoroutines waits until the number of goroutines drops back to n, so that
+// the goroutines started during a test are known not to leak.
+func waitGoroutines(t *testing.T, n int) {
+	var cur int
+	for i := 0; i < 200; i++ {
+		if cur = runtime.NumGoroutine(); cur <= n {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	buf := make([]byte, 1<<16)
+	t.Fatalf("goroutines leaked: %d, expected: %d\n%s", cur, n, buf[:runtime.Stack(buf, true)])
+}
+
+// serve makes an A query for name to the handler and returns the rcode.
+func serve(h dns.Handler, name string) int {
+	r := new(dns.Msg)
+	r.SetQuestion(name, dns.TypeA)
+	w := &msgWriter{}
+	h.ServeDNS(w, r)
+	return w.m.Rcode
+}
+
+// msgWriter is a dns.ResponseWriter keeping the response written.
+type msgWriter struct {
+	dns.ResponseWriter
+	m *dns.Msg
+}
+
+func (w *msgWriter) WriteMsg(m *dns.Msg) error {
+	w.m = m
+	return nil
+}
+
+// waitGeneration waits until the records have been written at least once.
+func waitGeneration(t *testing.T, rr rrstore.RRReader, min uint64) {
+	for i := 0; i < 100; i++ {
+		if rr.Generation() >= min {
+			return
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	t.Fatal("records are not written")
+}
@@ -0,0 +1,68 @@
+// Package clusterdnstest provides a fake cluster for the tests of the packages
+// syncing DNS records with a cluster.
+package clusterdnstest
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/ahmetalpbalkan/wagl/task"
+)
+
+// Cluster is a fake cluster driver. Its Tasks method returns the tasks or the
+// error set, or the cluster state sent by the test if Calls is not nil.
+type Cluster struct {
+	// Calls receives a channel for each call to Tasks, over which the test
+	// sends the cluster state to be returned, if not nil. It lets the test
+	// control when the calls return.
+	Calls chan chan task.ClusterState
+
+	m     sync.Mutex
+	tasks task.ClusterState
+	err   error
+}
+
+// New creates a Cluster returning the tasks, or err if not nil.
+func New(tasks task.ClusterState, err error) *Cluster {
+	return &Cluster{tasks: tasks, err: err}
+}
+
+// Tasks returns the tasks of the cluster. Calls return with an error once ctx
+// is done.
+func (c *Cluster) Tasks(ctx context.Context) (task.ClusterState, error) {
+	if c.Calls == nil {
+		c.m.Lock()
+		defer c.m.Unlock()
+		return c.tasks, c.err
+	}
+	ch := make(chan task.ClusterState)
+	select {
+	case c.Calls <- ch:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case s := <-ch:
+		return s, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Set replaces the tasks, or the error, returned by the next calls.
+func (c *Cluster) Set(tasks task.ClusterState, err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.tasks, c.err = tasks, err
+}
+
+// APITasks gives a cluster state with a single task of the service api,
+// exposing port 80 over TCP on ip.
+func APITasks(ip string) task.ClusterState {
+	return task.ClusterState{{
+		Id:      "web",
+		Service: "api",
+		Ports:   []task.Port{{HostIP: net.ParseIP(ip), HostPort: 80, Proto: "tcp"}},
+	}}
+}
@@ -0,0 +1,66 @@
+package clusterdns
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/ahmetalpbalkan/wagl/clusterdns/refresh"
+	"github.com/ahmetalpbalkan/wagl/metrics"
+	"github.com/ahmetalpbalkan/wagl/rrgen"
+	"github.com/ahmetalpbalkan/wagl/rrstore"
+	"github.com/ahmetalpbalkan/wagl/task"
+	"github.com/miekg/dns"
+)
+
+// recordTypes are the types of records counted.
+var recordTypes = []uint16{dns.TypeA, dns.TypeSRV, dns.TypeTXT}
+
+// Metrics are the metrics of the syncs with the cluster, including the ones of
+// the refreshes.
+type Metrics struct {
+	tasks    *metrics.Gauge
+	badTasks *metrics.GaugeVec
+	records  *metrics.GaugeVec
+	refresh  *refresh.Metrics
+
+	// lastSync is the time of the last successful sync in Unix nanoseconds,
+	// or the creation time if the records are never synced. It is atomic.
+	lastSync int64
+}
+
+// NewMetrics creates the metrics of the syncs in the registry r.
+func NewMetrics(r *metrics.Registry) *Metrics {
+	m := &Metrics{
+		tasks:    r.NewGauge("wagl_cluster_tasks", "Tasks in the cluster as of the last sync."),
+		badTasks: r.NewGaugeVec("wagl_cluster_bad_tasks", "Tasks not eligible for DNS records as of the last sync, by reason.", "reason"),
+		records:  r.NewGaugeVec("wagl_dns_records", "DNS records in the table as of the last sync, by type.", "type"),
+		refresh:  refresh.NewMetrics(r),
+		lastSync: time.Now().UnixNano(),
+	}
+	r.NewGaugeFunc("wagl_cluster_sync_age_seconds", "Time since the records are last synced with the cluster, or since startup if never.", func() float64 {
+		return time.Since(time.Unix(0, atomic.LoadInt64(&m.lastSync))).Seconds()
+	})
+	return m
+}
+
+// observeSync updates the metrics with the results of a successful sync.
+func (m *Metrics) observeSync(state task.ClusterState, rl rrstore.RRs, bad []rrgen.BadTask) {
+	atomic.StoreInt64(&m.lastSync, time.Now().UnixNano())
+	m.tasks.Set(float64(len(state)))
+
+	reasons := make(map[string]int)
+	for _, t := range bad {
+		reasons[t.Filter]++
+	}
+	for _, f := range rrgen.DnsFilters {
+		m.badTasks.With(f.Name).Set(float64(reasons[f.Name]))
+	}
+
+	for _, t := range recordTypes {
+		n := 0
+		for _, recs := range rl[t] {
+			n += len(recs)
+		}
+		m.records.With(dns.TypeToString[t]).Set(float64(n))
+	}
+}
@@ -0,0 +1,18 @@
+package refresh
+
+import "github.com/ahmetalpbalkan/wagl/metrics"
+
+// Metrics are the metrics of the refreshes.
+type Metrics struct {
+	refreshes *metrics.CounterVec
+	duration  *metrics.Histogram
+}
+
+// NewMetrics creates the metrics of the refreshes in the registry r.
+func NewMetrics(r *metrics.Registry) *Metrics {
+	return &Metrics{
+		refreshes: r.NewCounterVec("wagl_refresh_total", "Refreshes of the DNS records, by result (success, error, timeout or skipped).", "result"),
+		duration: r.NewHistogram("wagl_refresh_duration_seconds", "Time taken to refresh the DNS records.",
+			[]float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}),
+	}
+}
@@ -1,49 +1,189 @@
+// Package refresh provides a loop calling a function periodically, one call at
+// a time, backing off on consecutive failures.
 package refresh
 
 import (
+	"context"
 	"errors"
+	"math/rand"
 	"time"
+
+	"github.com/ahmetalpbalkan/wagl/metrics"
 )
 
-type RefreshFunc func(cancel <-chan struct{}) error
+// DefaultJitter is the default fraction of the delay between the calls that is
+// randomly added or subtracted.
+const DefaultJitter = 0.1
+
+var errTimeout = errors.New("refreshing timed out")
+
+// ErrSkipped is returned by a RefreshFunc which completes without refreshing,
+// e.g. because its result is superseded. Such calls are neither successes nor
+// failures: nothing is sent on the channels and the backoff is unchanged.
+var ErrSkipped = errors.New("refresh skipped")
+
+// RefreshFunc does a single refresh. It must return promptly once ctx is done,
+// which happens when the call times out or the refresh loop is cancelled.
+type RefreshFunc func(ctx context.Context) error
+
+// Loop calls a RefreshFunc every interval. Calls never overlap: the delay
+// until the next call starts once the previous call returns. After consecutive
+// failures, the delay is doubled for every failure up to MaxBackoff.
+type Loop struct {
+	f        RefreshFunc
+	interval time.Duration
+	timeout  time.Duration
+
+	// Jitter is the fraction of the delay between the calls that is randomly
+	// added or subtracted, so that instances started together do not call
+	// the cluster at the same time.
+	Jitter float64
+
+	// MaxBackoff is the maximum delay between the calls after failures. The
+	// delay is never less than the interval.
+	MaxBackoff time.Duration
+
+	// Metrics are the metrics the calls are counted in, created in a registry
+	// of their own by New. They must not be changed once the loop is started.
+	Metrics *Metrics
+
+	trigger chan struct{}
+	done    chan struct{}
+	after   func(time.Duration) <-chan time.Time
+	rand    func() float64
+}
+
+// New creates a Loop calling f every interval, with each call timing out after
+// timeout.
+func New(f RefreshFunc, interval, timeout time.Duration) *Loop {
+	return &Loop{
+		f:          f,
+		interval:   interval,
+		timeout:    timeout,
+		Jitter:     DefaultJitter,
+		MaxBackoff: interval,
+		Metrics:    NewMetrics(metrics.NewRegistry()),
+		trigger:    make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		after:      time.After,
+		rand:       rand.Float64,
+	}
+}
+
+// Trigger makes the next call happen right away without waiting for the delay.
+// If a call is in progress, the next call happens as soon as it returns.
+// Triggers made before the next call starts are merged into one.
+func (l *Loop) Trigger() {
+	select {
+	case l.trigger <- struct{}{}:
+	default: // already triggered
+	}
+}
 
-// New starts a new loop to call f and returns two channels, one for errors that
-// come out of the calls to f or the refresh loop, and one for signaling every
-// time f returns successfully.
-func New(f RefreshFunc, tickCh <-chan time.Time, timeout time.Duration, cancelCh <-chan struct{}) (<-chan error, <-chan struct{}) {
+// Start starts the loop in the background and returns two channels, one for
+// errors that come out of the calls to f, and one for signaling every time f
+// returns successfully. The loop stops when cancel is closed, aborting the
+// call in progress.
+func (l *Loop) Start(cancel <-chan struct{}) (<-chan error, <-chan struct{}) {
 	errCh := make(chan error, 1) // buffered so that we don't block on error
 	okCh := make(chan struct{}, 1)
 
-	go func() { // in the background
-		for _ = range tickCh {
-			// handle starting, timeout, cancellation or completion of call
-			// to f in the background
-			go func() {
-				cancelF := make(chan struct{})
-				doneF := make(chan struct{}, 1)
-				errF := make(chan error, 1)
-				go func() { // Kick "f" off in the background
-					err := f(cancelF)
-					if err != nil {
-						errF <- err
-					} else {
-						doneF <- struct{}{} // never blocks sending b/c buffered
-					}
-				}()
+	go func() {
+		defer close(l.done)
+		failures := 0
+		for {
+			select {
+			case <-cancel:
+				return
+			case <-l.after(l.delay(failures)):
+			case <-l.trigger:
+			}
+
+			start := time.Now()
+			ok, err := l.call(cancel)
+			if !ok {
+				return
+			}
+			l.Metrics.duration.Observe(time.Since(start).Seconds())
+			l.Metrics.refreshes.With(result(err)).Inc()
+			if err == ErrSkipped {
+				continue
+			} else if err != nil {
+				failures++
 				select {
-				case <-time.After(timeout): // task timed out
-					errCh <- errors.New("refreshing timed out")
-					close(cancelF)
-				case <-cancelCh: // cancellation from upstream
-					close(cancelF)
-				case err := <-errF: // f errored
-					errCh <- err
-				case <-doneF: // task done
-					okCh <- struct{}{}
+				case errCh <- err:
+				case <-cancel:
+					return
 				}
-
-			}()
+			} else {
+				failures = 0
+				select {
+				case okCh <- struct{}{}:
+				case <-cancel:
+					return
+				}
+			}
 		}
 	}()
 	return errCh, okCh
 }
+
+// call calls f and waits until it returns. It returns false if the loop is
+// cancelled in the meantime, once the aborted call returns.
+func (l *Loop) call(cancel <-chan struct{}) (bool, error) {
+	ctx, cancelF := context.WithCancel(context.Background())
+	defer cancelF()
+	errF := make(chan error, 1)
+	go func() { errF <- l.f(ctx) }() // never blocks sending b/c buffered
+
+	select {
+	case err := <-errF:
+		return true, err
+	case <-cancel:
+		cancelF()
+		<-errF
+		return false, nil
+	case <-l.after(l.timeout):
+		cancelF()
+	}
+	// f is aborted, wait until it returns so that the calls never overlap
+	<-errF
+	select {
+	case <-cancel:
+		return false, nil
+	default:
+		return true, errTimeout
+	}
+}
+
+// Done returns a channel that is closed once the loop stops after it is
+// cancelled, and the call in progress, if any, returns.
+func (l *Loop) Done() <-chan struct{} {
+	return l.done
+}
+
+// result describes the result of a call in metrics.
+func result(err error) string {
+	switch err {
+	case nil:
+		return "success"
+	case errTimeout:
+		return "timeout"
+	case ErrSkipped:
+		return "skipped"
+	}
+	return "error"
+}
+
+// delay gives the delay until the next call after the specified number of
+// consecutive failures, with jitter applied.
+func (l *Loop) delay(failures int) time.Duration {
+	d := l.interval
+	for i := 0; i < failures && d < l.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > l.MaxBackoff && l.MaxBackoff > l.interval {
+		d = l.MaxBackoff // doubled past the cap
+	}
+	return d + time.Duration(float64(d)*l.Jitter*(2*l.rand()-1))
+}
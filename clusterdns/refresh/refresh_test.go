@@ -1,6 +1,7 @@
 package refresh
 
 import (
+	"context"
 	"errors"
 	"sync"
 	"testing"
@@ -11,39 +12,79 @@ var (
 	dummyError = errors.New("dummy error")
 )
 
+// fakeClock hands the timers the loop waits on to the test, which fires them
+// manually.
+type fakeClock struct {
+	timers chan fakeTimer
+}
+
+type fakeTimer struct {
+	d time.Duration
+	c chan time.Time
+}
+
+func (c *fakeClock) after(d time.Duration) <-chan time.Time {
+	t := fakeTimer{d, make(chan time.Time, 1)}
+	c.timers <- t
+	return t.c
+}
+
+// fire waits for the next timer, which must be for d, and fires it.
+func (c *fakeClock) fire(t *testing.T, d time.Duration) {
+	select {
+	case tm := <-c.timers:
+		if tm.d != d {
+			t.Fatalf("wrong timer duration. expected: %v got: %v", d, tm.d)
+		}
+		tm.c <- time.Now()
+	case <-time.After(time.Second):
+		t.Fatalf("no timer for %v", d)
+	}
+}
+
+// skip waits for the next timer and leaves it unfired.
+func (c *fakeClock) skip(t *testing.T) {
+	select {
+	case <-c.timers:
+	case <-time.After(time.Second):
+		t.Fatal("no timer")
+	}
+}
+
+const (
+	testInterval = time.Second * 10
+	testTimeout  = time.Second * 5
+)
+
+// testLoop gives a loop that uses a fake clock and no jitter.
+func testLoop(f RefreshFunc) (*Loop, *fakeClock) {
+	c := &fakeClock{timers: make(chan fakeTimer, 100)}
+	l := New(f, testInterval, testTimeout)
+	l.after = c.after
+	l.rand = func() float64 { return 0.5 }
+	return l, c
+}
+
 func TestRefresh_simple(t *testing.T) {
 	i := 0
-	f := func(cancel <-chan struct{}) error {
+	f := func(ctx context.Context) error {
 		i++
 		return nil
 	}
-	tick := make(chan time.Time)
+	l, c := testLoop(f)
 	done := make(chan struct{})
-	errCh, okCh := New(f, tick, time.Millisecond*15, done)
-
-	go func() {
-		for err := range errCh {
-			t.Fatalf("err received: %v", err)
-		}
-	}()
+	defer close(done)
+	errCh, okCh := l.Start(done)
 
-	// (tick + sleep 10 ms) * 5
 	n := 5
-	go func() {
-		for j := 0; j < n; j++ {
-			tick <- time.Now()
-			time.Sleep(time.Millisecond * 10)
-		}
-	}()
-
-	// validate ok signals
 	for j := 0; j < n; j++ {
-		<-okCh
-	}
-	select {
-	case <-okCh:
-		t.Fatal("okCh still has values")
-	default:
+		c.fire(t, testInterval)
+		c.skip(t) // timeout
+		select {
+		case <-okCh:
+		case err := <-errCh:
+			t.Fatalf("err received: %v", err)
+		}
 	}
 
 	// validate calls to f are made
@@ -53,81 +94,51 @@ func TestRefresh_simple(t *testing.T) {
 }
 
 func TestRefresh_timeout(t *testing.T) {
-	// orchestrate predefined sleeps on each call to f
-	sleeps := []int{1, 5, 15, 20, 25, 2, 3, 2}
-	var m sync.Mutex
-	cur := 0
-
-	var ww sync.WaitGroup
-
-	f := func(cancel <-chan struct{}) error {
-		defer ww.Done()
-		m.Lock()
-		d := time.Duration(sleeps[cur]) * time.Millisecond
-		cur++
-		num := cur
-		m.Unlock()
-
-		t.Logf("f%d sleep for: %v -- %v", num, d, time.Now())
-		select {
-		case <-cancel:
-			t.Logf("f%d is cancelled", num)
-		case <-time.After(d):
-			t.Logf("f%d done: %v", num, time.Now())
-		}
+	fCancelled := make(chan struct{}, 1)
+	f := func(ctx context.Context) error {
+		<-ctx.Done()
+		fCancelled <- struct{}{}
 		return nil
 	}
-
-	tick := make(chan time.Time)
+	l, c := testLoop(f)
 	done := make(chan struct{})
-	errCh, okCh := New(f, tick, time.Millisecond*10, done) //TODO use okch
-
-	// send all ticks at once (won't block b/c buffered ch)
-	ww.Add(len(sleeps))
-	for _ = range sleeps {
-		tick <- time.Now()
-	}
-	ww.Wait()
+	defer close(done)
+	errCh, okCh := l.Start(done)
 
-	expectedErrs := 3
-	for i := 0; i < expectedErrs; i++ {
-		<-errCh
-	}
+	c.fire(t, testInterval)
+	c.fire(t, testTimeout)
 	select {
-	case <-errCh:
-		t.Fatal("there are more errors")
-	default:
-	}
-
-	expectedOks := len(sleeps) - expectedErrs
-	for i := 0; i < expectedOks; i++ {
-		<-okCh
+	case err := <-errCh:
+		if err != errTimeout {
+			t.Fatalf("got wrong error: %v", err)
+		}
+	case <-okCh:
+		t.Fatal("timed out call succeeded")
 	}
 	select {
-	case <-okCh:
-		t.Fatal("there are more OKs")
+	case <-fCancelled:
 	default:
+		t.Fatal("f is not cancelled on timeout")
+	}
+	if v := l.Metrics.refreshes.With("timeout").Value(); v != 1 {
+		t.Fatalf("timeout is not counted: %d", v)
 	}
-	close(done)
 }
 
 func TestRefresh_errGoesToErrCh(t *testing.T) {
-	f := func(cancel <-chan struct{}) error {
+	f := func(ctx context.Context) error {
 		return dummyError
 	}
-	tick := make(chan time.Time)
+	l, c := testLoop(f)
+	l.MaxBackoff = testInterval
 	done := make(chan struct{})
 	defer close(done)
-	errCh, _ := New(f, tick, time.Millisecond*15, done) //TODO use okch
+	errCh, _ := l.Start(done)
 
 	n := 5
-	go func() {
-		for i := 0; i < n; i++ {
-			tick <- time.Now()
-		}
-	}()
-
 	for i := 0; i < n; i++ {
+		c.fire(t, testInterval)
+		c.skip(t)
 		err := <-errCh
 		if err != dummyError {
 			t.Fatalf("got wrong error: %v", err)
@@ -135,200 +146,201 @@ func TestRefresh_errGoesToErrCh(t *testing.T) {
 	}
 }
 
-func TestRefresh_cancelsTaskOnTimeout(t *testing.T) {
-	timeout := time.Millisecond * 20
-
-	f := func(cancel <-chan struct{}) error {
+func TestRefresh_skipped(t *testing.T) {
+	results := make(chan error)
+	f := func(ctx context.Context) error {
 		select {
-		case <-cancel:
-			t.Log("successfully cancelled")
-		case <-time.After(timeout * 2):
-			t.Fatal("did not cancel the task on timeout")
+		case err := <-results:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		return nil
 	}
-	tick := make(chan time.Time)
+	l, c := testLoop(f)
+	l.MaxBackoff = testInterval * 4
 	done := make(chan struct{})
 	defer close(done)
-
-	_, _ = New(f, tick, timeout, done) //TODO use okch
-
-	// send a tick
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		select {
-		case tick <- time.Now():
-		case <-done:
-			t.Fatal("could not send tick")
-		}
-	}()
-
-	wg.Wait()
+	errCh, okCh := l.Start(done)
+
+	c.fire(t, testInterval)
+	c.skip(t)
+	results <- dummyError
+	<-errCh
+
+	// skipped calls are not reported and do not reset the backoff
+	c.fire(t, testInterval*2)
+	c.skip(t)
+	results <- ErrSkipped
+	c.fire(t, testInterval*2)
+	select {
+	case err := <-errCh:
+		t.Fatalf("skipped call is reported as an error: %v", err)
+	case <-okCh:
+		t.Fatal("skipped call is reported as a success")
+	default:
+	}
+	if v := l.Metrics.refreshes.With("skipped").Value(); v != 1 {
+		t.Fatalf("skipped call is not counted: %d", v)
+	}
 }
 
 func TestRefresh_cancellation(t *testing.T) {
-	timeout := time.Second
-
+	started := make(chan struct{})
 	fCancelled := make(chan struct{}, 1)
-	f := func(cancel <-chan struct{}) error {
+	f := func(ctx context.Context) error {
+		close(started)
 		select {
-		case fCancelled <- <-cancel:
+		case fCancelled <- <-ctx.Done():
 			t.Log("got cancellation")
 		case <-time.After(time.Second):
-			t.Fatalf("f not cancelled")
+			t.Errorf("f not cancelled")
 		}
 		return nil
 	}
-	tick := make(chan time.Time, 1)
+	l, c := testLoop(f)
 	done := make(chan struct{})
+	l.Start(done)
 
-	_, _ = New(f, tick, timeout, done)
-	tick <- time.Now() // won't block
-
-	<-time.After(time.Millisecond * 10)
+	c.fire(t, testInterval)
+	<-started
 	t.Log("closing cancel ch")
 	close(done) // cancel!
 
-	time.Sleep(time.Millisecond * 20) // give f some time to cancel
-
 	select {
 	case <-fCancelled:
 		t.Log("cancellation happened")
-	default:
+	case <-time.After(time.Second):
 		t.Fatal("f did not do cancellation")
 	}
+	select {
+	case <-l.Done():
+	case <-time.After(time.Second):
+		t.Fatal("loop is not done after cancellation")
+	}
 }
 
-func TestRefresh_fTakesMoreTimeThanTicks_soThatTasksInterleave(t *testing.T) {
-	started := 0
-	n := 10 // tick count
-	finished := make(chan struct{}, n)
-
-	sleep := 200 * time.Millisecond
-
+func TestRefresh_callsDoNotOverlap(t *testing.T) {
 	var m sync.Mutex
-	f := func(cancel <-chan struct{}) error {
+	calls, running, maxRunning := 0, 0, 0
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	f := func(ctx context.Context) error {
 		m.Lock()
-		started++
+		calls++
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
 		m.Unlock()
-		t.Log("task started")
+		started <- struct{}{}
 
-		select {
-		case <-time.After(sleep):
-			t.Log("task done")
-			finished <- struct{}{}
-		case <-cancel:
-		}
+		<-release
+		m.Lock()
+		running--
+		m.Unlock()
 		return nil
 	}
-
+	l, c := testLoop(f)
 	done := make(chan struct{})
 	defer close(done)
-	tick := make(chan time.Time)
-	_, _ = New(f, tick, time.Second, done)
-
-	var wg sync.WaitGroup
-	wg.Add(n)
+	_, okCh := l.Start(done)
 
-	start := time.Now()
+	c.fire(t, testInterval)
+	<-started
+	c.skip(t) // timeout, never fires
 
-	// send ticks
-	for i := 0; i < n; i++ {
-		t.Logf("--> scheduling (%d): %v", i, time.Now())
-		go func(num int) {
-			defer wg.Done()
-
-			select {
-			case tick <- time.Now():
-				t.Logf("--- scheduled (%d)...: %v", num, time.Now())
-			case <-done:
-				t.Fatalf("retryloop is canceled before sending tick")
-			}
-		}(i)
+	// triggers while f is running are merged into one call
+	for i := 0; i < 5; i++ {
+		l.Trigger()
+	}
+	select {
+	case <-started:
+		t.Fatal("f is called while the previous call is running")
+	case <-time.After(time.Millisecond * 50):
 	}
-	wg.Wait()
 
-	// prove calls to f interleave and not serialized
-	d := time.Since(start)
-	if expMax := sleep; d > expMax {
-		t.Fatalf("sending ticks took longer than expected (%v > %v). are they blocked on f to return? ", d, expMax)
+	release <- struct{}{}
+	<-okCh
+	c.skip(t) // delay, not waited because of the trigger
+	<-started
+	c.skip(t)
+	release <- struct{}{}
+	<-okCh
+
+	select {
+	case <-started:
+		t.Fatal("triggers are not merged")
+	case <-time.After(time.Millisecond * 50):
 	}
 
-	var wg2 sync.WaitGroup
-	wg2.Add(n)
-	for i := 0; i < n; i++ {
-		go func() {
-			defer wg2.Done()
-			<-finished
-		}()
+	m.Lock()
+	defer m.Unlock()
+	if calls != 2 || maxRunning != 1 {
+		t.Fatalf("wrong calls: %d, max concurrent calls: %d", calls, maxRunning)
 	}
-	wg2.Wait()
 }
 
-func TestRefresh_fSometimesReturnsErr(t *testing.T) {
-	vals := []bool{false, true, false, false, true, false}
-	cur := 0
-	var m sync.Mutex
-	f := func(c <-chan struct{}) error {
-		m.Lock()
-		v := vals[cur]
-		cur++
-		m.Unlock()
-
-		if !v {
-			return dummyError
-		}
-		return nil
+func TestRefresh_backoff(t *testing.T) {
+	results := make(chan error)
+	f := func(ctx context.Context) error {
+		return <-results
 	}
-
-	tick := make(chan time.Time)
+	l, c := testLoop(f)
+	l.MaxBackoff = testInterval * 5
 	done := make(chan struct{})
-	errCh, okCh := New(f, tick, time.Second, done)
 	defer close(done)
-
-	// send ticks
-	go func() {
-		for _ = range vals {
-			tick <- time.Now()
-		}
-	}()
-
-	expectedErrs := 4
-	expectedOKs := len(vals) - expectedErrs
-
-	oks := 0
-	errs := 0
-
-	for {
-		if oks+errs == len(vals) {
-			break
-		}
+	errCh, okCh := l.Start(done)
+
+	for i, cs := range []struct {
+		delay time.Duration
+		err   error
+	}{
+		{testInterval, dummyError},
+		{testInterval * 2, dummyError},
+		{testInterval * 4, dummyError},
+		{testInterval * 5, dummyError}, // capped
+		{testInterval * 5, nil},
+		{testInterval, dummyError}, // reset after success
+		{testInterval * 2, nil},
+	} {
+		c.fire(t, cs.delay)
+		c.skip(t)
+		results <- cs.err
 		select {
+		case err := <-errCh:
+			if cs.err == nil {
+				t.Fatalf("case %d: err received: %v", i, err)
+			}
 		case <-okCh:
-			oks++
-		case <-errCh:
-			errs++
+			if cs.err != nil {
+				t.Fatalf("case %d: no error received", i)
+			}
 		}
 	}
+}
 
-	if errs != expectedErrs {
-		t.Fatalf("wrong errs count: %d, expected: %d", errs, expectedErrs)
-	}
-	if oks != expectedOKs {
-		t.Fatalf("wrong OKs count: %d, expected: %d", oks, expectedOKs)
-	}
-
-	t.Log("alright... see if chans still have value")
-	select {
-	case <-errCh:
-		t.Fatal("errCh still has value")
-	default:
+func TestRefresh_delay(t *testing.T) {
+	l := New(nil, testInterval, testTimeout)
+	cases := []struct {
+		maxBackoff time.Duration
+		failures   int
+		rand       float64
+		expected   time.Duration
+	}{
+		{testInterval, 0, 0.5, testInterval},
+		{testInterval, 3, 0.5, testInterval},
+		{testInterval / 2, 3, 0.5, testInterval}, // never less than interval
+		{time.Minute, 1, 0.5, testInterval * 2},
+		{time.Minute, 100, 0.5, time.Minute},
+		{time.Minute, 0, 0, testInterval * 9 / 10},
+		{time.Minute, 0, 1, testInterval * 11 / 10},
+		{time.Minute, 100, 1, time.Minute * 11 / 10},
 	}
-	select {
-	case <-okCh:
-		t.Fatal("okCh still has value")
-	default:
+	for i, c := range cases {
+		l.MaxBackoff = c.maxBackoff
+		l.rand = func() float64 { return c.rand }
+		if d := l.delay(c.failures); d != c.expected {
+			t.Fatalf("case %d: wrong delay. expected: %v got: %v", i, c.expected, d)
+		}
 	}
 }
@@ -0,0 +1,89 @@
+package staleness
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// StaleTTL is the maximum TTL of the stale records served (RFC 8767 4).
+	StaleTTL = 30
+
+	// edeOption is the EDNS0 option code of Extended DNS Errors (RFC 8914).
+	edeOption = 15
+
+	// edeStaleAnswer is the Extended DNS Error code of stale answers.
+	edeStaleAnswer = 3
+)
+
+// Handler wraps the DNS handler h so that, while the records are stale, the
+// queries for the names in domain are answered as specified by the policy.
+// Queries outside the domain are always passed to h as is.
+func (t *Tracker) Handler(p Policy, domain string, h dns.Handler) dns.Handler {
+	if p != ServeStale && p != ServFail {
+		return h
+	}
+	domain = strings.ToLower(dns.Fqdn(domain))
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		if len(r.Question) == 0 || !dns.IsSubDomain(domain, strings.ToLower(r.Question[0].Name)) || !t.Stale() {
+			h.ServeDNS(w, r)
+			return
+		}
+		if p == ServFail {
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeServerFailure)
+			w.WriteMsg(m)
+			return
+		}
+		h.ServeDNS(&staleWriter{ResponseWriter: w, req: r}, r)
+	})
+}
+
+// staleWriter is a dns.ResponseWriter marking the responses as stale.
+type staleWriter struct {
+	dns.ResponseWriter
+	req *dns.Msg
+}
+
+func (w *staleWriter) WriteMsg(m *dns.Msg) error {
+	return w.ResponseWriter.WriteMsg(markStale(w.req, m))
+}
+
+func (w *staleWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return w.ResponseWriter.Write(b) // cannot mark, let it go
+	}
+	return len(b), w.ResponseWriter.WriteMsg(markStale(w.req, m))
+}
+
+// markStale caps the TTLs of the records in the response m to the query r at
+// StaleTTL and, if the client supports EDNS0, adds an Extended DNS Error
+// indicating the answer is stale. Records are copied before modified, as they
+// may be shared with other responses.
+func markStale(r, m *dns.Msg) *dns.Msg {
+	for _, l := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for i, rr := range l {
+			if rr.Header().Rrtype == dns.TypeOPT || rr.Header().Ttl <= StaleTTL {
+				continue
+			}
+			rr = dns.Copy(rr)
+			rr.Header().Ttl = StaleTTL
+			l[i] = rr
+		}
+	}
+
+	if ropt := r.IsEdns0(); ropt != nil {
+		opt := m.IsEdns0()
+		if opt == nil {
+			m.SetEdns0(ropt.UDPSize(), ropt.Do())
+			opt = m.IsEdns0()
+		}
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+			Code: edeOption,
+			Data: []byte{0, edeStaleAnswer},
+		})
+	}
+	return m
+}
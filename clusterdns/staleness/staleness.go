@@ -0,0 +1,106 @@
+// Package staleness tracks how fresh the DNS records are and decides how to
+// answer the queries for the records once they go stale.
+package staleness
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Policy determines what happens when the records go stale.
+type Policy string
+
+const (
+	// Exit exits the program rather than serving stale records.
+	Exit Policy = "exit"
+
+	// ServeStale keeps serving the stale records with reduced TTLs and an
+	// Extended DNS Error indicating the answer is stale (RFC 8767, 8914).
+	ServeStale Policy = "serve-stale"
+
+	// ServFail answers the queries for the records with SERVFAIL while
+	// still answering the queries outside the domain.
+	ServFail Policy = "servfail"
+)
+
+// Policies are the supported policies.
+var Policies = []Policy{Exit, ServeStale, ServFail}
+
+// ParsePolicy parses the name of a policy.
+func ParsePolicy(s string) (Policy, error) {
+	for _, p := range Policies {
+		if string(p) == s {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unknown staleness policy: '%s' (supported: %v)", s, Policies)
+}
+
+// Tracker tracks the time the records are last refreshed. Records are stale
+// if they are not refreshed within the staleness period. It is safe for
+// concurrent use.
+type Tracker struct {
+	period time.Duration
+	now    func() time.Time
+
+	m           sync.Mutex
+	start       time.Time
+	lastSuccess time.Time
+	freshUntil  time.Time
+}
+
+// New creates a Tracker for records that go stale after not being refreshed
+// for period.
+func New(period time.Duration) *Tracker {
+	t := &Tracker{period: period, now: time.Now}
+	t.start = t.now()
+	return t
+}
+
+// Success records a successful refresh of the records.
+func (t *Tracker) Success() {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.lastSuccess = t.now()
+}
+
+// FreshUntil marks the records as fresh until the specified time unless they
+// are refreshed, such as the records loaded from a file on startup.
+func (t *Tracker) FreshUntil(deadline time.Time) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.freshUntil = deadline
+}
+
+// LastSuccess returns the time of the last successful refresh, zero if the
+// records are never refreshed.
+func (t *Tracker) LastSuccess() time.Time {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.lastSuccess
+}
+
+// Fresh returns if the records are refreshed within the staleness period, or
+// loaded records are still fresh. Unlike Stale, it is false on start until
+// the records are refreshed or loaded.
+func (t *Tracker) Fresh() bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	now := t.now()
+	if !t.lastSuccess.IsZero() {
+		return now.Sub(t.lastSuccess) <= t.period
+	}
+	return now.Before(t.freshUntil)
+}
+
+// Stale returns if the records are stale.
+func (t *Tracker) Stale() bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	now := t.now()
+	if !t.lastSuccess.IsZero() {
+		return now.Sub(t.lastSuccess) > t.period
+	}
+	return now.Sub(t.start) > t.period && now.After(t.freshUntil)
+}
@@ -0,0 +1,195 @@
+package staleness
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeClock is a manually advanced clock.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// testTracker gives a tracker that uses a fake clock.
+func testTracker(period time.Duration) (*Tracker, *fakeClock) {
+	c := &fakeClock{time.Unix(1445000000, 0)}
+	t := New(period)
+	t.now = c.now
+	t.start = c.now()
+	return t, c
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, p := range Policies {
+		if v, err := ParsePolicy(string(p)); err != nil || v != p {
+			t.Fatalf("cannot parse %s: %v", p, err)
+		}
+	}
+	if _, err := ParsePolicy("ignore"); err == nil {
+		t.Fatal("unknown policy is parsed")
+	}
+}
+
+func TestTracker(t *testing.T) {
+	tr, c := testTracker(time.Minute)
+	if tr.Stale() || tr.Fresh() {
+		t.Fatal("stale or fresh on start")
+	}
+	c.advance(time.Minute + time.Second)
+	if !tr.Stale() {
+		t.Fatal("not stale without a refresh within the period")
+	}
+
+	tr.Success()
+	if tr.Stale() || !tr.Fresh() || !tr.LastSuccess().Equal(c.now()) {
+		t.Fatal("stale after refresh")
+	}
+	c.advance(time.Minute)
+	if tr.Stale() || !tr.Fresh() {
+		t.Fatal("stale within the period")
+	}
+	c.advance(time.Second)
+	if !tr.Stale() || tr.Fresh() {
+		t.Fatal("not stale after the period")
+	}
+}
+
+func TestTracker_freshUntil(t *testing.T) {
+	tr, c := testTracker(time.Minute)
+	tr.FreshUntil(c.now().Add(time.Hour))
+	c.advance(time.Minute * 30)
+	if tr.Stale() || !tr.Fresh() {
+		t.Fatal("loaded records are stale before deadline")
+	}
+	c.advance(time.Minute * 31)
+	if !tr.Stale() || tr.Fresh() {
+		t.Fatal("loaded records are not stale after deadline")
+	}
+
+	// refreshes override the deadline
+	tr, c = testTracker(time.Minute)
+	tr.FreshUntil(c.now().Add(time.Hour))
+	tr.Success()
+	c.advance(time.Minute * 2)
+	if !tr.Stale() {
+		t.Fatal("not stale after the period since refresh")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	tr, c := testTracker(time.Minute)
+	h := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 10.0.0.1")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+
+	cases := []struct {
+		policy   Policy
+		name     string
+		stale    bool
+		edns     bool
+		rcode    int
+		ttl      uint32
+		expected bool // EDE expected
+	}{
+		// fresh records are passed as is
+		{ServeStale, "api.swarm.", false, true, dns.RcodeSuccess, 300, false},
+		{ServFail, "api.swarm.", false, true, dns.RcodeSuccess, 300, false},
+		// stale records
+		{Exit, "api.swarm.", true, true, dns.RcodeSuccess, 300, false},
+		{ServeStale, "api.swarm.", true, true, dns.RcodeSuccess, StaleTTL, true},
+		{ServeStale, "API.Swarm.", true, false, dns.RcodeSuccess, StaleTTL, false},
+		{ServFail, "api.swarm.", true, true, dns.RcodeServerFailure, 0, false},
+		// external names are not affected
+		{ServeStale, "example.com.", true, true, dns.RcodeSuccess, 300, false},
+		{ServFail, "example.com.", true, true, dns.RcodeSuccess, 300, false},
+	}
+	for i, cs := range cases {
+		tr.Success()
+		if cs.stale {
+			c.advance(time.Hour)
+		}
+		r := new(dns.Msg)
+		r.SetQuestion(cs.name, dns.TypeA)
+		if cs.edns {
+			r.SetEdns0(4096, false)
+		}
+		w := &fakeWriter{}
+		tr.Handler(cs.policy, "swarm", h).ServeDNS(w, r)
+		if len(w.msgs) != 1 {
+			t.Fatalf("case %d: wrong number of responses: %d", i, len(w.msgs))
+		}
+		m := w.msgs[0]
+		if m.Rcode != cs.rcode {
+			t.Fatalf("case %d: wrong rcode: %s", i, dns.RcodeToString[m.Rcode])
+		}
+		if len(m.Answer) > 0 && m.Answer[0].Header().Ttl != cs.ttl {
+			t.Fatalf("case %d: wrong TTL: %d", i, m.Answer[0].Header().Ttl)
+		}
+		if hasEDE(m) != cs.expected {
+			t.Fatalf("case %d: wrong extended error: %v", i, m.Extra)
+		}
+	}
+}
+
+func hasEDE(m *dns.Msg) bool {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_LOCAL); ok && e.Code == edeOption &&
+			len(e.Data) == 2 && e.Data[1] == edeStaleAnswer {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMarkStale_copiesRecords(t *testing.T) {
+	rr, _ := dns.NewRR("api.swarm. 300 IN A 10.0.0.1")
+	r := new(dns.Msg)
+	r.SetQuestion("api.swarm.", dns.TypeA)
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = []dns.RR{rr}
+
+	// wire format round trip as the prepacked responses are written
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &fakeWriter{}
+	(&staleWriter{ResponseWriter: w, req: r}).Write(b)
+	if w.msgs[0].Answer[0].Header().Ttl != StaleTTL {
+		t.Fatal("TTL is not reduced")
+	}
+
+	markStale(r, m)
+	if rr.Header().Ttl != 300 || m.Answer[0].Header().Ttl != StaleTTL {
+		t.Fatal("shared record is modified")
+	}
+}
+
+type fakeWriter struct {
+	dns.ResponseWriter
+	msgs []*dns.Msg
+}
+
+func (w *fakeWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+}
+
+func (w *fakeWriter) WriteMsg(m *dns.Msg) error {
+	w.msgs = append(w.msgs, m)
+	return nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ahmetalpbalkan/wagl/clusterdns"
+	"github.com/ahmetalpbalkan/wagl/rrgen"
+	"github.com/ahmetalpbalkan/wagl/rrstore"
+	"github.com/ahmetalpbalkan/wagl/server"
+	"github.com/ahmetalpbalkan/wagl/swarm"
+	"github.com/ahmetalpbalkan/wagl/task"
+	"github.com/codegangsta/cli"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultQueryServer = "127.0.0.1:53"
+
+	// Formats of the records
+	recordsFormatTable = "table"
+	recordsFormatJSON  = "json"
+)
+
+var recordsFormatFlag = cli.StringFlag{
+	Name:  "format",
+	Value: recordsFormatTable,
+	Usage: "format of the output: table or json",
+}
+
+var queryFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "server",
+		Value: defaultQueryServer,
+		Usage: "DNS server to query, as IP[:port] or tls://IP[:port][#server-name]",
+	},
+	cli.BoolFlag{
+		Name:  "tcp",
+		Usage: "query over TCP instead of UDP",
+	},
+	cli.BoolFlag{
+		Name:  "norecurse",
+		Usage: "do not ask the server to query other nameservers (RD=0)",
+	},
+}
+
+// setCommandLogger sets the default logger of a command checking what would be
+// served as configured. Logs are written to stderr, the output of the command
+// to stdout.
+func setCommandLogger(opt *Options) {
+	logger, _ := newLogger(os.Stderr, opt.logFormat, logLevel(opt.logLevel))
+	slog.SetDefault(logger)
+}
+
+// newCluster connects to the Swarm manager specified in the options.
+func newCluster(opt *Options) (*swarm.Swarm, error) {
+	dockerTLS, err := tlsConfig(opt.tlsDir, opt.tlsVerify)
+	if err != nil {
+		return nil, fmt.Errorf("error establishing TLS config: %v", err)
+	}
+	cl, err := swarm.New(opt.swarmAddr, dockerTLS)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing Swarm: %v", err)
+	}
+	return cl, nil
+}
+
+// clusterState lists the tasks in the cluster once, within the refresh
+// timeout.
+func clusterState(opt *Options) (task.ClusterState, error) {
+	cl, err := newCluster(opt)
+	if err != nil {
+		return nil, err
+	}
+	defer cl.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), opt.refreshTimeout)
+	defer cancel()
+	return cl.Tasks(ctx)
+}
+
+// recordsAction prints the records that would be generated from the tasks in
+// the cluster and the tasks not eligible for them.
+func recordsAction(c *cli.Context) {
+	format := c.String(recordsFormatFlag.Name)
+	if format != recordsFormatTable && format != recordsFormatJSON {
+		fatal("Invalid configuration", "error", fmt.Errorf("Unknown --format value: '%s'", format))
+	}
+	opts, err := loadOptions(c)
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	setCommandLogger(opts)
+	state, err := clusterState(opts)
+	if err != nil {
+		fatal("Error listing tasks in the cluster", "error", err)
+	}
+	rl, bad := clusterdns.Records(slog.Default(), opts.domain, state, serviceConfig(opts).Records)
+
+	// Store the records to build them as they would be served.
+	rr := rrstore.New()
+	if err := rr.Set(1, rl); err != nil {
+		fatal("Error generating records", "error", err)
+	}
+	_, rl = rr.Records()
+	if format == recordsFormatJSON {
+		writeRecordsJSON(os.Stdout, rl, bad)
+	} else {
+		writeRecordsTable(os.Stdout, rl, bad)
+	}
+}
+
+type recordsOutput struct {
+	Records  []recordOutput  `json:"records"`
+	BadTasks []badTaskOutput `json:"bad_tasks"`
+}
+
+type recordOutput struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	TTL    uint32 `json:"ttl"`
+	Value  string `json:"value"`
+	TaskID string `json:"task,omitempty"`
+}
+
+type badTaskOutput struct {
+	ID      string `json:"id"`
+	Service string `json:"service,omitempty"`
+	Domain  string `json:"domain,omitempty"`
+	Filter  string `json:"filter"`
+	Reason  string `json:"reason"`
+}
+
+// sortedRecords lists the records sorted by name, type and value.
+func sortedRecords(rl rrstore.RRs) []recordOutput {
+	out := []recordOutput{}
+	for t, names := range rl {
+		for name, recs := range names {
+			for _, rec := range recs {
+				rr := rec.RR()
+				out = append(out, recordOutput{
+					Name:   name,
+					Type:   dns.TypeToString[t],
+					TTL:    rec.TTL,
+					Value:  strings.TrimSpace(strings.TrimPrefix(rr.String(), rr.Header().String())),
+					TaskID: rec.TaskID,
+				})
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Value < b.Value
+	})
+	return out
+}
+
+func badTasks(bad []rrgen.BadTask) []badTaskOutput {
+	out := []badTaskOutput{}
+	for _, t := range bad {
+		out = append(out, badTaskOutput{
+			ID:      t.Id,
+			Service: t.Service,
+			Domain:  t.Domain,
+			Filter:  t.Filter,
+			Reason:  t.Reason,
+		})
+	}
+	return out
+}
+
+func writeRecordsJSON(w io.Writer, rl rrstore.RRs, bad []rrgen.BadTask) {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(recordsOutput{Records: sortedRecords(rl), BadTasks: badTasks(bad)})
+}
+
+func writeRecordsTable(w io.Writer, rl rrstore.RRs, bad []rrgen.BadTask) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tTYPE\tTTL\tVALUE\tTASK")
+	for _, r := range sortedRecords(rl) {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", r.Name, r.Type, r.TTL, r.Value, r.TaskID)
+	}
+	tw.Flush()
+
+	if len(bad) == 0 {
+		return
+	}
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "BAD TASK\tSERVICE\tFILTER\tREASON")
+	for _, t := range badTasks(bad) {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", t.ID, t.Service, t.Filter, t.Reason)
+	}
+	tw.Flush()
+}
+
+// checkAction validates the configuration and checks that Swarm and the
+// external nameservers can be reached. It exits with an error if any of the
+// checks fails.
+func checkAction(c *cli.Context) {
+	opts, err := loadOptions(c)
+	if err != nil {
+		fmt.Printf("Configuration: FAILED: %v\n", err)
+		os.Exit(1)
+	}
+	setCommandLogger(opts)
+
+	ok := true
+	check := func(what string, f func() (string, error)) {
+		detail, err := f()
+		if err != nil {
+			ok = false
+			fmt.Printf("%s: FAILED: %v\n", what, err)
+			return
+		}
+		if detail != "" {
+			detail = " (" + detail + ")"
+		}
+		fmt.Printf("%s: OK%s\n", what, detail)
+	}
+
+	check("Configuration", func() (string, error) { return describeConfig(opts), nil })
+	if opts.tlsCert != "" {
+		check("TLS certificate", func() (string, error) {
+			_, err := serverTLSConfig(opts.tlsCert, opts.tlsKey, opts.tlsCA)
+			return opts.tlsCert, err
+		})
+	}
+	if opts.adminCA != "" {
+		check("Admin TLS client CA", func() (string, error) {
+			_, err := serverTLSConfig(opts.tlsCert, opts.tlsKey, opts.adminCA)
+			return opts.adminCA, err
+		})
+	}
+	check("Swarm "+opts.swarmAddr, func() (string, error) {
+		state, err := clusterState(opts)
+		if err != nil {
+			return "", err
+		}
+		_, bad := clusterdns.Records(slog.Default(), opts.domain, state, serviceConfig(opts).Records)
+		return fmt.Sprintf("%d tasks, %d not eligible for DNS records", len(state), len(bad)), nil
+	})
+	for _, ns := range opts.upstreams {
+		check("Nameserver "+ns.String(), func() (string, error) { return probeUpstream(ns, ".") })
+	}
+	zones := make([]string, 0, len(opts.forwardUpstreams))
+	for z := range opts.forwardUpstreams {
+		zones = append(zones, z)
+	}
+	sort.Strings(zones)
+	for _, z := range zones {
+		for _, ns := range opts.forwardUpstreams[z] {
+			check("Nameserver "+ns.String()+" of "+z, func() (string, error) { return probeUpstream(ns, z) })
+		}
+	}
+
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// describeConfig describes the configuration checked.
+func describeConfig(opt *Options) string {
+	if opt.configFile == "" {
+		return "flags"
+	}
+	return opt.configFile
+}
+
+// probeUpstream queries the nameserver for the SOA record of the zone and
+// describes its response. Any response counts, as the nameserver is reached.
+func probeUpstream(ns server.Upstream, zone string) (string, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(zone, dns.TypeSOA)
+	start := time.Now()
+	resp, err := ns.Exchange(m, "udp")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s in %v", dns.RcodeToString[resp.Rcode], time.Since(start).Round(time.Millisecond)), nil
+}
+
+// queryAction queries a DNS server for a name and prints the response.
+func queryAction(c *cli.Context) {
+	args := c.Args()
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "Usage: wagl query [options] name [type]")
+		os.Exit(1)
+	}
+	name, qType := dns.Fqdn(args[0]), dns.TypeA
+	if len(args) == 2 {
+		t, ok := dns.StringToType[strings.ToUpper(args[1])]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Unknown record type: '%s'\n", args[1])
+			os.Exit(1)
+		}
+		qType = t
+	}
+	ns, err := server.ParseUpstream(c.String("server"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	network := "udp"
+	if c.Bool("tcp") {
+		network = "tcp"
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(name, qType)
+	m.RecursionDesired = !c.Bool("norecurse")
+	start := time.Now()
+	resp, err := ns.Exchange(m, network)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error querying %s: %v\n", ns, err)
+		os.Exit(1)
+	}
+	fmt.Println(resp.String())
+	fmt.Printf(";; Query time: %v\n", time.Since(start).Round(time.Millisecond))
+	fmt.Printf(";; SERVER: %s (%s)\n", ns, network)
+}
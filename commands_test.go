@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/ahmetalpbalkan/wagl/rrgen"
+	"github.com/ahmetalpbalkan/wagl/rrstore"
+	"github.com/ahmetalpbalkan/wagl/task"
+	"github.com/codegangsta/cli"
+	"github.com/miekg/dns"
+)
+
+// testRecords gives the records as the records command prints them, built by
+// storing them.
+func testRecords(t *testing.T) rrstore.RRs {
+	rr := rrstore.New()
+	err := rr.Set(1, rrstore.RRs{
+		dns.TypeA: {
+			"api.swarm.": {
+				{Addr: net.ParseIP("10.0.0.2"), TaskID: "abc124"},
+				{Addr: net.ParseIP("10.0.0.1"), TaskID: "abc123"},
+			},
+			"db.swarm.": {{Addr: net.ParseIP("10.0.0.5"), TTL: 60}},
+		},
+		dns.TypeSRV: {
+			"_api._tcp.swarm.": {{Addr: net.ParseIP("10.0.0.1"), Port: 8080, Priority: 1, Weight: 1, TaskID: "abc123"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rl := rr.Records()
+	return rl
+}
+
+var testBadTasks = []rrgen.BadTask{{
+	Task:   task.Task{Id: "def456", Service: "api"},
+	Filter: "no-ports",
+	Reason: "has no port mappings",
+}, {
+	Task:   task.Task{Id: "fed789", Service: "web", Domain: "blue"},
+	Filter: "no-ipv4-port",
+	Reason: "has no IPv4 port mappings",
+}}
+
+func TestWriteRecords(t *testing.T) {
+	cases := []struct {
+		name     string
+		write    func(io.Writer, rrstore.RRs, []rrgen.BadTask)
+		rl       rrstore.RRs
+		bad      []rrgen.BadTask
+		expected string
+	}{
+		{"table", writeRecordsTable, testRecords(t), testBadTasks, `NAME              TYPE  TTL  VALUE               TASK
+_api._tcp.swarm.  SRV   0    1 1 8080 10.0.0.1.  abc123
+api.swarm.        A     0    10.0.0.1            abc123
+api.swarm.        A     0    10.0.0.2            abc124
+db.swarm.         A     60   10.0.0.5            
+
+BAD TASK  SERVICE  FILTER        REASON
+def456    api      no-ports      has no port mappings
+fed789    web      no-ipv4-port  has no IPv4 port mappings
+`},
+		{"table without bad tasks", writeRecordsTable, testRecords(t), nil, `NAME              TYPE  TTL  VALUE               TASK
+_api._tcp.swarm.  SRV   0    1 1 8080 10.0.0.1.  abc123
+api.swarm.        A     0    10.0.0.1            abc123
+api.swarm.        A     0    10.0.0.2            abc124
+db.swarm.         A     60   10.0.0.5            
+`},
+		{"empty table", writeRecordsTable, nil, nil, "NAME  TYPE  TTL  VALUE  TASK\n"},
+		{"json", writeRecordsJSON, testRecords(t), testBadTasks, `{
+  "records": [
+    {
+      "name": "_api._tcp.swarm.",
+      "type": "SRV",
+      "ttl": 0,
+      "value": "1 1 8080 10.0.0.1.",
+      "task": "abc123"
+    },
+    {
+      "name": "api.swarm.",
+      "type": "A",
+      "ttl": 0,
+      "value": "10.0.0.1",
+      "task": "abc123"
+    },
+    {
+      "name": "api.swarm.",
+      "type": "A",
+      "ttl": 0,
+      "value": "10.0.0.2",
+      "task": "abc124"
+    },
+    {
+      "name": "db.swarm.",
+      "type": "A",
+      "ttl": 60,
+      "value": "10.0.0.5"
+    }
+  ],
+  "bad_tasks": [
+    {
+      "id": "def456",
+      "service": "api",
+      "filter": "no-ports",
+      "reason": "has no port mappings"
+    },
+    {
+      "id": "fed789",
+      "service": "web",
+      "domain": "blue",
+      "filter": "no-ipv4-port",
+      "reason": "has no IPv4 port mappings"
+    }
+  ]
+}
+`},
+		{"empty json", writeRecordsJSON, nil, nil, `{
+  "records": [],
+  "bad_tasks": []
+}
+`},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		c.write(&buf, c.rl, c.bad)
+		if got := buf.String(); got != c.expected {
+			t.Errorf("%s: wrong output.\nexpected:\n%s\ngot:\n%s", c.name, c.expected, got)
+		}
+	}
+}
+
+func TestLoadOptions_flagsBeforeCommand(t *testing.T) {
+	for _, name := range []string{"records", "check"} {
+		app := newApp()
+		var opts *Options
+		for i := range app.Commands {
+			if app.Commands[i].Name == name {
+				app.Commands[i].Action = func(c *cli.Context) {
+					var err error
+					if opts, err = loadOptions(c); err != nil {
+						t.Fatalf("%s: %v", name, err)
+					}
+				}
+			}
+		}
+		app.Run([]string{"wagl", "--swarm", "tcp://10.0.0.10:2376", "--domain", "example.", "--ns", "8.8.8.8",
+			name, "--domain", "cluster."})
+		if opts == nil {
+			t.Fatalf("%s: command is not run", name)
+		}
+		if opts.swarmAddr != "tcp://10.0.0.10:2376" || len(opts.nameservers) != 1 {
+			t.Fatalf("%s: flags set before the command are ignored: %s", name, opts)
+		}
+		if opts.domain != "cluster." {
+			t.Fatalf("%s: flags set after the command do not take precedence: %s", name, opts)
+		}
+	}
+}
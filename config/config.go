@@ -0,0 +1,87 @@
+// Package config reads configuration files written in TOML (https://toml.io).
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// Table is a set of key/value pairs. Values are string, int64, float64, bool,
+// []interface{}, Table or one of the date and time types of go-toml. Inline
+// tables and arrays of tables are given as Table and []interface{} of Table.
+type Table map[string]interface{}
+
+// ReadFile reads and parses the configuration file at path.
+func ReadFile(path string) (Table, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t, line, err := parse(string(b))
+	if err != nil {
+		if line > 0 {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return t, nil
+}
+
+// Parse parses the configuration in s. Syntax errors are prefixed with the
+// line number they occur at.
+func Parse(s string) (Table, error) {
+	t, line, err := parse(s)
+	if err != nil && line > 0 {
+		return nil, fmt.Errorf("%d: %v", line, err)
+	}
+	return t, err
+}
+
+// parse parses the configuration in s, returning the line of the error if it
+// is known.
+func parse(s string) (Table, int, error) {
+	var m map[string]interface{}
+	if err := toml.Unmarshal([]byte(s), &m); err != nil {
+		msg := strings.TrimPrefix(err.Error(), "toml: ")
+		var de *toml.DecodeError
+		if errors.As(err, &de) {
+			line, _ := de.Position()
+			return nil, line, errors.New(msg)
+		}
+		return nil, 0, errors.New(msg)
+	}
+	return table(m), 0, nil
+}
+
+// table converts the map and the maps in it, as decoded, to Tables.
+func table(m map[string]interface{}) Table {
+	t := make(Table, len(m))
+	for k, v := range m {
+		t[k] = value(v)
+	}
+	return t
+}
+
+func value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return table(v)
+	case []map[string]interface{}:
+		l := make([]interface{}, len(v))
+		for i, m := range v {
+			l[i] = table(m)
+		}
+		return l
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = value(e)
+		}
+		return l
+	}
+	return v
+}
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	s := `# wagl configuration
+domain = "swarm."   # trailing comment
+bind = ':53'
+external = true
+rrl = 1_000
+query-log-sample = 0.05
+ns = [
+  "8.8.8.8",   # primary
+  "tls://1.1.1.1#cloudflare-dns.com",
+]
+empty = []
+"quoted key" = "a \"b\"\t\u00e7"
+a.b = 1
+big = 1e3
+neg = -inf
+hex = 0x10
+oct = 0o17
+bin = 0b11
+inline = { x = 1 }
+multi = """
+a
+b"""
+
+[acl]
+allow-query = ["10.0.0.0/8", "127.0.0.1/32"]
+
+[forward-zones]
+"corp.example." = ["10.1.0.53"]
+
+[x.y]
+z = false
+
+[[servers]]
+name = "a"
+
+[[servers]]
+name = "b"
+`
+	expected := Table{
+		"domain":           "swarm.",
+		"bind":             ":53",
+		"external":         true,
+		"rrl":              int64(1000),
+		"query-log-sample": 0.05,
+		"ns":               []interface{}{"8.8.8.8", "tls://1.1.1.1#cloudflare-dns.com"},
+		"empty":            []interface{}{},
+		"quoted key":       "a \"b\"\tç",
+		"a":                Table{"b": int64(1)},
+		"big":              1e3,
+		"neg":              math.Inf(-1),
+		"hex":              int64(16),
+		"oct":              int64(15),
+		"bin":              int64(3),
+		"inline":           Table{"x": int64(1)},
+		"multi":            "a\nb",
+		"acl":              Table{"allow-query": []interface{}{"10.0.0.0/8", "127.0.0.1/32"}},
+		"forward-zones":    Table{"corp.example.": []interface{}{"10.1.0.53"}},
+		"x":                Table{"y": Table{"z": false}},
+		"servers":          []interface{}{Table{"name": "a"}, Table{"name": "b"}},
+	}
+	got, err := Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("wrong table.\nexpected: %#v\ngot:      %#v", expected, got)
+	}
+}
+
+func TestParse_errors(t *testing.T) {
+	cases := []struct {
+		in  string
+		err string
+	}{
+		{"a = 1\na = 2", "key a is already defined"},
+		{"[t]\n[t]", "table t already exists"},
+		{"a = 1\n[a]", "key a should be a table, not a value"},
+		{"a.b = 1\n[a]", "table a already exists"},
+		{"[a]\nb.c = 1\n[a.b]", "table b already exists"},
+		{"a = ", "1: expected value, not eof"},
+		{"a = \"foo", `1: basic string not terminated by "`},
+		{"a = 1 b = 2", "1: expected newline but got U+0062 'b'"},
+		{"\n\n= 1", "3: invalid character at start of key: ="},
+		{"a = 01", "1: leading zero not allowed on decimal number"},
+		{"a = -007", "1: leading zero not allowed on decimal number"},
+		{"a = infinity", "1: expected newline but got U+0069 'i'"},
+		{"a = Inf", "1: incomplete number"},
+		{"a = NaN", "1: incomplete number"},
+		{"a = 0x1p-2", "1: expected newline but got U+0070 'p'"},
+	}
+	for _, c := range cases {
+		_, err := Parse(c.in)
+		if err == nil || err.Error() != c.err {
+			t.Fatalf("%q: wrong error. expected: %q got: %v", c.in, c.err, err)
+		}
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wagl.toml")
+	if err := os.WriteFile(path, []byte("a = 1\nb ="), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadFile(path); err == nil || !strings.HasPrefix(err.Error(), path+":2: ") {
+		t.Fatalf("error without file and line: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("a = 1\na = 2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadFile(path); err == nil || !strings.HasPrefix(err.Error(), path+": ") {
+		t.Fatalf("error without file: %v", err)
+	}
+	if _, err := ReadFile(path + ".missing"); !os.IsNotExist(err) {
+		t.Fatalf("wrong error for missing file: %v", err)
+	}
+}
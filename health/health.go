@@ -0,0 +1,81 @@
+// Package health provides the HTTP endpoints to probe the liveness and the
+// readiness of the DNS server, e.g. by an orchestrator.
+package health
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ahmetalpbalkan/wagl/clusterdns/staleness"
+)
+
+// Handler serves the health endpoints:
+//
+//	GET /healthz   200 if the DNS listener is up
+//	GET /readyz    200 if the records are refreshed within the staleness
+//	               period and the DNS server answers a query
+//
+// Otherwise they respond 503 with the reason.
+type Handler struct {
+	tracker   *staleness.Tracker
+	listening func() bool
+	probe     func() error
+	mux       *http.ServeMux
+}
+
+// NewHandler creates a Handler that uses the tracker to tell if the records
+// are fresh, listening to tell if the DNS listener is up and probe to query
+// the DNS server.
+func NewHandler(tracker *staleness.Tracker, listening func() bool, probe func() error) *Handler {
+	h := &Handler{tracker: tracker, listening: listening, probe: probe, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/healthz", h.check(h.healthy))
+	h.mux.HandleFunc("/readyz", h.check(h.ready))
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// check adapts f that gives the reason of being unhealthy into an HTTP
+// handler.
+func (h *Handler) check(f func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "expected GET", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := f(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+func (h *Handler) healthy() error {
+	if !h.listening() {
+		return errors.New("DNS listener is not up")
+	}
+	return nil
+}
+
+func (h *Handler) ready() error {
+	if err := h.healthy(); err != nil {
+		return err
+	}
+	if !h.tracker.Fresh() {
+		if t := h.tracker.LastSuccess(); !t.IsZero() {
+			return fmt.Errorf("records are stale, last refreshed at %s", t.Format(time.RFC3339))
+		}
+		return errors.New("records are not refreshed yet")
+	}
+	if err := h.probe(); err != nil {
+		return fmt.Errorf("DNS server does not answer: %v", err)
+	}
+	return nil
+}
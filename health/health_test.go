@@ -0,0 +1,69 @@
+package health
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ahmetalpbalkan/wagl/clusterdns/staleness"
+)
+
+func get(h http.Handler, url string) (int, string) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+	return w.Code, w.Body.String()
+}
+
+func TestHandler(t *testing.T) {
+	var (
+		tracker   = staleness.New(time.Minute)
+		listening = false
+		probeErr  = errors.New("i/o timeout")
+	)
+	h := NewHandler(tracker,
+		func() bool { return listening },
+		func() error { return probeErr })
+
+	cases := []struct {
+		setup   func()
+		healthz int
+		readyz  int
+		reason  string
+	}{
+		{func() {}, http.StatusServiceUnavailable, http.StatusServiceUnavailable, "DNS listener is not up"},
+		{func() { listening = true }, http.StatusOK, http.StatusServiceUnavailable, "records are not refreshed yet"},
+		{func() { tracker.Success() }, http.StatusOK, http.StatusServiceUnavailable, "DNS server does not answer: i/o timeout"},
+		{func() { probeErr = nil }, http.StatusOK, http.StatusOK, "ok"},
+		{func() { listening = false }, http.StatusServiceUnavailable, http.StatusServiceUnavailable, "DNS listener is not up"},
+	}
+	for i, c := range cases {
+		c.setup()
+		if code, _ := get(h, "/healthz"); code != c.healthz {
+			t.Fatalf("case %d: wrong /healthz status: %d", i, code)
+		}
+		code, body := get(h, "/readyz")
+		if code != c.readyz {
+			t.Fatalf("case %d: wrong /readyz status: %d", i, code)
+		}
+		if strings.TrimSpace(body) != c.reason {
+			t.Fatalf("case %d: wrong /readyz response: %q", i, body)
+		}
+	}
+}
+
+func TestHandler_loaded(t *testing.T) {
+	tracker := staleness.New(time.Minute)
+	h := NewHandler(tracker, func() bool { return true }, func() error { return nil })
+
+	tracker.FreshUntil(time.Now().Add(time.Minute))
+	if code, body := get(h, "/readyz"); code != http.StatusOK {
+		t.Fatalf("not ready with fresh loaded records: %d %s", code, body)
+	}
+	tracker.FreshUntil(time.Now().Add(-time.Second))
+	if code, _ := get(h, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("ready with stale loaded records: %d", code)
+	}
+}
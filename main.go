@@ -1,142 +1,547 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
 	"net"
 	"os"
+	"os/signal"
+	"sort"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/ahmetalpbalkan/wagl/clusterdns"
+	"github.com/ahmetalpbalkan/wagl/clusterdns/staleness"
+	"github.com/ahmetalpbalkan/wagl/metrics"
 	"github.com/ahmetalpbalkan/wagl/rrstore"
 	"github.com/ahmetalpbalkan/wagl/server"
+	"github.com/ahmetalpbalkan/wagl/server/blocklist"
+	"github.com/ahmetalpbalkan/wagl/server/dnstap"
+	"github.com/ahmetalpbalkan/wagl/service"
 	"github.com/ahmetalpbalkan/wagl/swarm"
 
 	"github.com/codegangsta/cli"
 )
 
 const (
-	defaultDnsDomain       = "swarm."
-	defaultAddr            = ":53"
+	version = "0.1"
+
+	defaultDnsDomain       = service.DefaultDomain
+	defaultAddr            = service.DefaultAddr
+	defaultTLSAddr         = ":853"
 	defaultSwarm           = "127.0.0.1:2376"
-	defaultRefreshInterval = time.Second * 15
-	defaultRefreshTimeout  = time.Second * 10
-	defaultStalenessPeriod = time.Second * 60
+	defaultRefreshInterval = service.DefaultRefreshInterval
+	defaultRefreshTimeout  = service.DefaultRefreshTimeout
+	defaultRefreshBackoff  = service.DefaultRefreshMaxBackoff
+	defaultStalenessPeriod = service.DefaultStaleness
+	defaultSnapshotMaxAge  = service.DefaultSnapshotMaxAge
+	defaultShutdownTimeout = service.DefaultShutdownTimeout
+	defaultRRLSlip         = 2
+	defaultLogLevel        = "info"
+	defaultLogFormat       = logFormatText
+
+	// How to format the logs
+	logFormatText = "text" // logfmt
+	logFormatJSON = "json"
 )
 
 type Options struct {
 	// User input
+	configFile      string
 	domain          string
 	bindAddr        string
+	tlsBindAddr     string
+	tlsCert         string
+	tlsKey          string
+	tlsCA           string
+	dohBindAddr     string
 	swarmAddr       string
 	tlsDir          string
 	tlsVerify       bool
 	recurse         bool
 	nameservers     []string
+	upstreams       []server.Upstream
 	refreshInterval time.Duration
 	refreshTimeout  time.Duration
+	refreshBackoff  time.Duration
 	stalenessPeriod time.Duration
+	stalePolicy     string
+	beforeSync      string
+	snapshotFile    string
+	snapshotMaxAge  time.Duration
+	snapshotOnExit  bool
+	shutdownTimeout time.Duration
+	rrlRate         int
+	rrlSlip         int
+	metricsAddr     string
+	healthAddr      string
+	adminAddr       string
+	adminToken      string
+	adminCA         string
+	logLevel        string
+	logFormat       string
+	queryLogSample  float64
+	dnstap          string
+	ttl             int
+	records         []string
+	allowQuery      []string
+	allowRecursion  []string
+	forwardZones    map[string][]string
+	plugins         []string
+	pluginSettings  map[string]map[string]interface{}
+
+	// Parsed by validate
+	staticRecords      rrstore.RRs
+	allowQueryNets     []*net.IPNet
+	allowRecursionNets []*net.IPNet
+	forwardUpstreams   map[string][]server.Upstream
+	pluginChain        []server.Middleware
 }
 
 func (o *Options) String() string {
 	return fmt.Sprintf(`Configuration:
+ - File:      %s
  - Domain:    "%s"
  - Listen:    "%s"
+   - TLS:     %s (cert: "%s") (client CA: "%s")
+   - HTTPS:   %s
  - Swarm:     %s
    - TLS:     %s (verify: %v)
  - External:  %v (ns: [%s])
- - Refresh:   Every %v (timeout: %v) (staleness: %v)
+ - Forward:   %s
+ - ACL:       query: %s, recursion: %s
+ - Records:   TTL %d (static: %d)
+ - Plugins:   %s
+ - Refresh:   Every %v (timeout: %v) (max backoff: %v) (staleness: %v, %s) (before sync: %s)
+ - Snapshot:  %s
+ - Shutdown:  %v to answer queries in flight
+ - RRL:       %d responses/sec (slip: %d)
+ - Metrics:   %s
+ - Health:    %s
+ - Admin:     %s
+ - Logging:   %s (format: %s) (queries: %v)
+ - dnstap:    %s
 -------------------`,
+		o.configSource(),
 		o.domain,
 		o.bindAddr,
+		o.tlsListen(), o.tlsCert, o.tlsCA,
+		o.dohListen(),
 		o.swarmAddr,
 		o.tlsDir,
 		o.tlsVerify,
 		o.recurse, strings.Join(o.nameservers, ","),
-		o.refreshInterval, o.refreshTimeout, o.stalenessPeriod)
+		o.forwards(),
+		acl(o.allowQuery), acl(o.allowRecursion),
+		o.ttl, len(o.records),
+		o.pluginList(),
+		o.refreshInterval, o.refreshTimeout, o.refreshBackoff, o.stalenessPeriod, o.stalePolicy, o.beforeSync,
+		o.snapshot(),
+		o.shutdownTimeout,
+		o.rrlRate, o.rrlSlip,
+		o.metricsListen(),
+		o.healthListen(),
+		o.adminListen(),
+		o.logLevel, o.logFormat, o.queryLogSample,
+		o.dnstapOutput())
+}
+
+// configSource describes the configuration file.
+func (o *Options) configSource() string {
+	if o.configFile == "" {
+		return "none"
+	}
+	return fmt.Sprintf("%q", o.configFile)
+}
+
+// forwards describes the nameservers of the forward zones.
+func (o *Options) forwards() string {
+	if len(o.forwardZones) == 0 {
+		return "none"
+	}
+	var l []string
+	for zone, ns := range o.forwardZones {
+		l = append(l, fmt.Sprintf("%s [%s]", zone, strings.Join(ns, ",")))
+	}
+	sort.Strings(l)
+	return strings.Join(l, ", ")
+}
+
+// pluginList describes the plugins the queries pass through, in order.
+func (o *Options) pluginList() string {
+	if len(o.plugins) == 0 {
+		return "none"
+	}
+	return strings.Join(o.plugins, " -> ")
+}
+
+// acl describes the networks of the clients allowed by an ACL.
+func acl(nets []string) string {
+	if nets == nil {
+		return "any"
+	}
+	return "[" + strings.Join(nets, ",") + "]"
+}
+
+// adminListen describes the address the admin API is served on and how it is
+// protected.
+func (o *Options) adminListen() string {
+	if o.adminAddr == "" {
+		return "disabled"
+	}
+	return fmt.Sprintf("%q (token: %v) (client CA: %q)", o.adminAddr, o.adminToken != "", o.adminCA)
+}
+
+// healthListen describes the address health endpoints are served on.
+func (o *Options) healthListen() string {
+	if o.healthAddr == "" {
+		return "disabled"
+	}
+	return fmt.Sprintf("%q (paths: /healthz, /readyz)", o.healthAddr)
+}
+
+// dnstapOutput describes where dnstap messages are written to.
+func (o *Options) dnstapOutput() string {
+	if o.dnstap == "" {
+		return "disabled"
+	}
+	return fmt.Sprintf("%q", o.dnstap)
+}
+
+// metricsListen describes the address metrics are served on.
+func (o *Options) metricsListen() string {
+	if o.metricsAddr == "" {
+		return "disabled"
+	}
+	return fmt.Sprintf("%q (path: /metrics)", o.metricsAddr)
+}
+
+// tlsListen describes the address DNS-over-TLS server listens on.
+func (o *Options) tlsListen() string {
+	if o.tlsCert == "" || o.tlsBindAddr == "" {
+		return "disabled"
+	}
+	return fmt.Sprintf("%q", o.tlsBindAddr)
+}
+
+// snapshot describes the file records are persisted to.
+func (o *Options) snapshot() string {
+	if o.snapshotFile == "" {
+		return "disabled"
+	}
+	return fmt.Sprintf("%q (max age: %v) (on exit: %v)", o.snapshotFile, o.snapshotMaxAge, o.snapshotOnExit)
+}
+
+// dohListen describes the address DNS-over-HTTPS server listens on.
+func (o *Options) dohListen() string {
+	if o.dohBindAddr == "" {
+		return "disabled"
+	}
+	return fmt.Sprintf("%q (path: %s)", o.dohBindAddr, server.DoHPath)
+}
+
+// serveFlags are the options of serving DNS, which are also needed by the
+// commands checking what would be served.
+var serveFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "config",
+		Usage: "configuration file (TOML) with the settings of the flags and more, reloaded on SIGHUP; flags take precedence",
+	},
+	cli.StringFlag{
+		Name:  "bind",
+		Value: defaultAddr,
+		Usage: "IP:port on which the server shoud listen (UDP and TCP)",
+	},
+	cli.StringFlag{
+		Name:  "tls-bind",
+		Value: defaultTLSAddr,
+		Usage: "IP:port on which the DNS-over-TLS server should listen (if --tls-cert is specified)",
+	},
+	cli.StringFlag{
+		Name:  "doh-bind",
+		Usage: "IP:port on which the DNS-over-HTTPS server should listen (requires --tls-cert)",
+	},
+	cli.StringFlag{
+		Name:  "tls-cert",
+		Usage: "TLS certificate file to serve DNS over TLS",
+	},
+	cli.StringFlag{
+		Name:  "tls-key",
+		Usage: "TLS private key file of --tls-cert",
+	},
+	cli.StringFlag{
+		Name:  "tls-ca",
+		Usage: "CA certificate file to verify DNS-over-TLS client certificates against (enables mutual TLS)",
+	},
+	cli.StringFlag{
+		Name:  "swarm",
+		Value: defaultSwarm,
+		Usage: "address of the Swarm manager", // TODO accept multiple
+	},
+	cli.StringFlag{
+		Name:   "swarm-cert-path",
+		Value:  "",
+		Usage:  "directory TLS certs for Swarm manager is stored",
+		EnvVar: "DOCKER_CERT_PATH",
+	},
+	cli.BoolFlag{
+		Name:   "swarm-tlsverify",
+		Usage:  "verify remote Swarm's identity using TLS",
+		EnvVar: "DOCKER_TLS_VERIFY",
+	},
+	cli.StringFlag{
+		Name:  "domain",
+		Value: defaultDnsDomain,
+		Usage: "DNS domain (FQDN suffix) for which this server is authoritative",
+	},
+	cli.BoolTFlag{
+		Name:  "external",
+		Usage: "use external nameservers to resolve DNS requests outside the domain (true by default)",
+	},
+	cli.StringSliceFlag{
+		Name:  "ns",
+		Usage: "external nameserver(s) to forward requests, as IP[:port] or tls://IP[:port][#server-name] (default: nameservers in /etc/resolv.conf)",
+	},
+	cli.DurationFlag{
+		Name:  "refresh",
+		Value: defaultRefreshInterval,
+		Usage: "how frequently refresh DNS table from cluster records",
+	},
+	cli.DurationFlag{
+		Name:  "refresh-timeout",
+		Value: defaultRefreshTimeout,
+		Usage: "time alotted for Swarm to list containers in the cluster",
+	},
+	cli.DurationFlag{
+		Name:  "refresh-max-backoff",
+		Value: defaultRefreshBackoff,
+		Usage: "maximum time between refreshes after consecutive failures",
+	},
+	cli.DurationFlag{
+		Name:  "staleness",
+		Value: defaultStalenessPeriod,
+		Usage: "how long DNS records can go without a refresh before they are stale",
+	},
+	cli.StringFlag{
+		Name:  "stale-policy",
+		Value: string(staleness.Exit),
+		Usage: "what to do when DNS records are stale: exit, serve-stale (with reduced TTLs) or servfail (for names in the domain)",
+	},
+	cli.StringFlag{
+		Name:  "before-sync",
+		Value: string(service.BeforeSyncServFail),
+		Usage: "how to answer names in the domain until records are first refreshed: servfail, wait (do not listen until then) or serve (NXDOMAIN)",
+	},
+	cli.StringFlag{
+		Name:  "snapshot-file",
+		Usage: "file to save DNS records to after every refresh and serve them from on startup until Swarm is reachable",
+	},
+	cli.DurationFlag{
+		Name:  "snapshot-max-age",
+		Value: defaultSnapshotMaxAge,
+		Usage: "how old saved DNS records can be to be served on startup",
+	},
+	cli.BoolFlag{
+		Name:  "snapshot-on-exit",
+		Usage: "also save DNS records to --snapshot-file on shutdown",
+	},
+	cli.DurationFlag{
+		Name:  "shutdown-timeout",
+		Value: defaultShutdownTimeout,
+		Usage: "time allotted for the queries in flight to be answered and the listeners to shut down on SIGTERM or SIGINT",
+	},
+	cli.IntFlag{
+		Name:  "rrl",
+		Value: 0,
+		Usage: "identical responses per second a client netblock can receive over UDP (0 disables rate limiting)",
+	},
+	cli.IntFlag{
+		Name:  "rrl-slip",
+		Value: defaultRRLSlip,
+		Usage: "send every Nth rate limited response truncated instead of dropping it (0 never)",
+	},
+	cli.StringFlag{
+		Name:  "metrics-bind",
+		Usage: "IP:port on which Prometheus metrics should be served over HTTP at /metrics",
+	},
+	cli.StringFlag{
+		Name:  "health-bind",
+		Usage: "IP:port on which /healthz and /readyz should be served over HTTP (can be the same as --metrics-bind)",
+	},
+	cli.StringFlag{
+		Name:  "log-level",
+		Value: defaultLogLevel,
+		Usage: "minimum level of the logs: debug, info, warn or error",
+	},
+	cli.StringFlag{
+		Name:  "log-format",
+		Value: defaultLogFormat,
+		Usage: "format of the logs: text (logfmt) or json",
+	},
+	cli.Float64Flag{
+		Name:  "query-log-sample",
+		Value: 0,
+		Usage: "fraction of the DNS queries to log, from 0 (none) to 1 (all)",
+	},
+	cli.StringFlag{
+		Name:  "dnstap",
+		Usage: "file or unix:///path/to/socket to write dnstap messages of the client and forwarded queries to",
+	},
+	cli.StringFlag{
+		Name:  "admin-bind",
+		Usage: "IP:port on which the admin API should be served (requires --admin-token or --admin-tls-ca, and --tls-cert unless it is a loopback address)",
+	},
+	cli.StringFlag{
+		Name:   "admin-token",
+		Usage:  "bearer token required to access the admin API",
+		EnvVar: "WAGL_ADMIN_TOKEN",
+	},
+	cli.StringFlag{
+		Name:  "admin-tls-ca",
+		Usage: "serve the admin API only to clients with a certificate signed by this CA",
+	},
 }
 
 func main() {
+	server.RegisterPlugin("blocklist", blocklist.Plugin)
+	newApp().Run(os.Args)
+}
+
+// newApp creates the command line app, running the serve command by default.
+func newApp() *cli.App {
 	cmd := cli.NewApp()
 	cmd.Name = "wagl"
-	cmd.Version = "0.1"
+	cmd.HelpName = cmd.Name
+	cmd.Version = version
 	cmd.Usage = "DNS service discovery for Docker Swarm clusters"
 	cli.AppHelpTemplate = usageTemplate
-	cmd.Flags = []cli.Flag{
-		cli.StringFlag{
-			Name:  "bind",
-			Value: defaultAddr,
-			Usage: "IP:port on which the server shoud listen",
-		},
-		cli.StringFlag{
-			Name:  "swarm",
-			Value: defaultSwarm,
-			Usage: "address of the Swarm manager", // TODO accept multiple
-		},
-		cli.StringFlag{
-			Name:   "swarm-cert-path",
-			Value:  "",
-			Usage:  "directory TLS certs for Swarm manager is stored",
-			EnvVar: "DOCKER_CERT_PATH",
-		},
-		cli.BoolFlag{
-			Name:   "swarm-tlsverify",
-			Usage:  "verify remote Swarm's identity using TLS",
-			EnvVar: "DOCKER_TLS_VERIFY",
-		},
-		cli.StringFlag{
-			Name:  "domain",
-			Value: defaultDnsDomain,
-			Usage: "DNS domain (FQDN suffix) for which this server is authoritative",
-		},
-		cli.BoolTFlag{
-			Name:  "external",
-			Usage: "use external nameservers to resolve DNS requests outside the domain (true by default)",
+	cli.CommandHelpTemplate = commandUsageTemplate
+	cmd.Flags = serveFlags
+	cmd.Commands = []cli.Command{
+		{
+			Name:   "serve",
+			Usage:  "serve DNS for the Swarm cluster (the default command)",
+			Flags:  serveFlags,
+			Action: serveAction,
 		},
-		cli.StringSliceFlag{
-			Name:  "ns",
-			Usage: "external nameserver(s) to forward requests (default: nameservers in /etc/resolv.conf)",
+		{
+			Name:   "records",
+			Usage:  "list the DNS records that would be served for the Swarm cluster and the tasks not eligible for them",
+			Flags:  append([]cli.Flag{recordsFormatFlag}, serveFlags...),
+			Action: recordsAction,
 		},
-		cli.DurationFlag{
-			Name:  "refresh",
-			Value: defaultRefreshInterval,
-			Usage: "how frequently refresh DNS table from cluster records",
+		{
+			Name:   "check",
+			Usage:  "validate the configuration and the connectivity to Swarm and the external nameservers",
+			Flags:  serveFlags,
+			Action: checkAction,
 		},
-		cli.DurationFlag{
-			Name:  "refresh-timeout",
-			Value: defaultRefreshTimeout,
-			Usage: "time alotted for Swarm to list containers in the cluster",
-		},
-		cli.DurationFlag{
-			Name:  "staleness",
-			Value: defaultStalenessPeriod,
-			Usage: "how long to serve stale DNS records before exiting",
+		{
+			Name:      "query",
+			Usage:     "query a DNS server and print the response, as dig does",
+			ArgsUsage: "name [type]",
+			Flags:     queryFlags,
+			Action:    queryAction,
 		},
 	}
 	cmd.Action = func(c *cli.Context) {
-		opts := &Options{
-			domain:          c.String("domain"),
-			bindAddr:        c.String("bind"),
-			swarmAddr:       c.String("swarm"),
-			tlsDir:          c.String("swarm-cert-path"),
-			tlsVerify:       c.Bool("swarm-tlsverify"),
-			recurse:         c.BoolT("external"),
-			nameservers:     c.StringSlice("ns"),
-			refreshInterval: c.Duration("refresh"),
-			refreshTimeout:  c.Duration("refresh-timeout"),
-			stalenessPeriod: c.Duration("staleness"),
-		}
-		if err := validate(opts); err != nil {
-			log.Fatalf("Error: %v", err)
+		if c.Args().Present() {
+			fmt.Fprintf(os.Stderr, "Unknown command: '%s'\n", c.Args().First())
+			os.Exit(1)
 		}
-		log.Printf("%s", opts)
-		serve(opts)
+		serveAction(c)
+	}
+	return cmd
+}
+
+// serveAction serves DNS until wagl is shut down.
+func serveAction(c *cli.Context) {
+	opts, err := loadOptions(c)
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	level := new(slog.LevelVar)
+	level.Set(logLevel(opts.logLevel))
+	logger, err := newLogger(os.Stderr, opts.logFormat, level)
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
 	}
-	cmd.Run(os.Args)
+	slog.SetDefault(logger)
+	logger.Info(opts.String())
+	serve(opts, logger, level, func() (*Options, error) { return loadOptions(c) })
 }
 
+// flagOptions gives the options specified with the flags.
+func flagOptions(c *cli.Context) *Options {
+	f := commandFlags{c}
+	return &Options{
+		configFile:      f.String("config"),
+		domain:          f.String("domain"),
+		bindAddr:        f.String("bind"),
+		tlsBindAddr:     f.String("tls-bind"),
+		tlsCert:         f.String("tls-cert"),
+		tlsKey:          f.String("tls-key"),
+		tlsCA:           f.String("tls-ca"),
+		dohBindAddr:     f.String("doh-bind"),
+		swarmAddr:       f.String("swarm"),
+		tlsDir:          f.String("swarm-cert-path"),
+		tlsVerify:       f.Bool("swarm-tlsverify"),
+		recurse:         f.BoolT("external"),
+		nameservers:     append([]string(nil), f.StringSlice("ns")...),
+		refreshInterval: f.Duration("refresh"),
+		refreshTimeout:  f.Duration("refresh-timeout"),
+		refreshBackoff:  f.Duration("refresh-max-backoff"),
+		stalenessPeriod: f.Duration("staleness"),
+		stalePolicy:     f.String("stale-policy"),
+		beforeSync:      f.String("before-sync"),
+		snapshotFile:    f.String("snapshot-file"),
+		snapshotMaxAge:  f.Duration("snapshot-max-age"),
+		snapshotOnExit:  f.Bool("snapshot-on-exit"),
+		shutdownTimeout: f.Duration("shutdown-timeout"),
+		rrlRate:         f.Int("rrl"),
+		rrlSlip:         f.Int("rrl-slip"),
+		metricsAddr:     f.String("metrics-bind"),
+		healthAddr:      f.String("health-bind"),
+		adminAddr:       f.String("admin-bind"),
+		adminToken:      f.String("admin-token"),
+		adminCA:         f.String("admin-tls-ca"),
+		logLevel:        f.String("log-level"),
+		logFormat:       f.String("log-format"),
+		queryLogSample:  f.Float64("query-log-sample"),
+		dnstap:          f.String("dnstap"),
+	}
+}
+
+// commandFlags gives the values of the flags of a command. The serve flags can
+// be set before the command as well, as in "wagl --swarm tcp://... records",
+// which are used unless they are set after it.
+type commandFlags struct {
+	c *cli.Context
+}
+
+// context gives the context the flag name is set in.
+func (f commandFlags) context(name string) *cli.Context {
+	if p := f.c.Parent(); p != nil && !f.c.IsSet(name) && p.IsSet(name) {
+		return p
+	}
+	return f.c
+}
+
+func (f commandFlags) IsSet(name string) bool {
+	return f.context(name).IsSet(name)
+}
+
+func (f commandFlags) String(name string) string          { return f.context(name).String(name) }
+func (f commandFlags) StringSlice(name string) []string   { return f.context(name).StringSlice(name) }
+func (f commandFlags) Bool(name string) bool              { return f.context(name).Bool(name) }
+func (f commandFlags) BoolT(name string) bool             { return f.context(name).BoolT(name) }
+func (f commandFlags) Int(name string) int                { return f.context(name).Int(name) }
+func (f commandFlags) Float64(name string) float64        { return f.context(name).Float64(name) }
+func (f commandFlags) Duration(name string) time.Duration { return f.context(name).Duration(name) }
+
 // validate looks for logical correctness and consistency of the input arguments
 // to the program.
 func validate(opt *Options) error {
@@ -150,6 +555,28 @@ func validate(opt *Options) error {
 		return errors.New("TLS verify specified; but not TLS cert path")
 	}
 
+	// DNS-over-TLS needs both the certificate and the key
+	if (opt.tlsCert == "") != (opt.tlsKey == "") {
+		return errors.New("Both TLS certificate and key must be specified to serve DNS over TLS")
+	}
+	if opt.tlsCA != "" && opt.tlsCert == "" {
+		return errors.New("TLS client CA specified; but not TLS certificate")
+	}
+	if opt.dohBindAddr != "" && opt.tlsCert == "" {
+		return errors.New("DNS-over-HTTPS address specified; but not TLS certificate")
+	}
+
+	// Admin API must be protected with a token or client certificates
+	if opt.adminAddr != "" && opt.adminToken == "" && opt.adminCA == "" {
+		return errors.New("Admin address specified; but neither admin token nor admin TLS client CA")
+	}
+	if opt.adminCA != "" && opt.tlsCert == "" {
+		return errors.New("Admin TLS client CA specified; but not TLS certificate")
+	}
+	if opt.adminAddr != "" && opt.tlsCert == "" && !isLoopback(opt.adminAddr) {
+		return errors.New("Non-loopback admin address specified; but not TLS certificate to serve the admin API over HTTPS")
+	}
+
 	// No nameservers speficied, check resolv.conf, add it.
 	if opt.recurse && len(opt.nameservers) == 0 {
 		if ns, err := localNameservers(); err != nil {
@@ -162,19 +589,44 @@ func validate(opt *Options) error {
 	}
 
 	// Nameserver validations:
-	// - make sure nameservers are IP[:port]
+	// - make sure nameservers are IP[:port] or tls://IP[:port][#name]
 	// - add default DNS port to nameservers if missing
+	opt.upstreams = nil
 	for i, v := range opt.nameservers {
-		host := v
-		if h, _, err := net.SplitHostPort(v); err != nil { // Missing port
-			opt.nameservers[i] = v + ":53"
-		} else {
-			host = h
-		}
-		// Make sure hostname is IP (do not support domain names as nameservers)
-		if ip := net.ParseIP(host); ip == nil {
-			return fmt.Errorf("Nameserver is not an IP address: '%s'", host)
+		ns, err := server.ParseUpstream(v)
+		if err != nil {
+			return err
 		}
+		opt.nameservers[i] = ns.String()
+		opt.upstreams = append(opt.upstreams, ns)
+	}
+
+	// Forward zones must be outside the domain and have valid nameservers
+	var err error
+	if opt.forwardUpstreams, err = parseForwardZones(opt.domain, opt.forwardZones); err != nil {
+		return err
+	}
+
+	// ACLs are networks in CIDR notation or IPs
+	if opt.allowQueryNets, err = parseNets(opt.allowQuery); err != nil {
+		return err
+	}
+	if opt.allowRecursionNets, err = parseNets(opt.allowRecursion); err != nil {
+		return err
+	}
+
+	// Static records are in the domain and use the TTL unless they specify
+	// their own
+	if opt.ttl < 0 || opt.ttl > math.MaxInt32 {
+		return fmt.Errorf("TTL (%d) should be between 0 and %d", opt.ttl, math.MaxInt32)
+	}
+	if opt.staticRecords, err = parseRecords(opt.domain, uint32(opt.ttl), opt.records); err != nil {
+		return err
+	}
+
+	// Plugins must be registered and their settings valid
+	if opt.pluginChain, err = newPluginChain(opt.plugins, opt.pluginSettings); err != nil {
+		return err
 	}
 
 	// Refresh timeout < refresh interval
@@ -182,65 +634,149 @@ func validate(opt *Options) error {
 		return fmt.Errorf("Refresh timeout (%v) should be less than refresh interval (%v)", opt.refreshTimeout, opt.refreshInterval)
 	}
 
+	// Backoff cannot make refreshes more frequent
+	if opt.refreshBackoff < opt.refreshInterval {
+		return fmt.Errorf("Refresh max backoff (%v) should not be less than refresh interval (%v)", opt.refreshBackoff, opt.refreshInterval)
+	}
+
+	// Staleness policy must be known
+	if _, err := staleness.ParsePolicy(opt.stalePolicy); err != nil {
+		return err
+	}
+
+	switch service.BeforeSync(opt.beforeSync) {
+	case service.BeforeSyncServFail, service.BeforeSyncWait, service.BeforeSyncServe:
+	default:
+		return fmt.Errorf("Unknown --before-sync value: '%s'", opt.beforeSync)
+	}
+
+	if opt.snapshotOnExit && opt.snapshotFile == "" {
+		return errors.New("Snapshot on exit specified; but not snapshot file")
+	}
+	if opt.shutdownTimeout < 0 {
+		return fmt.Errorf("Shutdown timeout (%v) cannot be negative", opt.shutdownTimeout)
+	}
+
+	// Rate limiting values cannot be negative
+	if opt.rrlRate < 0 || opt.rrlSlip < 0 {
+		return errors.New("Rate limiting values (--rrl, --rrl-slip) cannot be negative")
+	}
+
+	// Logging
+	if _, err := parseLogLevel(opt.logLevel); err != nil {
+		return err
+	}
+	if opt.logFormat != logFormatText && opt.logFormat != logFormatJSON {
+		return fmt.Errorf("Unknown --log-format value: '%s'", opt.logFormat)
+	}
+	if opt.queryLogSample < 0 || opt.queryLogSample > 1 {
+		return fmt.Errorf("Query log sample (%v) should be between 0 and 1", opt.queryLogSample)
+	}
+
 	return nil
 }
 
-// serve starts the DNS server and blocks.
-func serve(opt *Options) {
+// serve starts the DNS server and blocks until it is shut down on SIGTERM or
+// SIGINT. The configuration is reloaded with load on SIGHUP.
+func serve(opt *Options, logger *slog.Logger, level *slog.LevelVar, load func() (*Options, error)) {
+	// Subscribe to SIGHUP before anything else so that a reload requested
+	// during startup is queued rather than killing the process.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
 	dockerTLS, err := tlsConfig(opt.tlsDir, opt.tlsVerify)
 	if err != nil {
-		log.Fatalf("Error establishing TLS config: %v", err)
+		fatal("Error establishing TLS config", "error", err)
 	}
-
-	rrs := rrstore.New()
 	cluster, err := swarm.New(opt.swarmAddr, dockerTLS)
 	if err != nil {
-		log.Fatalf("Error initializing Swarm: %v", err)
+		fatal("Error initializing Swarm", "error", err)
 	}
-	dns := clusterdns.New(opt.domain, rrs, cluster)
+	cluster.Logger = logger
 
-	cancel := make(chan struct{})
-	defer close(cancel)
-	errCh, okCh := dns.StartRefreshing(opt.refreshInterval, opt.refreshTimeout,
-		cancel)
+	sopts := serviceOptions(opt)
+	sopts.Cluster = cluster
+	sopts.Logger = logger
+	if opt.tlsCert != "" {
+		cfg, err := serverTLSConfig(opt.tlsCert, opt.tlsKey, opt.tlsCA)
+		if err != nil {
+			fatal("Error establishing server TLS config", "error", err)
+		}
+		sopts.TLSConfig = cfg
+		sopts.TLSAddr = opt.tlsBindAddr
+		sopts.DoHAddr = opt.dohBindAddr
+	}
+	registry := metrics.NewRegistry()
+	tap, tapOut := dnstapTap(opt.dnstap, logger, dnstap.NewMetrics(registry))
+	sopts.Tap = tap
+	sopts.Registry = registry
+	svc, err := service.New(sopts)
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
 
+	// Stop answering queries on SIGTERM or SIGINT and shut down, or exit
+	// right away on another signal.
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
 	go func() {
-		var lastSuccess time.Time
-		var start = time.Now()
-		var errs = 0
-		var ok = 0
-
-		for {
-			// Exit if records are stale. Here we prefer consistency over
-			// liveliness/availability.
-			if (ok > 0 && time.Since(lastSuccess) > opt.stalenessPeriod) ||
-				(ok == 0 && time.Since(start) > opt.stalenessPeriod) {
-				close(cancel)
-
-				var last string
-				if lastSuccess.IsZero() {
-					last = "never"
-				} else {
-					last = lastSuccess.String()
-				}
-				log.Fatalf("Fatal: exiting rather than serving stale records. Staleness period: %v, last success: %s", opt.stalenessPeriod, last)
-			}
-
-			select {
-			case err := <-errCh:
-				errs++
-				log.Printf("Refresh error (#%d): %v ", errs, err)
-			case <-okCh:
-				errs = 0 // reset errs
-				ok++
-				lastSuccess = time.Now()
-				log.Printf("Successfully refreshed records.")
-			case <-cancel:
-				log.Fatal("Fatal: Refreshing records cancelled.")
-			}
-		}
+		sig := <-stop
+		signal.Reset(syscall.SIGTERM, syscall.SIGINT)
+		logger.Info("Shutting down", "signal", sig.String(), "timeout", opt.shutdownTimeout)
+		cancel()
 	}()
 
-	srv := server.New(opt.domain, opt.bindAddr, rrs, opt.recurse, opt.nameservers)
-	log.Fatal(srv.ListenAndServe())
+	// Shut down as well if an HTTP or the admin server fails, exiting with
+	// its error.
+	httpErr := make(chan error, 1)
+	fail := func(err error) {
+		select {
+		case httpErr <- err:
+		default: // another server failed first
+		}
+		cancel()
+	}
+
+	// Apply the reloadable settings of the configuration on SIGHUP.
+	go reloadOnSignal(hup, opt, load, func(o *Options) {
+		level.Set(logLevel(o.logLevel))
+		svc.SetConfig(serviceConfig(o))
+	})
+
+	// Serve metrics and health endpoints before waiting for the records so
+	// that both can be probed meanwhile.
+	muxes := make(httpMuxes)
+	if opt.metricsAddr != "" {
+		muxes.at(opt.metricsAddr).Handle("/metrics", svc.MetricsHandler())
+	}
+	if opt.healthAddr != "" {
+		h := svc.HealthHandler()
+		mux := muxes.at(opt.healthAddr)
+		mux.Handle("/healthz", h)
+		mux.Handle("/readyz", h)
+	}
+	servers := muxes.serve(fail)
+	if opt.adminAddr != "" {
+		servers = append(servers, serveAdmin(opt, svc.AdminHandler(), fail))
+	}
+
+	err = svc.Run(ctx)
+	shutdownHTTP(servers)
+	cluster.Close()
+	if tapOut != nil {
+		if err := tapOut.Close(); err != nil {
+			logger.Error("Error closing dnstap output", "error", err)
+		}
+	}
+	if err == nil {
+		select {
+		case err = <-httpErr:
+		default:
+		}
+	}
+	if err != nil {
+		fatal("Stopped serving", "error", err)
+	}
+	logger.Info("Shut down")
 }
@@ -0,0 +1,415 @@
+// Package metrics provides counters, gauges and histograms exposed over HTTP
+// in the Prometheus text exposition format, or collected into a Sink.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are the default upper bounds of the histogram buckets, in
+// seconds, suited for measuring the time taken to answer DNS queries.
+var DefaultBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+// metric is a single metric or a vector of them, written in the exposition
+// format as the samples of the metric family name.
+type metric interface {
+	typ() string
+	write(w io.Writer, name string, labels string)
+	collect(s Sink, name string, labels map[string]string)
+}
+
+// Sink receives the samples of the metrics when they are collected, e.g. to
+// export them to another monitoring system.
+type Sink interface {
+	// Sample is called with the name of each sample, which is the name of
+	// the metric or, for histograms, the name suffixed with _bucket, _sum
+	// or _count, its labels and its value. labels must not be modified.
+	Sample(name string, labels map[string]string, value float64)
+}
+
+type family struct {
+	name, help string
+	m          metric
+}
+
+// Registry is a set of metrics served together. It is safe for concurrent
+// use.
+type Registry struct {
+	m        sync.Mutex
+	families map[string]family
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]family)}
+}
+
+// register adds the metric with the specified name and help text. Metric
+// names must be unique, as they are defined once at startup, it panics
+// otherwise.
+func (r *Registry) register(name, help string, m metric) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if _, ok := r.families[name]; ok {
+		panic(fmt.Sprintf("metrics: duplicate metric %s", name))
+	}
+	r.families[name] = family{name, help, m}
+}
+
+// sorted gives the metric families sorted by name.
+func (r *Registry) sorted() []family {
+	r.m.Lock()
+	l := make([]family, 0, len(r.families))
+	for _, f := range r.families {
+		l = append(l, f)
+	}
+	r.m.Unlock()
+
+	sort.Slice(l, func(i, j int) bool { return l[i].name < l[j].name })
+	return l
+}
+
+// WriteText writes the metrics in the text exposition format, sorted by name.
+func (r *Registry) WriteText(w io.Writer) {
+	for _, f := range r.sorted() {
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.m.typ())
+		f.m.write(w, f.name, "")
+	}
+}
+
+// Collect sends the samples of the metrics to s, sorted by name.
+func (r *Registry) Collect(s Sink) {
+	for _, f := range r.sorted() {
+		f.m.collect(s, f.name, map[string]string{})
+	}
+}
+
+// ServeHTTP serves the metrics to Prometheus.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteText(w)
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	v uint64
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() { atomic.AddUint64(&c.v, 1) }
+
+// Add increments the counter by n.
+func (c *Counter) Add(n uint64) { atomic.AddUint64(&c.v, n) }
+
+// Value gives the current value of the counter.
+func (c *Counter) Value() uint64 { return atomic.LoadUint64(&c.v) }
+
+func (c *Counter) typ() string { return "counter" }
+
+func (c *Counter) write(w io.Writer, name, labels string) {
+	fmt.Fprintf(w, "%s%s %d\n", name, braces(labels), c.Value())
+}
+
+func (c *Counter) collect(s Sink, name string, labels map[string]string) {
+	s.Sample(name, labels, float64(c.Value()))
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	bits uint64
+}
+
+// Set sets the value of the gauge.
+func (g *Gauge) Set(v float64) { atomic.StoreUint64(&g.bits, math.Float64bits(v)) }
+
+// Value gives the current value of the gauge.
+func (g *Gauge) Value() float64 { return math.Float64frombits(atomic.LoadUint64(&g.bits)) }
+
+func (g *Gauge) typ() string { return "gauge" }
+
+func (g *Gauge) write(w io.Writer, name, labels string) {
+	fmt.Fprintf(w, "%s%s %s\n", name, braces(labels), formatFloat(g.Value()))
+}
+
+func (g *Gauge) collect(s Sink, name string, labels map[string]string) {
+	s.Sample(name, labels, g.Value())
+}
+
+// gaugeFunc is a gauge whose value is computed when the metrics are written.
+type gaugeFunc func() float64
+
+func (f gaugeFunc) typ() string { return "gauge" }
+
+func (f gaugeFunc) write(w io.Writer, name, labels string) {
+	fmt.Fprintf(w, "%s%s %s\n", name, braces(labels), formatFloat(f()))
+}
+
+func (f gaugeFunc) collect(s Sink, name string, labels map[string]string) {
+	s.Sample(name, labels, f())
+}
+
+// Histogram counts the observed values in buckets.
+type Histogram struct {
+	buckets []float64 // upper bounds, sorted
+
+	m      sync.Mutex
+	counts []uint64 // per bucket, not cumulative; the last is +Inf
+	sum    float64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+}
+
+// Observe adds the value v to the histogram.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v) // first bucket with bound >= v
+	h.m.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.m.Unlock()
+}
+
+func (h *Histogram) typ() string { return "histogram" }
+
+// snapshot gives the cumulative counts of the buckets, the last being +Inf,
+// and the sum of the observed values.
+func (h *Histogram) snapshot() (counts []uint64, sum float64) {
+	h.m.Lock()
+	counts = append([]uint64(nil), h.counts...)
+	sum = h.sum
+	h.m.Unlock()
+
+	for i := 1; i < len(counts); i++ {
+		counts[i] += counts[i-1]
+	}
+	return counts, sum
+}
+
+// upperBound gives the upper bound of the ith bucket.
+func (h *Histogram) upperBound(i int) float64 {
+	if i < len(h.buckets) {
+		return h.buckets[i]
+	}
+	return math.Inf(1)
+}
+
+func (h *Histogram) write(w io.Writer, name, labels string) {
+	counts, sum := h.snapshot()
+	for i, n := range counts {
+		le := formatFloat(h.upperBound(i))
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, braces(joinLabels(labels, `le="`+le+`"`)), n)
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(labels), formatFloat(sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, braces(labels), counts[len(counts)-1])
+}
+
+func (h *Histogram) collect(s Sink, name string, labels map[string]string) {
+	counts, sum := h.snapshot()
+	for i, n := range counts {
+		s.Sample(name+"_bucket", withLabel(labels, "le", formatFloat(h.upperBound(i))), float64(n))
+	}
+	s.Sample(name+"_sum", labels, sum)
+	s.Sample(name+"_count", labels, float64(counts[len(counts)-1]))
+}
+
+// vec is a set of metrics of the same type partitioned by label values.
+type vec struct {
+	labels []string
+	create func() metric
+
+	m        sync.Mutex
+	children map[string]metric   // by formatted label pairs
+	values   map[string][]string // label values by formatted label pairs
+}
+
+func newVec(labels []string, create func() metric) *vec {
+	return &vec{
+		labels:   labels,
+		create:   create,
+		children: make(map[string]metric),
+		values:   make(map[string][]string),
+	}
+}
+
+// with gives the metric with the specified label values, creating it if it
+// does not exist.
+func (v *vec) with(values []string) metric {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %d label values for labels %v", len(values), v.labels))
+	}
+	pairs := make([]string, len(values))
+	for i, l := range v.labels {
+		pairs[i] = l + `="` + escapeLabel(values[i]) + `"`
+	}
+	key := strings.Join(pairs, ",")
+
+	v.m.Lock()
+	defer v.m.Unlock()
+	m, ok := v.children[key]
+	if !ok {
+		m = v.create()
+		v.children[key] = m
+		v.values[key] = append([]string(nil), values...)
+	}
+	return m
+}
+
+func (v *vec) typ() string { return v.create().typ() }
+
+// sorted gives the formatted label pairs of the metrics in the vector, the
+// metrics and their label values, sorted by the label pairs.
+func (v *vec) sorted() (keys []string, children []metric, values [][]string) {
+	v.m.Lock()
+	defer v.m.Unlock()
+	keys = make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	children = make([]metric, len(keys))
+	values = make([][]string, len(keys))
+	for i, k := range keys {
+		children[i], values[i] = v.children[k], v.values[k]
+	}
+	return keys, children, values
+}
+
+func (v *vec) write(w io.Writer, name, labels string) {
+	keys, children, _ := v.sorted()
+	for i, m := range children {
+		m.write(w, name, joinLabels(labels, keys[i]))
+	}
+}
+
+func (v *vec) collect(s Sink, name string, labels map[string]string) {
+	_, children, values := v.sorted()
+	for i, m := range children {
+		l := labels
+		for j, label := range v.labels {
+			l = withLabel(l, label, values[i][j])
+		}
+		m.collect(s, name, l)
+	}
+}
+
+// CounterVec is a set of counters partitioned by label values.
+type CounterVec struct{ v *vec }
+
+// With gives the counter with the label values in the order of the labels.
+func (c *CounterVec) With(values ...string) *Counter { return c.v.with(values).(*Counter) }
+
+// GaugeVec is a set of gauges partitioned by label values.
+type GaugeVec struct{ v *vec }
+
+// With gives the gauge with the label values in the order of the labels.
+func (g *GaugeVec) With(values ...string) *Gauge { return g.v.with(values).(*Gauge) }
+
+// HistogramVec is a set of histograms partitioned by label values.
+type HistogramVec struct{ v *vec }
+
+// With gives the histogram with the label values in the order of the labels.
+func (h *HistogramVec) With(values ...string) *Histogram { return h.v.with(values).(*Histogram) }
+
+// NewCounter creates a counter in the registry.
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := new(Counter)
+	r.register(name, help, c)
+	return c
+}
+
+// NewCounterVec creates a set of counters with the specified labels in the
+// registry.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := newVec(labels, func() metric { return new(Counter) })
+	r.register(name, help, v)
+	return &CounterVec{v}
+}
+
+// NewGauge creates a gauge in the registry.
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := new(Gauge)
+	r.register(name, help, g)
+	return g
+}
+
+// NewGaugeVec creates a set of gauges with the specified labels in the
+// registry.
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	v := newVec(labels, func() metric { return new(Gauge) })
+	r.register(name, help, v)
+	return &GaugeVec{v}
+}
+
+// NewGaugeFunc creates a gauge in the registry whose value is given by f
+// every time the metrics are served.
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) {
+	r.register(name, help, gaugeFunc(f))
+}
+
+// NewHistogram creates a histogram with the specified bucket upper bounds in
+// the registry.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := newHistogram(buckets)
+	r.register(name, help, h)
+	return h
+}
+
+// NewHistogramVec creates a set of histograms with the specified bucket upper
+// bounds and labels in the registry.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	v := newVec(labels, func() metric { return newHistogram(buckets) })
+	r.register(name, help, v)
+	return &HistogramVec{v}
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+// withLabel gives a copy of the labels with the label added.
+func withLabel(labels map[string]string, name, value string) map[string]string {
+	l := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		l[k] = v
+	}
+	l[name] = value
+	return l
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
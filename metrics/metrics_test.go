@@ -0,0 +1,145 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("queries_total", "Queries by type.", "type", "scope")
+	c.With("SRV", "internal").Inc()
+	c.With("A", "internal").Add(2)
+	c.With("A", "internal").Inc()
+	c.With("A", `ex"ternal`).Inc()
+	g := r.NewGauge("records", "Records\nin the table.")
+	g.Set(1.5)
+	r.NewGaugeFunc("age_seconds", "Age.", func() float64 { return 42 })
+	h := r.NewHistogram("duration_seconds", "Durations.", []float64{.1, 1})
+	h.Observe(.05)
+	h.Observe(.1)
+	h.Observe(5)
+	hv := r.NewHistogramVec("upstream_seconds", "Upstream durations.", []float64{1}, "upstream")
+	hv.With("10.0.0.1:53").Observe(.5)
+
+	var b bytes.Buffer
+	r.WriteText(&b)
+	expected := `# HELP age_seconds Age.
+# TYPE age_seconds gauge
+age_seconds 42
+# HELP duration_seconds Durations.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{le="0.1"} 2
+duration_seconds_bucket{le="1"} 2
+duration_seconds_bucket{le="+Inf"} 3
+duration_seconds_sum 5.15
+duration_seconds_count 3
+# HELP queries_total Queries by type.
+# TYPE queries_total counter
+queries_total{type="A",scope="ex\"ternal"} 1
+queries_total{type="A",scope="internal"} 3
+queries_total{type="SRV",scope="internal"} 1
+# HELP records Records\nin the table.
+# TYPE records gauge
+records 1.5
+# HELP upstream_seconds Upstream durations.
+# TYPE upstream_seconds histogram
+upstream_seconds_bucket{upstream="10.0.0.1:53",le="1"} 1
+upstream_seconds_bucket{upstream="10.0.0.1:53",le="+Inf"} 1
+upstream_seconds_sum{upstream="10.0.0.1:53"} 0.5
+upstream_seconds_count{upstream="10.0.0.1:53"} 1
+`
+	if b.String() != expected {
+		t.Fatalf("wrong output.\nexpected:\n%s\ngot:\n%s", expected, b.String())
+	}
+}
+
+// sampleList is a Sink keeping the samples formatted as name{labels} value,
+// with the labels sorted.
+type sampleList []string
+
+func (l *sampleList) Sample(name string, labels map[string]string, value float64) {
+	var pairs []string
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	*l = append(*l, fmt.Sprintf("%s%v %v", name, pairs, value))
+}
+
+func TestRegistry_collect(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("queries_total", "Queries by type.", "type", "scope").With("A", "internal").Add(3)
+	r.NewGauge("records", "Records.").Set(1.5)
+	h := r.NewHistogramVec("upstream_seconds", "Upstream durations.", []float64{1}, "upstream")
+	h.With("10.0.0.1:53").Observe(.5)
+	h.With("10.0.0.1:53").Observe(2)
+
+	var l sampleList
+	r.Collect(&l)
+	expected := sampleList{
+		"queries_total[scope=internal type=A] 3",
+		"records[] 1.5",
+		"upstream_seconds_bucket[le=1 upstream=10.0.0.1:53] 1",
+		"upstream_seconds_bucket[le=+Inf upstream=10.0.0.1:53] 2",
+		"upstream_seconds_sum[upstream=10.0.0.1:53] 2.5",
+		"upstream_seconds_count[upstream=10.0.0.1:53] 2",
+	}
+	if !reflect.DeepEqual(l, expected) {
+		t.Fatalf("wrong samples.\nexpected: %q\ngot:      %q", expected, l)
+	}
+}
+
+func TestRegistry_duplicate(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("queries_total", "Queries.")
+	defer func() {
+		if recover() == nil {
+			t.Fatal("duplicate metric is registered")
+		}
+	}()
+	r.NewGauge("queries_total", "Queries.")
+}
+
+func TestRegistry_concurrent(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("queries_total", "Queries.", "type")
+	h := r.NewHistogram("duration_seconds", "Durations.", DefaultBuckets)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.With("A").Inc()
+				h.Observe(.001)
+				r.WriteText(&bytes.Buffer{})
+			}
+		}()
+	}
+	wg.Wait()
+	if v := c.With("A").Value(); v != 1000 {
+		t.Fatalf("wrong count: %d", v)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("queries_total", "Queries.").Inc()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("wrong content type: %s", ct)
+	}
+	if !strings.Contains(w.Body.String(), "queries_total 1\n") {
+		t.Fatalf("metric is not served:\n%s", w.Body.String())
+	}
+}
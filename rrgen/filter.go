@@ -9,22 +9,32 @@ import (
 // FilterFunc determines if a Task can be used, if not provides a reason.
 type FilterFunc func(t task.Task) (bool, string)
 
-type Filters []FilterFunc
+// Filter is a FilterFunc with a short name that identifies why the tasks it
+// rejects are not eligible, such as in metrics.
+type Filter struct {
+	Name string
+	Func FilterFunc
+}
+
+type Filters []Filter
 
 // BadTask describes a Task that is not eligible.
 type BadTask struct {
 	task.Task
+	Filter string // name of the filter rejecting the task
 	Reason string
 }
 
 // DnsFilters are list of filters applied in order to determine DNS eligibility
 // of tasks. The end result of the filters are Tasks (containers) that can have
 // DNS RRs.
-var DnsFilters = Filters([]FilterFunc{
-	HasDnsName,
-	HasPorts,
-	PortsHaveProtos,
-})
+var DnsFilters = Filters{
+	{"no-dns-name", HasDnsName},
+	{"no-ports", HasPorts},
+	{"no-ipv4-port", HasIPv4Ports},
+	{"no-port-proto", PortsHaveProtos},
+	{"port-out-of-range", PortsInRange},
+}
 
 // filterTasks filters tasks based on their eligibility for having DNS records
 // and returns the list of good tasks and bad ones along with their reasons.
@@ -35,8 +45,8 @@ func (f Filters) FilterTasks(ll []task.Task) ([]task.Task, []BadTask) {
 	for _, t := range ll {
 		bad := false
 		for _, ff := range f {
-			if ok, reason := ff(t); !ok {
-				badTasks = append(badTasks, BadTask{t, reason})
+			if ok, reason := ff.Func(t); !ok {
+				badTasks = append(badTasks, BadTask{t, ff.Name, reason})
 				bad = true
 				break
 			}
@@ -54,6 +64,13 @@ func HasPorts(t task.Task) (bool, string) {
 	return len(t.Ports) > 0, "has no port mappings"
 }
 
+// HasIPv4Ports rejects the tasks with no port mappings on IPv4 addresses, the
+// only ones records are generated for. Other port mappings, such as the ones
+// on :: Docker reports next to the ones on 0.0.0.0, are ignored.
+func HasIPv4Ports(t task.Task) (bool, string) {
+	return len(ipv4Ports(t)) > 0, "has no port mappings on IPv4 addresses"
+}
+
 func HasDnsName(t task.Task) (bool, string) {
 	return t.Service != "", "has no DNS name specified (or not configured for DNS)"
 }
@@ -67,4 +84,13 @@ func PortsHaveProtos(t task.Task) (bool, string) {
 	return true, ""
 }
 
+func PortsInRange(t task.Task) (bool, string) {
+	for _, p := range t.Ports {
+		if p.HostPort <= 0 || p.HostPort > 65535 {
+			return false, fmt.Sprintf("host port out of range for port mapping '%s'", p)
+		}
+	}
+	return true, ""
+}
+
 // TODO implement DNS name checks (length, valid characters and such)
@@ -28,15 +28,17 @@ func TestFilterTasks(t *testing.T) {
 		good int
 		bad  int
 	}{
-		{[]FilterFunc{allGood}, len(ll), 0},
-		{[]FilterFunc{allGood, allBad}, 0, len(ll)},
-		{[]FilterFunc{allGood, hasPort}, 1, len(ll) - 1},
+		{Filters{{"good", allGood}}, len(ll), 0},
+		{Filters{{"good", allGood}, {"bad", allBad}}, 0, len(ll)},
+		{Filters{{"good", allGood}, {"no-ports", hasPort}}, 1, len(ll) - 1},
 	}
 	for i, c := range cases {
 		if o, b := c.fs.FilterTasks(ll); len(o) != c.good {
 			t.Fatalf("case %d: wrong good task count", i)
 		} else if len(b) != c.bad {
 			t.Fatalf("case %d: wrong bad task count", i)
+		} else if len(b) > 0 && b[0].Filter != c.fs[len(c.fs)-1].Name {
+			t.Fatalf("case %d: wrong filter name: %s", i, b[0].Filter)
 		}
 	}
 }
@@ -4,7 +4,9 @@ package rrgen
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
+	"strconv"
 
 	"github.com/ahmetalpbalkan/wagl/rrstore"
 	"github.com/ahmetalpbalkan/wagl/task"
@@ -14,25 +16,27 @@ import (
 type rrEntry struct {
 	rrType uint16
 	domain string
-	record string
+	record rrstore.Record
 }
 
 func (r *rrEntry) String() string {
-	return fmt.Sprintf("%s %s %s", dns.TypeToString[r.rrType], r.domain, r.record)
+	val := r.record.Addr.String()
+	if r.rrType == dns.TypeSRV {
+		val = net.JoinHostPort(val, strconv.Itoa(int(r.record.Port)))
+	}
+	return fmt.Sprintf("%s %s %s", dns.TypeToString[r.rrType], r.domain, val)
 }
 
 // RRs determines the tasks which can have DNS Resource Records and returns the
-// RRs based on the given cluster state.
-func RRs(domain string, state task.ClusterState) rrstore.RRs {
+// RRs based on the given cluster state, along with the tasks which cannot. The
+// tasks which cannot are logged to logger at debug level.
+func RRs(logger *slog.Logger, domain string, state task.ClusterState) (rrstore.RRs, []BadTask) {
 	goodTasks, badTasks := DnsFilters.FilterTasks(state)
-	if len(badTasks) > 0 {
-		log.Printf("Found %d tasks are not eligible for DNS records:", len(badTasks))
-		for _, v := range badTasks {
-			log.Printf("\t- %s: %s", v.Id, v.Reason)
-		}
+	for _, v := range badTasks {
+		logger.Debug("Task is not eligible for DNS records", "task", v.Id, "filter", v.Filter, "reason", v.Reason)
 	}
-	log.Printf("Tasks with DNS records: %d", len(goodTasks))
-	return getRRs(domain, goodTasks)
+	logger.Info("Generated DNS records", "tasks", len(goodTasks), "bad_tasks", len(badTasks))
+	return getRRs(domain, goodTasks), badTasks
 }
 
 // getRRs generates all DNS Resource Record table for the given tasks by
@@ -42,7 +46,6 @@ func getRRs(domain string, ll []task.Task) rrstore.RRs {
 	rr := make(rrstore.RRs)
 	for _, t := range ll {
 		for _, r := range getTaskRRs(domain, t) {
-			log.Printf("\t+RR: %s", r.String())
 			insertRR(rr, r)
 		}
 	}
@@ -60,13 +63,34 @@ func getTaskRRs(domain string, t task.Task) []rrEntry {
 	}
 
 	// A record ("A service.domain. IP")
-	ip := t.Ports[0].HostIP.String() // use first port mapping's IP addr
-	l = append(l, rrEntry{dns.TypeA, fmt.Sprintf("%s.%s", t.Service, tail), ip})
+	ports := ipv4Ports(t)
+	a := rrstore.Record{
+		Addr:   ports[0].HostIP, // use first port mapping's IP addr
+		TaskID: t.Id,
+	}
+	l = append(l, rrEntry{dns.TypeA, fmt.Sprintf("%s.%s", t.Service, tail), a})
 
 	// SRV records for each port mapping ("SRV _service._tcp.domain. IP PORT")
+	for _, p := range ports {
+		srv := rrstore.Record{
+			Addr:     p.HostIP,
+			Port:     uint16(p.HostPort),
+			Priority: 1, // keep all records equal
+			Weight:   1, // keep all records equal
+			TaskID:   t.Id,
+		}
+		l = append(l, rrEntry{dns.TypeSRV, fmt.Sprintf("_%s._%s.%s", t.Service, p.Proto, tail), srv})
+	}
+	return l
+}
+
+// ipv4Ports returns the port mappings of the task on IPv4 addresses.
+func ipv4Ports(t task.Task) []task.Port {
+	var l []task.Port
 	for _, p := range t.Ports {
-		val := fmt.Sprintf("%s:%d", p.HostIP, p.HostPort)
-		l = append(l, rrEntry{dns.TypeSRV, fmt.Sprintf("_%s._%s.%s", t.Service, p.Proto, tail), val})
+		if p.HostIP.To4() != nil {
+			l = append(l, p)
+		}
 	}
 	return l
 }
@@ -74,7 +98,7 @@ func getTaskRRs(domain string, t task.Task) []rrEntry {
 // insertRR adds the specified RR entry into the RR table.
 func insertRR(rr rrstore.RRs, entry rrEntry) {
 	if rr[entry.rrType] == nil {
-		rr[entry.rrType] = make(map[string][]string)
+		rr[entry.rrType] = make(map[string][]rrstore.Record)
 	}
 	rr[entry.rrType][entry.domain] = append(rr[entry.rrType][entry.domain], entry.record)
 }
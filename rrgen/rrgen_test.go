@@ -1,6 +1,7 @@
 package rrgen
 
 import (
+	"log/slog"
 	"net"
 	"reflect"
 	"strings"
@@ -13,13 +14,13 @@ import (
 
 func Test_insertRR(t *testing.T) {
 	rr := make(rrstore.RRs)
-	insertRR(rr, rrEntry{dns.TypeA, "foo.domain.", "10.0.0.1"})
-	insertRR(rr, rrEntry{dns.TypeA, "foo.domain.", "10.0.0.2"})
-	insertRR(rr, rrEntry{dns.TypeSRV, "_foo._tcp.domain.", "10.0.0.3:3000"})
+	insertRR(rr, rrEntry{dns.TypeA, "foo.domain.", a("10.0.0.1", "1")})
+	insertRR(rr, rrEntry{dns.TypeA, "foo.domain.", a("10.0.0.2", "2")})
+	insertRR(rr, rrEntry{dns.TypeSRV, "_foo._tcp.domain.", srv("10.0.0.3", 3000, "3")})
 
-	expected := rrstore.RRs(map[uint16]map[string][]string{
-		dns.TypeA:   {"foo.domain.": []string{"10.0.0.1", "10.0.0.2"}},
-		dns.TypeSRV: {"_foo._tcp.domain.": []string{"10.0.0.3:3000"}}})
+	expected := rrstore.RRs(map[uint16]map[string][]rrstore.Record{
+		dns.TypeA:   {"foo.domain.": {a("10.0.0.1", "1"), a("10.0.0.2", "2")}},
+		dns.TypeSRV: {"_foo._tcp.domain.": {srv("10.0.0.3", 3000, "3")}}})
 
 	if !reflect.DeepEqual(expected, rr) {
 		t.Fatalf("wrong value.\nexpected=%#v\ngot=%#v", expected, rr)
@@ -91,7 +92,7 @@ func Test_RRs_empty(t *testing.T) {
 		t.Fatal("output has records")
 	}
 
-	rr = RRs("domain", task.ClusterState([]task.Task{
+	rr, bad := RRs(slog.Default(), "domain", task.ClusterState([]task.Task{
 		{
 			Id:      "no-ports",
 			Service: "api",
@@ -99,33 +100,44 @@ func Test_RRs_empty(t *testing.T) {
 		},
 		{
 			Id:    "no-service-name",
-			Ports: []task.Port{{net.IPv4(10, 0, 0, 2), 8001, "tcp"}},
+			Ports: []task.Port{{HostIP: net.IPv4(10, 0, 0, 2), HostPort: 8001, Proto: "tcp"}},
+		},
+		{
+			Id:      "ipv6-only",
+			Service: "api",
+			Ports:   []task.Port{{HostIP: net.ParseIP("::"), HostPort: 8001, Proto: "tcp"}},
 		},
 	}))
 	if len(rr) > 0 {
 		t.Fatal("output has records")
 	}
+	if len(bad) != 3 || bad[0].Filter != "no-ports" || bad[1].Filter != "no-dns-name" || bad[2].Filter != "no-ipv4-port" {
+		t.Fatalf("wrong bad tasks: %v", bad)
+	}
 }
 
 func Test_RRs_actualWorkload(t *testing.T) {
-	rr := RRs("domain", task.ClusterState([]task.Task{
+	rr, _ := RRs(slog.Default(), "domain", task.ClusterState([]task.Task{
 		{
 			Id:      "bind",
 			Service: "dns",
 			Domain:  "infra",
-			Ports:   []task.Port{{net.IPv4(192, 168, 0, 3), 53, "udp"}},
+			Ports:   []task.Port{{HostIP: net.IPv4(192, 168, 0, 3), HostPort: 53, Proto: "udp"}},
 		},
-		{
+		{ // mapped on :: too
 			Id:      "web1",
 			Service: "api",
-			Ports:   []task.Port{{net.IPv4(192, 168, 0, 1), 8000, "tcp"}},
+			Ports: []task.Port{
+				{HostIP: net.IPv4(192, 168, 0, 1), HostPort: 8000, Proto: "tcp"},
+				{HostIP: net.ParseIP("::"), HostPort: 8000, Proto: "tcp"},
+			},
 		},
 		{
 			Id:      "web2",
 			Service: "api",
 			Ports: []task.Port{
-				{net.IPv4(192, 168, 0, 2), 8000, "tcp"},
-				{net.IPv4(192, 168, 0, 2), 5000, "udp"},
+				{HostIP: net.IPv4(192, 168, 0, 2), HostPort: 8000, Proto: "tcp"},
+				{HostIP: net.IPv4(192, 168, 0, 2), HostPort: 5000, Proto: "udp"},
 			},
 		},
 		{
@@ -133,34 +145,50 @@ func Test_RRs_actualWorkload(t *testing.T) {
 			Service: "frontend",
 			Domain:  "blog",
 			Ports: []task.Port{
-				{net.IPv4(192, 168, 0, 3), 8000, "tcp"},
+				{HostIP: net.IPv4(192, 168, 0, 3), HostPort: 8000, Proto: "tcp"},
 			},
 		},
 		{ // no proto on port
 			Id:      "debian",
 			Service: "test",
-			Ports:   []task.Port{{net.IPv4(192, 168, 0, 3), 500, ""}},
+			Ports:   []task.Port{{HostIP: net.IPv4(192, 168, 0, 3), HostPort: 500, Proto: ""}},
 		},
 		{ // no service name
 			Id:    "debian",
-			Ports: []task.Port{{net.IPv4(192, 168, 0, 3), 500, "udp"}},
+			Ports: []task.Port{{HostIP: net.IPv4(192, 168, 0, 3), HostPort: 500, Proto: "udp"}},
+		},
+		{ // port out of range
+			Id:      "debian",
+			Service: "test",
+			Ports:   []task.Port{{HostIP: net.IPv4(192, 168, 0, 3), HostPort: 70000, Proto: "tcp"}},
 		},
 	}))
 
-	expected := rrstore.RRs(map[uint16]map[string][]string{
+	expected := rrstore.RRs(map[uint16]map[string][]rrstore.Record{
 		dns.TypeA: {
-			"dns.infra.domain.":     []string{"192.168.0.3"},
-			"api.domain.":           []string{"192.168.0.1", "192.168.0.2"},
-			"frontend.blog.domain.": []string{"192.168.0.3"},
+			"dns.infra.domain.":     {a("192.168.0.3", "bind")},
+			"api.domain.":           {a("192.168.0.1", "web1"), a("192.168.0.2", "web2")},
+			"frontend.blog.domain.": {a("192.168.0.3", "nginx")},
 		},
 		dns.TypeSRV: {
-			"_dns._udp.infra.domain.":     []string{"192.168.0.3:53"},
-			"_api._tcp.domain.":           []string{"192.168.0.1:8000", "192.168.0.2:8000"},
-			"_api._udp.domain.":           []string{"192.168.0.2:5000"},
-			"_frontend._tcp.blog.domain.": []string{"192.168.0.3:8000"},
+			"_dns._udp.infra.domain.":     {srv("192.168.0.3", 53, "bind")},
+			"_api._tcp.domain.":           {srv("192.168.0.1", 8000, "web1"), srv("192.168.0.2", 8000, "web2")},
+			"_api._udp.domain.":           {srv("192.168.0.2", 5000, "web2")},
+			"_frontend._tcp.blog.domain.": {srv("192.168.0.3", 8000, "nginx")},
 		}})
 
 	if !reflect.DeepEqual(rr, expected) {
 		t.Fatalf("wrong value.\nexp: %#v\ngot: %#v", expected, rr)
 	}
+	if err := rrstore.New().Set(1, rr); err != nil {
+		t.Fatalf("records cannot be stored: %v", err)
+	}
+}
+
+func a(ip, taskID string) rrstore.Record {
+	return rrstore.Record{Addr: net.ParseIP(ip), TaskID: taskID}
+}
+
+func srv(ip string, port uint16, taskID string) rrstore.Record {
+	return rrstore.Record{Addr: net.ParseIP(ip), Port: port, Priority: 1, Weight: 1, TaskID: taskID}
 }
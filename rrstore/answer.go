@@ -0,0 +1,66 @@
+package rrstore
+
+import (
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// answerKey identifies the records of a name and type.
+type answerKey struct {
+	name   string
+	rrType uint16
+}
+
+// Answer is the answer section of a DNS response in wire format, packed once
+// for the records of a name and type when the records are stored. The owner
+// names of the records are compressed to point at the question name following
+// the message header (offset 12), therefore the answer can only be appended
+// to a response with a single question of the same name.
+type Answer struct {
+	n       int    // number of records
+	size    int    // length of the records packed
+	packed  []byte // records packed twice in a row, so rotations are slices
+	offsets []int  // offsets of the records in packed
+	next    uint32 // rotation counter
+}
+
+// Len returns the number of records in the answer.
+func (a *Answer) Len() int {
+	return a.n
+}
+
+// Next returns the answer section with the records rotated by one from the
+// previous call, so that consecutive responses start with different records.
+// The returned slice is shared and must not be modified.
+func (a *Answer) Next() []byte {
+	if a.n == 0 {
+		return a.packed
+	}
+	off := a.offsets[atomic.AddUint32(&a.next, 1)%uint32(a.n)]
+	return a.packed[off : off+a.size]
+}
+
+// packAnswer packs the built DNS RRs of the records with the specified name,
+// with the owner names pointing at the question name.
+func packAnswer(name string, recs []Record, buf []byte) (*Answer, error) {
+	nameLen, err := dns.PackDomainName(name, buf, 0, nil, false)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Answer{n: len(recs), offsets: make([]int, len(recs))}
+	var once []byte
+	for i, rec := range recs {
+		off, err := dns.PackRR(rec.rr, buf, 0, nil, false)
+		if err != nil {
+			return nil, err
+		}
+		a.offsets[i] = len(once)
+		once = append(once, 0xC0, 0x0C) // pointer to the question name
+		once = append(once, buf[nameLen:off]...)
+	}
+	a.size = len(once)
+	a.packed = append(once, once...)
+	return a, nil
+}
@@ -0,0 +1,106 @@
+package rrstore
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Change describes the changes in the records of a name and type.
+type Change struct {
+	Name    string
+	Type    uint16
+	Added   []Record // records that did not exist before
+	Removed []Record // records that no longer exist
+}
+
+// Diff describes the changes in the records made by a write.
+type Diff struct {
+	Generation uint64 // generation of the new records
+
+	Added   []Change // names (of a type) that did not exist before
+	Removed []Change // names (of a type) that no longer exist
+	Changed []Change // names (of a type) with records added or removed
+}
+
+// Empty returns if the records are unchanged.
+func (d Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// String gives a summary of the changes.
+func (d Diff) String() string {
+	var added, removed int
+	for _, l := range [][]Change{d.Added, d.Removed, d.Changed} {
+		for _, c := range l {
+			added += len(c.Added)
+			removed += len(c.Removed)
+		}
+	}
+	return fmt.Sprintf("generation %d: %d names added, %d removed, %d changed (+%d/-%d records)",
+		d.Generation, len(d.Added), len(d.Removed), len(d.Changed), added, removed)
+}
+
+// diff computes the changes from the old records to the new ones. Records are
+// compared by their DNS RRs, so the changes in the task a record belongs to
+// are ignored. The changes are sorted by name and type.
+func diff(old, new *snapshot) Diff {
+	d := Diff{Generation: new.gen}
+	for t, names := range new.rrs {
+		for name, recs := range names {
+			prev, ok := old.rrs[t][name]
+			c := Change{Name: name, Type: t}
+			c.Added, c.Removed = diffRecords(prev, recs)
+			if !ok {
+				d.Added = append(d.Added, c)
+			} else if len(c.Added) > 0 || len(c.Removed) > 0 {
+				d.Changed = append(d.Changed, c)
+			}
+		}
+	}
+	for t, names := range old.rrs {
+		for name, recs := range names {
+			if _, ok := new.rrs[t][name]; !ok {
+				d.Removed = append(d.Removed, Change{Name: name, Type: t, Removed: recs})
+			}
+		}
+	}
+	for _, l := range [][]Change{d.Added, d.Removed, d.Changed} {
+		sort.Sort(byNameType(l))
+	}
+	return d
+}
+
+// diffRecords returns the records only in new and the ones only in old.
+func diffRecords(old, new []Record) (added, removed []Record) {
+	count := make(map[string]int, len(old))
+	for _, r := range old {
+		count[r.rr.String()]++
+	}
+	for _, r := range new {
+		k := r.rr.String()
+		if count[k] > 0 {
+			count[k]--
+		} else {
+			added = append(added, r)
+		}
+	}
+	for _, r := range old {
+		k := r.rr.String()
+		if count[k] > 0 {
+			count[k]--
+			removed = append(removed, r)
+		}
+	}
+	return added, removed
+}
+
+type byNameType []Change
+
+func (l byNameType) Len() int      { return len(l) }
+func (l byNameType) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l byNameType) Less(i, j int) bool {
+	if l[i].Name != l[j].Name {
+		return l[i].Name < l[j].Name
+	}
+	return l[i].Type < l[j].Type
+}
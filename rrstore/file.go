@@ -0,0 +1,152 @@
+package rrstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fileVersion is the version of the snapshot file format.
+const fileVersion = 1
+
+// snapshotFile is the on-disk format of the records.
+type snapshotFile struct {
+	Version    int        `json:"version"`
+	Saved      time.Time  `json:"saved"`
+	Generation uint64     `json:"generation"`
+	Names      []fileName `json:"names"`
+}
+
+// fileName is the records of a type for a name. Names without records are
+// kept, as they are answered with no records rather than NXDOMAIN.
+type fileName struct {
+	Name    string       `json:"name"`
+	Type    string       `json:"type"`
+	Records []fileRecord `json:"records"`
+}
+
+type fileRecord struct {
+	Addr     net.IP   `json:"addr,omitempty"`
+	Port     uint16   `json:"port,omitempty"`
+	Target   string   `json:"target,omitempty"`
+	Priority uint16   `json:"priority,omitempty"`
+	Weight   uint16   `json:"weight,omitempty"`
+	TTL      uint32   `json:"ttl,omitempty"`
+	Text     []string `json:"text,omitempty"`
+	TaskID   string   `json:"task,omitempty"`
+}
+
+// WriteFile saves the records of generation gen to the file at path as JSON,
+// along with the time they are saved. The file is written atomically, so it
+// is either replaced with the new records or left as it was, and durably: it
+// is synced to disk, as is its directory once it is replaced.
+func WriteFile(path string, gen uint64, rl RRs) error {
+	f := snapshotFile{
+		Version:    fileVersion,
+		Saved:      time.Now().UTC(),
+		Generation: gen,
+	}
+	for t, names := range rl {
+		for name, recs := range names {
+			n := fileName{Name: name, Type: dns.TypeToString[t], Records: []fileRecord{}}
+			for _, r := range recs {
+				n.Records = append(n.Records, fileRecord{
+					Addr:     r.Addr,
+					Port:     r.Port,
+					Target:   r.Target,
+					Priority: r.Priority,
+					Weight:   r.Weight,
+					TTL:      r.TTL,
+					Text:     r.Text,
+					TaskID:   r.TaskID,
+				})
+			}
+			f.Names = append(f.Names, n)
+		}
+	}
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file in the same directory and rename it over the
+	// destination, as renames are atomic within a filesystem
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir syncs the directory at path to disk, so that the files renamed in it
+// are there after a crash.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// ReadFile loads the records saved with WriteFile and returns them with their
+// generation and the time they were saved.
+func ReadFile(path string) (gen uint64, rl RRs, saved time.Time, err error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, nil, time.Time{}, err
+	}
+	var f snapshotFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return 0, nil, time.Time{}, fmt.Errorf("cannot parse records file %s: %v", path, err)
+	}
+	if f.Version != fileVersion {
+		return 0, nil, time.Time{}, fmt.Errorf("unsupported records file version %d in %s", f.Version, path)
+	}
+
+	rl = make(RRs)
+	for _, n := range f.Names {
+		t, ok := dns.StringToType[n.Type]
+		if !ok {
+			return 0, nil, time.Time{}, fmt.Errorf("unknown record type %q in %s", n.Type, path)
+		}
+		if rl[t] == nil {
+			rl[t] = make(map[string][]Record)
+		}
+		recs := make([]Record, 0, len(n.Records))
+		for _, r := range n.Records {
+			recs = append(recs, Record{
+				Addr:     r.Addr,
+				Port:     r.Port,
+				Target:   r.Target,
+				Priority: r.Priority,
+				Weight:   r.Weight,
+				TTL:      r.TTL,
+				Text:     r.Text,
+				TaskID:   r.TaskID,
+			})
+		}
+		rl[t][n.Name] = recs
+	}
+	return f.Generation, rl, f.Saved, nil
+}
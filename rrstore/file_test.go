@@ -0,0 +1,76 @@
+package rrstore
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "records.json")
+
+	in := RRs{
+		dns.TypeA:   {"a.": records("10.0.0.1", "10.0.0.2")},
+		dns.TypeSRV: {
+			"_a._tcp.": []Record{{Addr: net.ParseIP("10.0.0.1"), Port: 80, Priority: 1, Weight: 1, TaskID: "web"}},
+			"_a._udp.": []Record{}, // kept without records
+		},
+		dns.TypeTXT: {"a.": []Record{{Text: []string{"foo", "bar"}, TTL: 60}}},
+	}
+	if err := WriteFile(path, 42, in); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(path, 43, in); err != nil { // replaces
+		t.Fatal(err)
+	}
+	if l, _ := filepath.Glob(filepath.Join(dir, "*")); len(l) != 1 {
+		t.Fatalf("temporary files are left: %v", l)
+	}
+
+	gen, out, saved, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gen != 43 {
+		t.Fatalf("wrong generation: %d", gen)
+	}
+	if age := time.Since(saved); age < 0 || age > time.Minute {
+		t.Fatalf("wrong save time: %v", saved)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Fatalf("wrong records.\nexpected=%v\ngot=%v", in, out)
+	}
+
+	// loaded records can be stored
+	s := New()
+	if err := s.Set(gen, out); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadFile_invalid(t *testing.T) {
+	dir := t.TempDir()
+
+	for i, content := range []string{
+		`not json`,
+		`{"version":2,"names":[]}`,
+		`{"version":1,"names":[{"name":"a.","type":"FOO","records":[]}]}`,
+	} {
+		path := filepath.Join(dir, "records.json")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := ReadFile(path); err == nil {
+			t.Fatalf("case %d: invalid file is read", i)
+		}
+	}
+	if _, _, _, err := ReadFile(filepath.Join(dir, "nonexistent")); !os.IsNotExist(err) {
+		t.Fatalf("wrong error for missing file: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package rrstore
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Record is a typed DNS Resource Record. Which fields are used depends on the
+// type of the record it is stored as:
+//
+//	A:   Addr
+//	SRV: Target (or Addr, if Target is empty), Port, Priority, Weight
+//	TXT: Text
+type Record struct {
+	Addr     net.IP
+	Port     uint16
+	Target   string
+	Priority uint16
+	Weight   uint16
+	TTL      uint32
+	Text     []string
+	TaskID   string // ID of the task the record belongs to, if any
+
+	rr dns.RR // built when the record is stored
+}
+
+// RR returns the DNS RR built from the record when it was stored and nil if
+// the record is not obtained from a store. The returned value is shared, so
+// it must not be modified.
+func (r Record) RR() dns.RR {
+	return r.rr
+}
+
+// build creates the DNS RR with the specified type and name for the record.
+func (r Record) build(rrType uint16, name string) (dns.RR, error) {
+	hdr := dns.RR_Header{
+		Name:   name,
+		Rrtype: rrType,
+		Class:  dns.ClassINET,
+		Ttl:    r.TTL,
+	}
+	switch rrType {
+	case dns.TypeA:
+		ip := r.Addr.To4()
+		if ip == nil {
+			return nil, fmt.Errorf("not an IPv4 address: '%s'", r.Addr)
+		}
+		return &dns.A{Hdr: hdr, A: ip}, nil
+	case dns.TypeSRV:
+		target := r.Target
+		if target == "" {
+			if r.Addr == nil {
+				return nil, errors.New("no target or address")
+			}
+			target = r.Addr.String()
+		}
+		return &dns.SRV{
+			Hdr:      hdr,
+			Target:   dns.Fqdn(target), // have . suffix per SRV RFC
+			Port:     r.Port,
+			Priority: r.Priority,
+			Weight:   r.Weight,
+		}, nil
+	case dns.TypeTXT:
+		return &dns.TXT{Hdr: hdr, Txt: append([]string(nil), r.Text...)}, nil
+	}
+	return nil, fmt.Errorf("%s(%d) records are not implemented", dns.TypeToString[rrType], rrType)
+}
+
+// NewRecord creates the record of the DNS RR, which must be of a type records
+// can be stored as.
+func NewRecord(rr dns.RR) (Record, error) {
+	r := Record{TTL: rr.Header().Ttl}
+	switch rr := rr.(type) {
+	case *dns.A:
+		r.Addr = rr.A
+	case *dns.SRV:
+		r.Target = rr.Target
+		r.Port = rr.Port
+		r.Priority = rr.Priority
+		r.Weight = rr.Weight
+	case *dns.TXT:
+		r.Text = append([]string(nil), rr.Txt...)
+	default:
+		t := rr.Header().Rrtype
+		return r, fmt.Errorf("%s(%d) records are not implemented", dns.TypeToString[t], t)
+	}
+	return r, nil
+}
@@ -3,49 +3,200 @@
 package rrstore
 
 import (
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
 )
 
 // RRs stores FQDN RR answer for various RR Types.
 // Example:
-//     {
-//       dns.TypeA: {"a.b." : ["10.0.0.3"]},
-//       dns.TypeSRV: {"a.b." : ["10.0.0.3:23481","10.0.0.7:11215"]}
-//     }
-type RRs map[uint16]map[string][]string
+//
+//	{
+//	  dns.TypeA: {"a.b." : [{Addr: 10.0.0.3}]},
+//	  dns.TypeSRV: {"_a._tcp.b." : [{Addr: 10.0.0.3, Port: 23481}]}
+//	}
+type RRs map[uint16]map[string][]Record
+
+// ErrStale is returned when the records being written are older than the
+// records in the store.
+var ErrStale = errors.New("records are older than the current records")
 
+// RRReader provides the DNS Resource Records.
 type RRReader interface {
-	Get(fqdn string, rrType uint16) (rrs []string, ok bool)
+	// Get returns the records of the specified type for fqdn. The returned
+	// slice is owned by the caller and can be reordered (e.g. shuffled), but
+	// the records share their Addr, Text and RR with the store and must not
+	// be modified.
+	Get(fqdn string, rrType uint16) (rrs []Record, ok bool)
+
+	// Answer returns the records of the specified type for fqdn as an answer
+	// section prepacked in wire format.
+	Answer(fqdn string, rrType uint16) (*Answer, bool)
+
+	// Generation returns the generation of the current records, zero if no
+	// records are written yet.
+	Generation() uint64
+
+	// Records returns all the current records along with their generation.
+	// The returned table is shared with the store and must not be modified.
+	Records() (gen uint64, rl RRs)
 }
 
 type RRWriter interface {
-	Set(rl RRs)
+	// Set replaces the records with rl if gen is greater than the generation
+	// of the current records, otherwise returns ErrStale. Generations are
+	// monotonic numbers such as a counter incremented when the records start
+	// to be gathered, so that a slow write that started earlier cannot
+	// overwrite newer data.
+	// If a record cannot be converted to a DNS RR, an error is returned and
+	// the current records are kept.
+	Set(gen uint64, rl RRs) error
+}
+
+// RRWatcher publishes the changes in the records.
+type RRWatcher interface {
+	// Watch returns a channel receiving the changes made by every write that
+	// changes the records, until cancel is closed. The channel is buffered;
+	// if the watcher falls behind, the changes it cannot receive are dropped.
+	Watch(cancel <-chan struct{}) <-chan Diff
 }
 
 type RRStore interface {
 	RRReader
 	RRWriter
+	RRWatcher
 }
 
+// watchBuffer is the number of changes buffered for each watcher.
+const watchBuffer = 16
+
+// snapshot is an immutable version of the records along with their answer
+// sections.
+type snapshot struct {
+	gen     uint64
+	rrs     RRs
+	answers map[answerKey]*Answer
+}
+
+// rrStore keeps the records in an immutable snapshot that is atomically
+// replaced on every write, so that reads never block or observe a partially
+// written table.
 type rrStore struct {
-	rrs RRs
-	m   sync.RWMutex
+	v atomic.Value // holds *snapshot, never modified after stored
+	m sync.Mutex   // serializes writers, guards watchers
+
+	watchers map[chan Diff]struct{}
 }
 
 // New creates a new record table to store DNS Resource Records.
 func New() RRStore {
-	return &rrStore{}
+	r := &rrStore{watchers: make(map[chan Diff]struct{})}
+	r.v.Store(&snapshot{rrs: make(RRs), answers: make(map[answerKey]*Answer)})
+	return r
 }
 
-func (r *rrStore) Get(fqdn string, rrType uint16) (rrs []string, ok bool) {
-	r.m.RLock()
-	defer r.m.RUnlock()
-	rrs, ok = r.rrs[rrType][fqdn]
-	return
+func (r *rrStore) load() *snapshot {
+	return r.v.Load().(*snapshot)
 }
 
-func (r *rrStore) Set(rl RRs) {
+func (r *rrStore) Get(fqdn string, rrType uint16) (rrs []Record, ok bool) {
+	recs, ok := r.load().rrs[rrType][fqdn]
+	if !ok {
+		return nil, false
+	}
+	return append([]Record(nil), recs...), true
+}
+
+func (r *rrStore) Answer(fqdn string, rrType uint16) (*Answer, bool) {
+	a, ok := r.load().answers[answerKey{fqdn, rrType}]
+	return a, ok
+}
+
+func (r *rrStore) Generation() uint64 {
+	return r.load().gen
+}
+
+func (r *rrStore) Records() (gen uint64, rl RRs) {
+	s := r.load()
+	return s.gen, s.rrs
+}
+
+func (r *rrStore) Watch(cancel <-chan struct{}) <-chan Diff {
+	ch := make(chan Diff, watchBuffer)
+	r.m.Lock()
+	r.watchers[ch] = struct{}{}
+	r.m.Unlock()
+
+	go func() {
+		<-cancel
+		r.m.Lock()
+		delete(r.watchers, ch)
+		r.m.Unlock()
+		close(ch)
+	}()
+	return ch
+}
+
+// Set replaces the records with a copy of rl, therefore rl can be reused by
+// the caller afterwards. If the records are changed, the changes are sent to
+// the watchers.
+func (r *rrStore) Set(gen uint64, rl RRs) error {
+	s, err := newSnapshot(gen, rl)
+	if err != nil {
+		return err
+	}
+
 	r.m.Lock()
 	defer r.m.Unlock()
-	r.rrs = rl
+	old := r.load()
+	if gen <= old.gen {
+		return ErrStale
+	}
+	r.v.Store(s)
+
+	if len(r.watchers) > 0 {
+		if d := diff(old, s); !d.Empty() {
+			for ch := range r.watchers {
+				select {
+				case ch <- d:
+				default: // watcher is falling behind
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// newSnapshot returns a snapshot with a deep copy of the RR table, where the
+// DNS RRs of the records are built and packed into answer sections.
+func newSnapshot(gen uint64, rl RRs) (*snapshot, error) {
+	out := make(RRs, len(rl))
+	answers := make(map[answerKey]*Answer)
+	buf := make([]byte, dns.MaxMsgSize)
+	for t, names := range rl {
+		m := make(map[string][]Record, len(names))
+		for name, recs := range names {
+			l := make([]Record, len(recs))
+			for i, rec := range recs {
+				rec.Text = append([]string(nil), rec.Text...)
+				rr, err := rec.build(t, name)
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s record for %s: %v", dns.TypeToString[t], name, err)
+				}
+				rec.rr = rr
+				l[i] = rec
+			}
+			a, err := packAnswer(name, l, buf)
+			if err != nil {
+				return nil, fmt.Errorf("cannot pack %s records for %s: %v", dns.TypeToString[t], name, err)
+			}
+			m[name] = l
+			answers[answerKey{name, t}] = a
+		}
+		out[t] = m
+	}
+	return &snapshot{gen: gen, rrs: out, answers: answers}, nil
 }
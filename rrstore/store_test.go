@@ -1,44 +1,454 @@
 package rrstore
 
 import (
+	"fmt"
+	"net"
 	"reflect"
+	"strconv"
 	"sync"
 	"testing"
+
+	"github.com/miekg/dns"
 )
 
 func TestRRStore(t *testing.T) {
 	s := New()
-	s.Get("foo", 0)
+	s.Get("foo.", dns.TypeA)
 
-	in := map[uint16]map[string][]string{
-		0: {"1": []string{"2"}},
-		3: {"4": []string{"5"}},
+	in := RRs{
+		dns.TypeA:   {"a.": []Record{{Addr: net.IPv4(10, 0, 0, 1)}}},
+		dns.TypeSRV: {"_a._tcp.": []Record{{Addr: net.IPv4(10, 0, 0, 1), Port: 80, TaskID: "web"}}},
 	}
-	s.Set(in)
-	if v, _ := s.Get("1", 0); !reflect.DeepEqual(v, in[0]["1"]) {
-		t.Fatal("wrong value")
+	if err := s.Set(1, in); err != nil {
+		t.Fatal(err)
 	}
-	if v, _ := s.Get("4", 3); !reflect.DeepEqual(v, in[3]["4"]) {
-		t.Fatal("wrong value")
+	if v, _ := s.Get("a.", dns.TypeA); len(v) != 1 || v[0].RR().String() != "a.\t0\tIN\tA\t10.0.0.1" {
+		t.Fatalf("wrong value: %v", v)
+	}
+	if v, _ := s.Get("_a._tcp.", dns.TypeSRV); len(v) != 1 || v[0].TaskID != "web" ||
+		v[0].RR().String() != "_a._tcp.\t0\tIN\tSRV\t0 0 80 10.0.0.1." {
+		t.Fatalf("wrong value: %v", v)
 	}
-	if _, ok := s.Get("1", 1); ok {
+	if _, ok := s.Get("a.", dns.TypeSRV); ok {
 		t.Fatal("wrong value")
 	}
 }
 
+func TestRRStore_invalidRecords(t *testing.T) {
+	s := New()
+	valid := RRs{dns.TypeA: {"a.": []Record{{Addr: net.IPv4(10, 0, 0, 1)}}}}
+	if err := s.Set(1, valid); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, in := range []RRs{
+		{dns.TypeA: {"a.": []Record{{}}}},
+		{dns.TypeA: {"a.": []Record{{Addr: net.ParseIP("2001:db8::1")}}}},
+		{dns.TypeSRV: {"_a._tcp.": []Record{{Port: 80}}}},
+		{dns.TypeMX: {"a.": []Record{{Target: "mail.a."}}}},
+	} {
+		if err := s.Set(2, in); err == nil {
+			t.Fatalf("invalid records are accepted: %v", in)
+		}
+	}
+	if g := s.Generation(); g != 1 {
+		t.Fatalf("records are replaced with invalid records: generation=%d", g)
+	}
+}
+
 func TestRRStore_RaceCond(t *testing.T) {
 	s := New()
 	var wg sync.WaitGroup
 	for i := 0; i < 1000; i++ {
 		wg.Add(2)
 		go func() {
-			s.Get("1", 0)
+			s.Get("a.", dns.TypeTXT)
 			wg.Done()
 		}()
-		go func() {
-			s.Set(make(map[uint16]map[string][]string))
+		go func(gen uint64) {
+			s.Set(gen, make(RRs))
 			wg.Done()
+		}(uint64(i + 1))
+	}
+	wg.Wait()
+	if g := s.Generation(); g != 1000 {
+		t.Fatalf("wrong generation: %d", g)
+	}
+}
+
+func TestRRStore_Generation(t *testing.T) {
+	s := New()
+	if g := s.Generation(); g != 0 {
+		t.Fatalf("wrong initial generation: %d", g)
+	}
+
+	newer := txt("a.", "new")
+	older := txt("a.", "old")
+	if err := s.Set(20, newer); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(10, older); err != ErrStale {
+		t.Fatalf("older write is not rejected: %v", err)
+	}
+	if err := s.Set(20, older); err != ErrStale {
+		t.Fatalf("write with the same generation is not rejected: %v", err)
+	}
+	if g := s.Generation(); g != 20 {
+		t.Fatalf("wrong generation: %d", g)
+	}
+	if v, _ := s.Get("a.", dns.TypeTXT); !reflect.DeepEqual(texts(v), []string{"new"}) {
+		t.Fatalf("newer records are overwritten: %v", v)
+	}
+	if g, rl := s.Records(); g != 20 || !reflect.DeepEqual(texts(rl[dns.TypeTXT]["a."]), []string{"new"}) {
+		t.Fatalf("wrong records: %d %v", g, rl)
+	}
+}
+
+func TestRRStore_GetReturnsCopy(t *testing.T) {
+	s := New()
+	s.Set(1, txt("a.", "1", "2", "3"))
+
+	v, _ := s.Get("a.", dns.TypeTXT)
+	v[0], v[2] = v[2], v[0]
+	if v, _ := s.Get("a.", dns.TypeTXT); !reflect.DeepEqual(texts(v), []string{"1", "2", "3"}) {
+		t.Fatalf("stored records are modified through Get: %v", v)
+	}
+}
+
+func TestRRStore_SetCopies(t *testing.T) {
+	s := New()
+	in := txt("a.", "1", "2", "3")
+	s.Set(1, in)
+
+	in[dns.TypeTXT]["a."][0].Text[0] = "x"
+	in[dns.TypeTXT]["a."][1] = Record{Text: []string{"y"}}
+	in[dns.TypeTXT]["b."] = []Record{{Text: []string{"4"}}}
+	if v, _ := s.Get("a.", dns.TypeTXT); !reflect.DeepEqual(texts(v), []string{"1", "2", "3"}) {
+		t.Fatalf("stored records are modified through Set input: %v", v)
+	}
+	if _, ok := s.Get("b.", dns.TypeTXT); ok {
+		t.Fatal("stored records are modified through Set input")
+	}
+}
+
+// TestRRStore_ConcurrentModify modifies the returned records while records
+// are being replaced. Run with -race.
+func TestRRStore_ConcurrentModify(t *testing.T) {
+	s := New()
+	in := txt("a.", "1", "2", "3", "4")
+	s.Set(1, in)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			v, _ := s.Get("a.", dns.TypeTXT)
+			for j := range v { // reverse in place
+				k := len(v) - 1 - j
+				if j >= k {
+					break
+				}
+				v[j], v[k] = v[k], v[j]
+			}
 		}()
+		go func(gen uint64) {
+			defer wg.Done()
+			s.Set(gen, in)
+		}(uint64(i + 2))
 	}
 	wg.Wait()
+
+	if v, _ := s.Get("a.", dns.TypeTXT); !reflect.DeepEqual(texts(v), []string{"1", "2", "3", "4"}) {
+		t.Fatalf("stored records are reordered: %v", v)
+	}
+}
+
+func TestRRStore_Answer(t *testing.T) {
+	s := New()
+	if err := s.Set(1, benchRRs); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Answer("b.", dns.TypeA); ok {
+		t.Fatal("answer for nonexistent records")
+	}
+	a, ok := s.Answer("a.", dns.TypeA)
+	if !ok || a.Len() != 3 {
+		t.Fatalf("wrong answer: %v", a)
+	}
+
+	// every record comes first once in consecutive rotations
+	first := make(map[string]bool)
+	for i := 0; i < a.Len(); i++ {
+		m := unpackAnswer(t, "A.", a.Next(), a.Len())
+		if len(m.Answer) != 3 {
+			t.Fatalf("wrong number of answers: %v", m.Answer)
+		}
+		for _, rr := range m.Answer {
+			if rr.Header().Name != "A." {
+				t.Fatalf("owner name does not point at the question: %v", rr)
+			}
+		}
+		first[m.Answer[0].(*dns.A).A.String()] = true
+	}
+	if len(first) != 3 {
+		t.Fatalf("answers are not rotated: %v", first)
+	}
+
+	// answers are replaced along with the records
+	if err := s.Set(2, txt("a.", "foo")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Answer("a.", dns.TypeA); ok {
+		t.Fatal("answer is not replaced")
+	}
+	a, _ = s.Answer("a.", dns.TypeTXT)
+	if m := unpackAnswer(t, "a.", a.Next(), a.Len()); m.Answer[0].(*dns.TXT).Txt[0] != "foo" {
+		t.Fatalf("wrong answer: %v", m.Answer)
+	}
+}
+
+// unpackAnswer unpacks a response with the question for name and the answer
+// section appended.
+func unpackAnswer(t *testing.T, name string, answer []byte, n int) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = append(b, answer...)
+	b[6], b[7] = byte(n>>8), byte(n) // ANCOUNT
+	if err := m.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestRRStore_Watch(t *testing.T) {
+	s := New()
+	cancel := make(chan struct{})
+	ch := s.Watch(cancel)
+
+	s.Set(1, RRs{
+		dns.TypeA:   {"a.": records("10.0.0.1", "10.0.0.2"), "b.": records("10.0.0.3")},
+		dns.TypeSRV: {"_a._tcp.": records("10.0.0.1:80")},
+	})
+	d := <-ch
+	if d.Generation != 1 || len(d.Added) != 3 || len(d.Removed) != 0 || len(d.Changed) != 0 {
+		t.Fatalf("wrong diff: %s", d)
+	}
+
+	// unchanged records, different order and tasks
+	s.Set(2, RRs{
+		dns.TypeA:   {"a.": append(records("10.0.0.2"), Record{Addr: net.IPv4(10, 0, 0, 1), TaskID: "web"}), "b.": records("10.0.0.3")},
+		dns.TypeSRV: {"_a._tcp.": records("10.0.0.1:80")},
+	})
+	s.Set(3, RRs{
+		dns.TypeA:   {"a.": records("10.0.0.2", "10.0.0.4"), "c.": records("10.0.0.5")},
+		dns.TypeSRV: {"_a._tcp.": records("10.0.0.1:80")},
+	})
+	d = <-ch
+	if d.Generation != 3 {
+		t.Fatalf("unchanged records are published: %s", d)
+	}
+	expected := Diff{
+		Generation: 3,
+		Added:      []Change{{Name: "c.", Type: dns.TypeA, Added: records("10.0.0.5")}},
+		Removed:    []Change{{Name: "b.", Type: dns.TypeA, Removed: records("10.0.0.3")}},
+		Changed:    []Change{{Name: "a.", Type: dns.TypeA, Added: records("10.0.0.4"), Removed: records("10.0.0.1")}},
+	}
+	if !reflect.DeepEqual(summary(d), summary(expected)) {
+		t.Fatalf("wrong diff.\nexpected=%v\ngot=%v", summary(expected), summary(d))
+	}
+
+	close(cancel)
+	if _, ok := <-ch; ok {
+		t.Fatal("channel is not closed")
+	}
+	s.Set(4, RRs{}) // no watchers
+}
+
+// records gives A records for the specified addresses, or SRV records if the
+// addresses have ports.
+func records(addrs ...string) []Record {
+	l := make([]Record, len(addrs))
+	for i, v := range addrs {
+		host, port, err := net.SplitHostPort(v)
+		if err != nil {
+			host, port = v, "0"
+		}
+		p, _ := strconv.Atoi(port)
+		l[i] = Record{Addr: net.ParseIP(host), Port: uint16(p)}
+	}
+	return l
+}
+
+// summary describes the changes in a diff as strings, as the records in a
+// diff are not comparable to the ones written.
+func summary(d Diff) []string {
+	var out []string
+	for i, l := range [][]Change{d.Added, d.Removed, d.Changed} {
+		for _, c := range l {
+			s := fmt.Sprintf("%d %s %s", i, dns.TypeToString[c.Type], c.Name)
+			for _, r := range c.Added {
+				s += " +" + r.Addr.String()
+			}
+			for _, r := range c.Removed {
+				s += " -" + r.Addr.String()
+			}
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// mutexStore is the RWMutex-based store that rrStore replaced, kept to compare
+// the performance of the two.
+type mutexStore struct {
+	s *snapshot
+	m sync.RWMutex
+}
+
+func newMutexStore() *mutexStore {
+	return &mutexStore{s: &snapshot{}}
+}
+
+func (r *mutexStore) Get(fqdn string, rrType uint16) (rrs []Record, ok bool) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	recs, ok := r.s.rrs[rrType][fqdn]
+	if !ok {
+		return nil, false
+	}
+	return append([]Record(nil), recs...), true
+}
+
+func (r *mutexStore) Answer(fqdn string, rrType uint16) (*Answer, bool) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	a, ok := r.s.answers[answerKey{fqdn, rrType}]
+	return a, ok
+}
+
+func (r *mutexStore) Generation() uint64 {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.s.gen
+}
+
+func (r *mutexStore) Records() (gen uint64, rl RRs) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.s.gen, r.s.rrs
+}
+
+func (r *mutexStore) Set(gen uint64, rl RRs) error {
+	s, err := newSnapshot(gen, rl)
+	if err != nil {
+		return err
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	if gen <= r.s.gen {
+		return ErrStale
+	}
+	r.s = s
+	return nil
+}
+
+// txt gives an RR table with TXT records for name, a record for each text.
+func txt(name string, texts ...string) RRs {
+	l := make([]Record, len(texts))
+	for i, v := range texts {
+		l[i] = Record{Text: []string{v}}
+	}
+	return RRs{dns.TypeTXT: {name: l}}
+}
+
+// texts gives the texts of the TXT records.
+func texts(l []Record) []string {
+	var out []string
+	for _, r := range l {
+		out = append(out, r.Text...)
+	}
+	return out
+}
+
+var benchRRs = RRs{dns.TypeA: {"a.": []Record{
+	{Addr: net.IPv4(10, 0, 0, 1)},
+	{Addr: net.IPv4(10, 0, 0, 2)},
+	{Addr: net.IPv4(10, 0, 0, 3)},
+}}}
+
+type readWriter interface {
+	RRReader
+	RRWriter
+}
+
+func benchmarkGet(b *testing.B, s readWriter) {
+	s.Set(1, benchRRs)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			s.Get("a.", dns.TypeA)
+		}
+	})
+}
+
+func benchmarkGetWithWrites(b *testing.B, s readWriter) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for gen := uint64(1); ; gen++ {
+			select {
+			case <-done:
+				return
+			default:
+				s.Set(gen, benchRRs)
+			}
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			s.Get("a.", dns.TypeA)
+		}
+	})
+}
+
+func BenchmarkGet_atomic(b *testing.B)  { benchmarkGet(b, New()) }
+func BenchmarkGet_rwmutex(b *testing.B) { benchmarkGet(b, newMutexStore()) }
+
+func BenchmarkGetWithWrites_atomic(b *testing.B)  { benchmarkGetWithWrites(b, New()) }
+func BenchmarkGetWithWrites_rwmutex(b *testing.B) { benchmarkGetWithWrites(b, newMutexStore()) }
+
+func TestNewRecord(t *testing.T) {
+	s := New()
+	for _, v := range []string{
+		"a.\t5\tIN\tA\t10.0.0.1",
+		"_a._tcp.\t5\tIN\tSRV\t1 2 80 host.a.",
+		"t.a.\t5\tIN\tTXT\t\"x\" \"y\"",
+	} {
+		rr, err := dns.NewRR(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec, err := NewRecord(rr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := rr.Header()
+		if err := s.Set(s.Generation()+1, RRs{h.Rrtype: {h.Name: {rec}}}); err != nil {
+			t.Fatal(err)
+		}
+		if l, _ := s.Get(h.Name, h.Rrtype); len(l) != 1 || l[0].RR().String() != v {
+			t.Fatalf("wrong record for %q: %v", v, l)
+		}
+	}
+
+	rr, _ := dns.NewRR("a. 5 IN MX 10 mail.a.")
+	if _, err := NewRecord(rr); err == nil {
+		t.Fatal("expected error for MX record")
+	}
 }
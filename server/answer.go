@@ -0,0 +1,51 @@
+package server
+
+import (
+	"encoding/binary"
+
+	"github.com/ahmetalpbalkan/wagl/rrstore"
+	"github.com/miekg/dns"
+)
+
+const (
+	headerLen = 12 // length of the DNS message header
+
+	flagQR = 1 << 15 // response
+	flagAA = 1 << 10 // authoritative answer
+	flagRD = 1 << 8  // recursion desired
+)
+
+// writeAnswer writes an authoritative response to the query r with the
+// prepacked answer section, without building and packing a message. If the
+// response does not fit in a UDP response to the client, it returns false
+// without writing, so the response can be built and truncated instead.
+func writeAnswer(w dns.ResponseWriter, r *dns.Msg, a *rrstore.Answer) bool {
+	answer := a.Next()
+	q := r.Question[0]
+	b := make([]byte, headerLen+len(q.Name)+2+4+len(answer))
+
+	flags := uint16(flagQR | flagAA) // opcode is QUERY (0), rcode is NOERROR (0)
+	if r.RecursionDesired {
+		flags |= flagRD
+	}
+	binary.BigEndian.PutUint16(b[0:], r.Id)
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], 1) // QDCOUNT
+	binary.BigEndian.PutUint16(b[6:], uint16(a.Len()))
+
+	off, err := dns.PackDomainName(q.Name, b, headerLen, nil, false)
+	if err != nil {
+		return false
+	}
+	binary.BigEndian.PutUint16(b[off:], q.Qtype)
+	binary.BigEndian.PutUint16(b[off+2:], q.Qclass)
+	off += 4
+	off += copy(b[off:], answer)
+	b = b[:off]
+
+	if clientNetwork(w) == "udp" && len(b) > udpSize(r) {
+		return false
+	}
+	w.Write(b)
+	return true
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/ahmetalpbalkan/wagl/rrstore"
+	"github.com/miekg/dns"
+)
+
+func TestWriteAnswer(t *testing.T) {
+	rr := rrstore.New()
+	rr.Set(1, rrstore.RRs{
+		dns.TypeA:   {"api.domain.": records("10.0.0.1", "10.0.0.2")},
+		dns.TypeSRV: {"_web._tcp.domain.": records("10.0.0.1:80")},
+	})
+	d := New("domain", ":8053", rr, false, nil)
+
+	cases := []struct {
+		name  string
+		qType uint16
+	}{
+		{"api.domain.", dns.TypeA},
+		{"API.Domain.", dns.TypeA},
+		{"_web._tcp.domain.", dns.TypeSRV},
+	}
+	for _, c := range cases {
+		req := new(dns.Msg)
+		req.SetQuestion(c.name, c.qType)
+
+		prepacked := &answerWriter{network: "udp"}
+		d.handleDomain(prepacked, req)
+		if prepacked.b == nil {
+			t.Fatalf("answer for %s is not prepacked", c.name)
+		}
+		got := new(dns.Msg)
+		if err := got.Unpack(prepacked.b); err != nil {
+			t.Fatal(err)
+		}
+
+		// compare with the message built from the records
+		d.rr = noAnswers{rr}
+		built := &answerWriter{network: "udp"}
+		d.handleDomain(built, req)
+		d.rr = rr
+		expected := built.m
+
+		if got.MsgHdr != expected.MsgHdr {
+			t.Fatalf("wrong header for %s.\nexpected=%+v\ngot=%+v", c.name, expected.MsgHdr, got.MsgHdr)
+		}
+		if len(got.Question) != 1 || got.Question[0] != req.Question[0] {
+			t.Fatalf("wrong question for %s: %v", c.name, got.Question)
+		}
+		if len(got.Answer) != len(expected.Answer) {
+			t.Fatalf("wrong answers for %s.\nexpected=%v\ngot=%v", c.name, expected.Answer, got.Answer)
+		}
+		for _, a := range got.Answer {
+			if a.Header().Name != c.name {
+				t.Fatalf("wrong owner name for %s: %v", c.name, a)
+			}
+		}
+	}
+}
+
+func TestWriteAnswer_large(t *testing.T) {
+	addrs := make([]string, 100)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+	}
+	rr := rrstore.New()
+	rr.Set(1, rrstore.RRs{dns.TypeA: {"big.domain.": records(addrs...)}})
+	d := New("domain", ":8053", rr, false, nil)
+
+	req := new(dns.Msg)
+	req.SetQuestion("big.domain.", dns.TypeA)
+
+	// does not fit in a UDP response, built and truncated
+	w := &answerWriter{network: "udp"}
+	d.handleDomain(w, req)
+	if w.b != nil || w.m == nil {
+		t.Fatal("oversized answer is prepacked over UDP")
+	}
+	if !w.m.Truncated || w.m.Len() > dns.MinMsgSize {
+		t.Fatalf("response is not truncated: %d bytes", w.m.Len())
+	}
+
+	// fits in a TCP response
+	w = &answerWriter{network: "tcp"}
+	d.handleDomain(w, req)
+	m := new(dns.Msg)
+	if err := m.Unpack(w.b); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Answer) != len(addrs) {
+		t.Fatalf("wrong number of answers: %d", len(m.Answer))
+	}
+}
+
+func benchmarkHandleDomain(b *testing.B, prepacked bool) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	var rr rrstore.RRReader
+	s := rrstore.New()
+	s.Set(1, rrstore.RRs{
+		dns.TypeA: {"api.domain.": records("10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4")},
+	})
+	rr = s
+	if !prepacked {
+		rr = noAnswers{s}
+	}
+	d := New("domain", ":8053", rr, false, nil)
+
+	req := new(dns.Msg)
+	req.SetQuestion("api.domain.", dns.TypeA)
+	w := &answerWriter{network: "udp", pack: true}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.handleDomain(w, req)
+	}
+}
+
+func BenchmarkHandleDomain_prepacked(b *testing.B) { benchmarkHandleDomain(b, true) }
+func BenchmarkHandleDomain_message(b *testing.B)   { benchmarkHandleDomain(b, false) }
+
+// noAnswers hides the prepacked answers of the records, so that the responses
+// are built from the records.
+type noAnswers struct {
+	rrstore.RRReader
+}
+
+func (noAnswers) Answer(string, uint16) (*rrstore.Answer, bool) { return nil, false }
+
+// answerWriter is a dns.ResponseWriter keeping the written response. If pack
+// is set, the written messages are packed as they would be sent.
+type answerWriter struct {
+	network string
+	pack    bool
+
+	b []byte
+	m *dns.Msg
+}
+
+func (w *answerWriter) LocalAddr() net.Addr { return nil }
+
+func (w *answerWriter) RemoteAddr() net.Addr {
+	if w.network == "udp" {
+		return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+	}
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+}
+
+func (w *answerWriter) WriteMsg(m *dns.Msg) error {
+	w.m = m
+	if w.pack {
+		_, err := m.Pack()
+		return err
+	}
+	return nil
+}
+
+func (w *answerWriter) Write(b []byte) (int, error) {
+	w.b = b
+	return len(b), nil
+}
+
+func (w *answerWriter) Close() error        { return nil }
+func (w *answerWriter) TsigStatus() error   { return nil }
+func (w *answerWriter) TsigTimersOnly(bool) {}
+func (w *answerWriter) Hijack()             {}
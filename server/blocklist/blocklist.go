@@ -0,0 +1,75 @@
+// Package blocklist provides a plugin answering the queries for the names in
+// the blocked zones without resolving them, e.g. to keep the containers from
+// reaching some domains.
+package blocklist
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ahmetalpbalkan/wagl/server"
+	"github.com/miekg/dns"
+)
+
+// New creates a middleware answering the queries for the names in the zones,
+// including the zones themselves, with the rcode.
+func New(zones []string, rcode int) server.Middleware {
+	blocked := make(map[string]bool, len(zones))
+	for _, z := range zones {
+		blocked[strings.ToLower(dns.Fqdn(z))] = true
+	}
+	return func(next dns.Handler) dns.Handler {
+		return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			if len(r.Question) == 0 || !isBlocked(blocked, strings.ToLower(r.Question[0].Name)) {
+				next.ServeDNS(w, r)
+				return
+			}
+			m := new(dns.Msg)
+			m.SetRcode(r, rcode)
+			w.WriteMsg(m)
+		})
+	}
+}
+
+// isBlocked returns if the name or one of its parents is blocked.
+func isBlocked(blocked map[string]bool, name string) bool {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if blocked[name[off:]] {
+			return true
+		}
+	}
+	return false
+}
+
+// Plugin creates the middleware with its settings in the configuration file:
+//
+//	zones = ["ads.example.com", "tracker.example"]
+//	rcode = "NXDOMAIN" # or "REFUSED", the default is NXDOMAIN
+func Plugin(settings map[string]interface{}) (server.Middleware, error) {
+	l, ok := settings["zones"].([]interface{})
+	if !ok || len(l) == 0 {
+		return nil, errors.New("expected 'zones' to be an array of zones")
+	}
+	zones := make([]string, len(l))
+	for i, v := range l {
+		z, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a zone in 'zones', got %v", v)
+		}
+		zones[i] = z
+	}
+
+	rcode := dns.RcodeNameError
+	if v, ok := settings["rcode"]; ok {
+		s, _ := v.(string)
+		switch strings.ToUpper(s) {
+		case "NXDOMAIN":
+		case "REFUSED":
+			rcode = dns.RcodeRefused
+		default:
+			return nil, fmt.Errorf("expected 'rcode' to be NXDOMAIN or REFUSED, got %v", v)
+		}
+	}
+	return New(zones, rcode), nil
+}
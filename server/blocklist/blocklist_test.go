@@ -0,0 +1,66 @@
+package blocklist
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// msgWriter is a dns.ResponseWriter keeping the written message.
+type msgWriter struct {
+	dns.ResponseWriter
+	m *dns.Msg
+}
+
+func (w *msgWriter) RemoteAddr() net.Addr      { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (w *msgWriter) WriteMsg(m *dns.Msg) error { w.m = m; return nil }
+
+func TestPlugin(t *testing.T) {
+	m, err := Plugin(map[string]interface{}{
+		"zones": []interface{}{"Ads.Example.com", "tracker.example."},
+		"rcode": "refused",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := m(dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		w.WriteMsg(resp)
+	}))
+
+	cases := []struct {
+		name     string
+		expected int
+	}{
+		{"ads.example.com.", dns.RcodeRefused},
+		{"x.ADS.example.com.", dns.RcodeRefused},
+		{"tracker.example.", dns.RcodeRefused},
+		{"example.com.", dns.RcodeSuccess},
+		{"notads.example.com.", dns.RcodeSuccess},
+		{"api.swarm.", dns.RcodeSuccess},
+	}
+	for _, c := range cases {
+		w := new(msgWriter)
+		q := new(dns.Msg)
+		q.SetQuestion(c.name, dns.TypeA)
+		h.ServeDNS(w, q)
+		if w.m == nil || w.m.Rcode != c.expected {
+			t.Errorf("%s: expected %s, got: %v", c.name, dns.RcodeToString[c.expected], w.m)
+		}
+	}
+}
+
+func TestPlugin_errors(t *testing.T) {
+	for _, settings := range []map[string]interface{}{
+		nil,
+		{"zones": []interface{}{}},
+		{"zones": []interface{}{int64(1)}},
+		{"zones": []interface{}{"ads.example."}, "rcode": "SERVFAIL"},
+	} {
+		if _, err := Plugin(settings); err == nil {
+			t.Errorf("no error for settings %v", settings)
+		}
+	}
+}
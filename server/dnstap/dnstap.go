@@ -0,0 +1,205 @@
+// Package dnstap records the DNS queries and responses of the server as dnstap
+// messages (https://dnstap.info), written as Frame Streams to a file or a unix
+// socket.
+//
+// Client queries and responses are recorded by wrapping the DNS handler with
+// Tap.Handler, and the queries forwarded to the upstream nameservers and their
+// responses by setting the Tap as the server's ForwardTap.
+package dnstap
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// MessageType is the type of a dnstap message, as in dnstap.proto.
+type MessageType int
+
+const (
+	ClientQuery       MessageType = 5
+	ClientResponse    MessageType = 6
+	ForwarderQuery    MessageType = 7
+	ForwarderResponse MessageType = 8
+)
+
+// Protocol is the transport protocol of a DNS message, as in dnstap.proto.
+type Protocol int
+
+const (
+	UDP Protocol = 1
+	TCP Protocol = 2
+	DOT Protocol = 3 // DNS over TLS
+	DOH Protocol = 4 // DNS over HTTPS
+)
+
+// Socket families, as in dnstap.proto.
+const (
+	familyINET  = 1
+	familyINET6 = 2
+)
+
+// dnstapTypeMessage is the type of the Dnstap messages carrying a Message.
+const dnstapTypeMessage = 1
+
+// message is a dnstap Message, recording a DNS query or response.
+type message struct {
+	typ      MessageType
+	protocol Protocol
+
+	queryAddr, responseAddr net.IP
+	queryPort, responsePort int
+
+	queryTime, responseTime time.Time
+	query, response         []byte // wire format
+}
+
+// marshal encodes the message wrapped in a Dnstap message in the protobuf
+// wire format.
+func (m *message) marshal(identity, version []byte) []byte {
+	var b []byte
+	b = appendVarintField(b, 1, uint64(m.typ))
+	if ip := m.queryAddr; ip != nil {
+		b = appendVarintField(b, 2, family(ip))
+	} else if ip := m.responseAddr; ip != nil {
+		b = appendVarintField(b, 2, family(ip))
+	}
+	if m.protocol != 0 {
+		b = appendVarintField(b, 3, uint64(m.protocol))
+	}
+	if m.queryAddr != nil {
+		b = appendBytesField(b, 4, ipBytes(m.queryAddr))
+	}
+	if m.responseAddr != nil {
+		b = appendBytesField(b, 5, ipBytes(m.responseAddr))
+	}
+	if m.queryAddr != nil {
+		b = appendVarintField(b, 6, uint64(m.queryPort))
+	}
+	if m.responseAddr != nil {
+		b = appendVarintField(b, 7, uint64(m.responsePort))
+	}
+	if !m.queryTime.IsZero() {
+		b = appendVarintField(b, 8, uint64(m.queryTime.Unix()))
+		b = appendFixed32Field(b, 9, uint32(m.queryTime.Nanosecond()))
+	}
+	if m.query != nil {
+		b = appendBytesField(b, 10, m.query)
+	}
+	if !m.responseTime.IsZero() {
+		b = appendVarintField(b, 12, uint64(m.responseTime.Unix()))
+		b = appendFixed32Field(b, 13, uint32(m.responseTime.Nanosecond()))
+	}
+	if m.response != nil {
+		b = appendBytesField(b, 14, m.response)
+	}
+
+	var d []byte
+	if identity != nil {
+		d = appendBytesField(d, 1, identity)
+	}
+	if version != nil {
+		d = appendBytesField(d, 2, version)
+	}
+	d = appendBytesField(d, 14, b)
+	d = appendVarintField(d, 15, dnstapTypeMessage)
+	return d
+}
+
+// setQueryAddr sets the address the query is sent from.
+func (m *message) setQueryAddr(a net.Addr) {
+	m.queryAddr, m.queryPort = splitAddr(a)
+}
+
+// setResponseAddr sets the address the query is sent to.
+func (m *message) setResponseAddr(a net.Addr) {
+	m.responseAddr, m.responsePort = splitAddr(a)
+}
+
+// splitAddr gives the IP and the port of a UDP or TCP address, or nil if the
+// address is neither.
+func splitAddr(a net.Addr) (net.IP, int) {
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
+
+// parseAddr parses the IP and the port of an address in host:port form, or
+// gives nil if it cannot.
+func parseAddr(s string) (net.IP, int) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, 0
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, 0
+	}
+	return net.ParseIP(host), p
+}
+
+func family(ip net.IP) uint64 {
+	if ip.To4() != nil {
+		return familyINET
+	}
+	return familyINET6
+}
+
+func ipBytes(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
+
+// pack gives the wire format of the DNS message, or nil if it cannot be
+// packed.
+func pack(m *dns.Msg) []byte {
+	if m == nil {
+		return nil
+	}
+	b, err := m.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendTag(b []byte, field int, wire int) []byte {
+	return appendVarint(b, uint64(field)<<3|uint64(wire))
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	return appendVarint(appendTag(b, field, wireVarint), v)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendVarint(appendTag(b, field, wireBytes), uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendFixed32Field(b []byte, field int, v uint32) []byte {
+	b = appendTag(b, field, wireFixed32)
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
@@ -0,0 +1,332 @@
+package dnstap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ahmetalpbalkan/wagl/metrics"
+	"github.com/miekg/dns"
+)
+
+// frame is a Frame Streams frame read by the tests.
+type frame struct {
+	control bool
+	typ     uint32 // of control frames
+	b       []byte // data, or fields of control frames
+}
+
+func readFrame(r io.Reader) (frame, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return frame{}, err
+	}
+	control := n == 0
+	if control {
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return frame{}, err
+		}
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return frame{}, err
+	}
+	if control {
+		return frame{control: true, typ: binary.BigEndian.Uint32(b), b: b[4:]}, nil
+	}
+	return frame{b: b}, nil
+}
+
+func writeControl(w io.Writer, typ uint32) {
+	b := binary.BigEndian.AppendUint32(nil, 0)
+	b = binary.BigEndian.AppendUint32(b, 4)
+	b = binary.BigEndian.AppendUint32(b, typ)
+	w.Write(b)
+}
+
+// fields decodes a protobuf message into its fields: varint and fixed32 values
+// as uint64, bytes as []byte.
+func fields(t *testing.T, b []byte) map[int]interface{} {
+	out := make(map[int]interface{})
+	varint := func() uint64 {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("bad varint in %x", b)
+		}
+		b = b[n:]
+		return v
+	}
+	for len(b) > 0 {
+		tag := varint()
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case wireVarint:
+			out[field] = varint()
+		case wireFixed32:
+			out[field] = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		case wireBytes:
+			n := varint()
+			out[field] = b[:n]
+			b = b[n:]
+		default:
+			t.Fatalf("unexpected wire type in tag %x", tag)
+		}
+	}
+	return out
+}
+
+// decode decodes a Dnstap message, checks it and gives the fields of the
+// Message in it.
+func decode(t *testing.T, b []byte) map[int]interface{} {
+	d := fields(t, b)
+	if d[15] != uint64(dnstapTypeMessage) {
+		t.Fatalf("wrong dnstap type: %v", d[15])
+	}
+	if string(d[1].([]byte)) != "ns1" || string(d[2].([]byte)) != "wagl test" {
+		t.Fatalf("wrong identity or version: %q %q", d[1], d[2])
+	}
+	return fields(t, d[14].([]byte))
+}
+
+// testWriter is a dns.ResponseWriter for a client at 10.0.0.1:5353 over UDP.
+type testWriter struct {
+	dns.ResponseWriter
+	m *dns.Msg
+}
+
+func (w *testWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("10.0.0.53"), Port: 53}
+}
+
+func (w *testWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5353}
+}
+
+func (w *testWriter) WriteMsg(m *dns.Msg) error {
+	w.m = m
+	return nil
+}
+
+func TestTap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	out, err := OpenFile(path, slog.Default(), NewMetrics(metrics.NewRegistry()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tap := New(out)
+	tap.Identity, tap.Version = []byte("ns1"), []byte("wagl test")
+
+	req := new(dns.Msg)
+	req.SetQuestion("api.domain.", dns.TypeA)
+	h := tap.Handler(dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNameError)
+		w.WriteMsg(m)
+	}), 0)
+	h.ServeDNS(&testWriter{}, req)
+
+	fwd := new(dns.Msg)
+	fwd.SetQuestion("example.com.", dns.TypeMX)
+	resp := new(dns.Msg)
+	resp.SetReply(fwd)
+	qt := time.Unix(1500000000, 42)
+	tap.Forwarded("8.8.8.8:853", "tls", fwd, qt, resp, qt.Add(time.Millisecond))
+	tap.Forwarded("[2001:4860:4860::8888]:53", "udp", fwd, qt, nil, qt.Add(time.Second))
+
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(b)
+	f, err := readFrame(r)
+	if err != nil || !f.control || f.typ != controlStart || !bytes.Contains(f.b, []byte(contentType)) {
+		t.Fatalf("stream is not started: %+v %v", f, err)
+	}
+	var msgs []map[int]interface{}
+	for {
+		f, err := readFrame(r)
+		if err != nil {
+			t.Fatalf("stream is not stopped: %v", err)
+		}
+		if f.control {
+			if f.typ != controlStop {
+				t.Fatalf("unexpected control frame: %d", f.typ)
+			}
+			break
+		}
+		msgs = append(msgs, decode(t, f.b))
+	}
+	if len(msgs) != 5 { // no response for the unanswered query
+		t.Fatalf("wrong number of messages: %d", len(msgs))
+	}
+
+	// client query and response
+	for i, typ := range []MessageType{ClientQuery, ClientResponse} {
+		m := msgs[i]
+		if m[1] != uint64(typ) || m[2] != uint64(familyINET) || m[3] != uint64(UDP) ||
+			!net.IP(m[4].([]byte)).Equal(net.ParseIP("10.0.0.1")) || m[6] != uint64(5353) ||
+			!net.IP(m[5].([]byte)).Equal(net.ParseIP("10.0.0.53")) || m[7] != uint64(53) {
+			t.Fatalf("wrong message %d: %v", i, m)
+		}
+		q := new(dns.Msg)
+		if err := q.Unpack(m[10].([]byte)); err != nil || q.Question[0].Name != "api.domain." {
+			t.Fatalf("wrong query in message %d: %v", i, err)
+		}
+	}
+	if _, ok := msgs[0][14]; ok {
+		t.Fatal("response in client query message")
+	}
+	a := new(dns.Msg)
+	if err := a.Unpack(msgs[1][14].([]byte)); err != nil || a.Rcode != dns.RcodeNameError {
+		t.Fatalf("wrong client response: %v", err)
+	}
+
+	// forwarded query over TLS and its response
+	m := msgs[3]
+	if msgs[2][1] != uint64(ForwarderQuery) || m[1] != uint64(ForwarderResponse) ||
+		m[3] != uint64(DOT) || !net.IP(m[5].([]byte)).Equal(net.ParseIP("8.8.8.8")) || m[7] != uint64(853) ||
+		m[8] != uint64(1500000000) || m[9] != uint64(42) || m[13] != uint64(1000042) {
+		t.Fatalf("wrong forwarder messages: %v %v", msgs[2], m)
+	}
+	if _, ok := m[4]; ok {
+		t.Fatal("query address in forwarder message")
+	}
+
+	// unanswered forwarded query
+	m = msgs[4]
+	if m[1] != uint64(ForwarderQuery) || m[2] != uint64(familyINET6) || m[3] != uint64(UDP) ||
+		len(m[5].([]byte)) != net.IPv6len {
+		t.Fatalf("wrong unanswered forwarder message: %v", m)
+	}
+}
+
+func TestHandler_nil(t *testing.T) {
+	var tap *Tap
+	h := dns.HandlerFunc(func(dns.ResponseWriter, *dns.Msg) {})
+	if tap.Handler(h, UDP) == nil {
+		t.Fatal("nil handler")
+	}
+}
+
+// testReader listens on a unix socket in a temporary directory, does the
+// bidirectional handshake with the first client and sends the frames it reads
+// until the connection is closed. It returns the path of the socket.
+func testReader(t *testing.T) (string, <-chan frame) {
+	path := filepath.Join(t.TempDir(), "dnstap.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	frames := make(chan frame, 10)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			f, err := readFrame(c)
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- f
+			switch f.typ {
+			case controlReady:
+				writeControl(c, controlAccept)
+			case controlStop:
+				writeControl(c, controlFinish)
+			}
+		}
+	}()
+	return path, frames
+}
+
+// checkFrames checks that the reader gets the control frames of the expected
+// types, and data frames where 0 is expected.
+func checkFrames(t *testing.T, frames <-chan frame, expected []uint32) {
+	var got []uint32
+	for f := range frames {
+		if f.control {
+			got = append(got, f.typ)
+		} else {
+			got = append(got, 0)
+		}
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("wrong frames. expected: %v got: %v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("wrong frames. expected: %v got: %v", expected, got)
+		}
+	}
+}
+
+func TestDialUnix(t *testing.T) {
+	path, frames := testReader(t)
+	out := DialUnix(path, slog.Default(), NewMetrics(metrics.NewRegistry()))
+	tap := New(out)
+	tap.Forwarded("8.8.8.8:53", "udp", new(dns.Msg), time.Now(), nil, time.Now())
+	if err := out.Close(); err != nil {
+		t.Fatalf("stream is not finished: %v", err)
+	}
+	checkFrames(t, frames, []uint32{controlReady, controlStart, 0, controlStop})
+}
+
+func TestDialUnix_afterHandshakeTimeout(t *testing.T) {
+	defer func(d time.Duration) { handshakeTimeout = d }(handshakeTimeout)
+	handshakeTimeout = 50 * time.Millisecond
+
+	path, frames := testReader(t)
+	out := DialUnix(path, slog.Default(), NewMetrics(metrics.NewRegistry()))
+	tap := New(out)
+	time.Sleep(3 * handshakeTimeout)
+	tap.Forwarded("8.8.8.8:53", "udp", new(dns.Msg), time.Now(), nil, time.Now())
+	time.Sleep(flushInterval + 3*handshakeTimeout) // flushed on its own
+	if err := out.Close(); err != nil {
+		t.Fatalf("stream is not finished: %v", err)
+	}
+	if out.metrics.dropped.Value() != 0 {
+		t.Fatal("message is dropped")
+	}
+	checkFrames(t, frames, []uint32{controlReady, controlStart, 0, controlStop})
+}
+func TestDialUnix_noReader(t *testing.T) {
+	out := DialUnix(filepath.Join(t.TempDir(), "none.sock"), slog.Default(), NewMetrics(metrics.NewRegistry()))
+	tap := New(out)
+	tap.Forwarded("8.8.8.8:53", "udp", new(dns.Msg), time.Now(), nil, time.Now())
+
+	done := make(chan struct{})
+	go func() {
+		out.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("close blocks without a reader")
+	}
+	if out.metrics.dropped.Value() != 1 {
+		t.Fatal("message is not dropped")
+	}
+
+	// messages are dropped after the output is closed
+	tap.Forwarded("8.8.8.8:53", "udp", new(dns.Msg), time.Now(), nil, time.Now())
+	if out.metrics.dropped.Value() != 2 {
+		t.Fatal("message is not dropped after close")
+	}
+}
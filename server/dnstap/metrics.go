@@ -0,0 +1,17 @@
+package dnstap
+
+import "github.com/ahmetalpbalkan/wagl/metrics"
+
+// Metrics are the metrics of the messages of an Output.
+type Metrics struct {
+	written *metrics.Counter
+	dropped *metrics.Counter
+}
+
+// NewMetrics creates the metrics of the messages in the registry r.
+func NewMetrics(r *metrics.Registry) *Metrics {
+	return &Metrics{
+		written: r.NewCounter("wagl_dnstap_messages_total", "dnstap messages written."),
+		dropped: r.NewCounter("wagl_dnstap_dropped_total", "dnstap messages dropped as they could not be written in time, or at all."),
+	}
+}
@@ -0,0 +1,307 @@
+package dnstap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// contentType is the Frame Streams content type of dnstap.
+	contentType = "protobuf:dnstap.Dnstap"
+
+	// queueSize is the number of messages waiting to be written, after
+	// which messages are dropped rather than slowing down the queries.
+	queueSize = 1024
+
+	// flushInterval is how often buffered messages are written out.
+	flushInterval = time.Second
+
+	// redialInterval is how long to wait before connecting to the socket
+	// again after failing to. Messages are dropped meanwhile.
+	redialInterval = time.Second * 5
+)
+
+// handshakeTimeout is the time allotted for the reader of the socket to accept
+// or finish the stream. It is a variable for the tests.
+var handshakeTimeout = time.Second * 5
+
+// Frame Streams control frame types and fields.
+const (
+	controlAccept = 1
+	controlStart  = 2
+	controlStop   = 3
+	controlReady  = 4
+	controlFinish = 5
+
+	controlFieldContentType = 1
+)
+
+// Output writes the dnstap messages in the background as Frame Streams. If the
+// messages cannot be written as fast as they are recorded, or the reader of
+// the socket is not available, they are dropped.
+type Output struct {
+	logger        *slog.Logger // logs the errors writing the messages
+	metrics       *Metrics
+	open          func() (io.ReadWriteCloser, error)
+	bidirectional bool // the reader accepts and finishes the stream
+
+	m      sync.RWMutex
+	closed bool
+	queue  chan []byte
+	done   chan struct{}
+	err    error // of ending the stream, set once done
+}
+
+// OpenFile creates the file at path, truncating it if it exists, and gives the
+// Output writing the messages to it. Errors writing are logged to logger and
+// the messages are counted in m.
+func OpenFile(path string, logger *slog.Logger, m *Metrics) (*Output, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	opened := false
+	return newOutput(func() (io.ReadWriteCloser, error) {
+		if opened {
+			return nil, errors.New("file is closed")
+		}
+		opened = true
+		return f, nil
+	}, false, logger, m), nil
+}
+
+// DialUnix gives the Output writing the messages to the reader listening on
+// the unix socket at path, such as a dnstap collector. It connects to the
+// socket in the background and reconnects if the connection is lost. Errors
+// connecting and writing are logged to logger and the messages are counted in
+// m.
+func DialUnix(path string, logger *slog.Logger, m *Metrics) *Output {
+	return newOutput(func() (io.ReadWriteCloser, error) {
+		return net.DialTimeout("unix", path, handshakeTimeout)
+	}, true, logger, m)
+}
+
+func newOutput(open func() (io.ReadWriteCloser, error), bidirectional bool, logger *slog.Logger, m *Metrics) *Output {
+	o := &Output{
+		logger:        logger,
+		metrics:       m,
+		open:          open,
+		bidirectional: bidirectional,
+		queue:         make(chan []byte, queueSize),
+		done:          make(chan struct{}),
+	}
+	go o.run()
+	return o
+}
+
+// write queues the encoded message to be written, or drops it if the queue is
+// full or the Output is closed.
+func (o *Output) write(b []byte) {
+	o.m.RLock()
+	defer o.m.RUnlock()
+	if o.closed {
+		o.metrics.dropped.Inc()
+		return
+	}
+	select {
+	case o.queue <- b:
+	default:
+		o.metrics.dropped.Inc()
+	}
+}
+
+// Close writes the queued messages, ends the stream and closes the file or
+// the socket. Messages written after it is called are dropped.
+func (o *Output) Close() error {
+	o.m.Lock()
+	o.closed = true
+	close(o.queue)
+	o.m.Unlock()
+	<-o.done
+	return o.err
+}
+
+func (o *Output) run() {
+	defer close(o.done)
+	flush := time.NewTicker(flushInterval)
+	defer flush.Stop()
+
+	// Start the stream right away, so that the files are valid streams and
+	// the readers know about the server even if there are no messages.
+	lastOpen := time.Now()
+	s, err := o.start()
+	if err != nil {
+		o.logger.Error("Error starting dnstap stream", "error", err)
+	}
+	for {
+		select {
+		case b, ok := <-o.queue:
+			if !ok {
+				if s != nil {
+					o.err = s.stop()
+				}
+				return
+			}
+			if s == nil && time.Since(lastOpen) >= redialInterval {
+				lastOpen = time.Now()
+				if s, err = o.start(); err != nil {
+					o.logger.Error("Error starting dnstap stream", "error", err)
+				}
+			}
+			if s == nil {
+				o.metrics.dropped.Inc()
+				continue
+			}
+			if err := s.writeFrame(b); err != nil {
+				o.logger.Error("Error writing dnstap message", "error", err)
+				s.close()
+				s = nil
+				o.metrics.dropped.Inc()
+				continue
+			}
+			o.metrics.written.Inc()
+		case <-flush.C:
+			if s == nil {
+				continue
+			}
+			if err := s.w.Flush(); err != nil {
+				o.logger.Error("Error writing dnstap message", "error", err)
+				s.close()
+				s = nil
+			}
+		}
+	}
+}
+
+// start opens the file or the socket and starts the stream.
+func (o *Output) start() (*stream, error) {
+	c, err := o.open()
+	if err != nil {
+		return nil, err
+	}
+	s := &stream{c: c, w: bufio.NewWriter(c), bidirectional: o.bidirectional}
+	if err := s.start(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// stream is a Frame Streams stream of dnstap messages. Bidirectional streams
+// are accepted and finished by the reader.
+type stream struct {
+	c             io.ReadWriteCloser
+	w             *bufio.Writer
+	bidirectional bool
+}
+
+func (s *stream) start() error {
+	if s.bidirectional {
+		s.deadline()
+		if err := s.writeControl(controlReady, true); err != nil {
+			return err
+		}
+		if err := s.w.Flush(); err != nil {
+			return err
+		}
+		if err := s.readControl(controlAccept); err != nil {
+			return err
+		}
+	}
+	if err := s.writeControl(controlStart, true); err != nil {
+		return err
+	}
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	// The messages are written whenever they are recorded.
+	s.clearDeadline()
+	return nil
+}
+
+// stop ends the stream and closes it.
+func (s *stream) stop() error {
+	defer s.close()
+	s.deadline()
+	if err := s.writeControl(controlStop, false); err != nil {
+		return err
+	}
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if s.bidirectional {
+		return s.readControl(controlFinish)
+	}
+	return nil
+}
+
+func (s *stream) close() error { return s.c.Close() }
+
+// deadline bounds the time the reader has to respond to the control frames,
+// if the stream is a connection.
+func (s *stream) deadline() {
+	if c, ok := s.c.(net.Conn); ok {
+		c.SetDeadline(time.Now().Add(handshakeTimeout))
+	}
+}
+
+func (s *stream) clearDeadline() {
+	if c, ok := s.c.(net.Conn); ok {
+		c.SetDeadline(time.Time{})
+	}
+}
+
+func (s *stream) writeFrame(b []byte) error {
+	if err := binary.Write(s.w, binary.BigEndian, uint32(len(b))); err != nil {
+		return err
+	}
+	_, err := s.w.Write(b)
+	return err
+}
+
+// writeControl writes a control frame of the type, with the dnstap content
+// type if specified.
+func (s *stream) writeControl(typ uint32, withContentType bool) error {
+	b := binary.BigEndian.AppendUint32(nil, typ)
+	if withContentType {
+		b = binary.BigEndian.AppendUint32(b, controlFieldContentType)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(contentType)))
+		b = append(b, contentType...)
+	}
+	// Control frames are escaped with a zero length.
+	if err := binary.Write(s.w, binary.BigEndian, uint32(0)); err != nil {
+		return err
+	}
+	return s.writeFrame(b)
+}
+
+// readControl reads a control frame, which must be of the expected type.
+func (s *stream) readControl(expected uint32) error {
+	var h [8]byte
+	if _, err := io.ReadFull(s.c, h[:]); err != nil {
+		return fmt.Errorf("error reading control frame: %v", err)
+	}
+	if escape := binary.BigEndian.Uint32(h[:4]); escape != 0 {
+		return errors.New("expected control frame, got data frame")
+	}
+	n := binary.BigEndian.Uint32(h[4:])
+	if n < 4 || n > 512 {
+		return fmt.Errorf("bad control frame length: %d", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(s.c, b); err != nil {
+		return fmt.Errorf("error reading control frame: %v", err)
+	}
+	if typ := binary.BigEndian.Uint32(b); typ != expected {
+		return fmt.Errorf("unexpected control frame type: %d", typ)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package dnstap
+
+import (
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Tap records the queries and the responses to the Output.
+type Tap struct {
+	// Identity and Version identify the server in the messages, such as
+	// its hostname and the name and version of the software. They are
+	// omitted if nil.
+	Identity, Version []byte
+
+	out *Output
+}
+
+// New creates a Tap writing the messages to out.
+func New(out *Output) *Tap {
+	return &Tap{out: out}
+}
+
+func (t *Tap) send(m *message) {
+	t.out.write(m.marshal(t.Identity, t.Version))
+}
+
+// Handler wraps the DNS handler h to record the queries it receives from
+// clients and its responses over the protocol, which is told by the client's
+// address (UDP or TCP) if zero. It gives h if t is nil, so that handlers can be
+// wrapped whether or not dnstap is enabled.
+func (t *Tap) Handler(h dns.Handler, proto Protocol) dns.Handler {
+	if t == nil {
+		return h
+	}
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := &message{typ: ClientQuery, protocol: proto, queryTime: time.Now(), query: pack(r)}
+		if m.protocol == 0 {
+			m.protocol = UDP
+			if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+				m.protocol = TCP
+			}
+		}
+		m.setQueryAddr(w.RemoteAddr())
+		m.setResponseAddr(w.LocalAddr())
+		t.send(m)
+
+		h.ServeDNS(&tapWriter{ResponseWriter: w, t: t, query: *m}, r)
+	})
+}
+
+// tapWriter is a dns.ResponseWriter recording the responses written.
+type tapWriter struct {
+	dns.ResponseWriter
+	t     *Tap
+	query message
+}
+
+func (w *tapWriter) record(b []byte) {
+	m := w.query
+	m.typ = ClientResponse
+	m.responseTime = time.Now()
+	m.response = b
+	w.t.send(&m)
+}
+
+func (w *tapWriter) WriteMsg(m *dns.Msg) error {
+	w.record(pack(m))
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+func (w *tapWriter) Write(b []byte) (int, error) {
+	w.record(append([]byte(nil), b...))
+	return w.ResponseWriter.Write(b)
+}
+
+// Forwarded records the query forwarded to the upstream nameserver at addr in
+// host:port form over network ("udp", "tcp" or "tls"), and its response unless
+// resp is nil. It implements server.ForwardTap.
+func (t *Tap) Forwarded(addr, network string, query *dns.Msg, queryTime time.Time, resp *dns.Msg, respTime time.Time) {
+	m := &message{typ: ForwarderQuery, queryTime: queryTime, query: pack(query)}
+	switch network {
+	case "udp":
+		m.protocol = UDP
+	case "tcp":
+		m.protocol = TCP
+	case "tls":
+		m.protocol = DOT
+	}
+	m.responseAddr, m.responsePort = parseAddr(addr)
+	t.send(m)
+
+	if resp != nil {
+		r := *m
+		r.typ = ForwarderResponse
+		r.responseTime = respTime
+		r.response = pack(resp)
+		t.send(&r)
+	}
+}
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DoHPath is the URL path DNS-over-HTTPS queries are served at.
+	DoHPath = "/dns-query"
+
+	dnsMessageType = "application/dns-message"
+	dnsJSONType    = "application/dns-json"
+
+	// Limits of the DoH server, so that slow or idle clients cannot hold on
+	// to its connections.
+	dohReadHeaderTimeout = time.Second * 5
+	dohReadTimeout       = time.Second * 10
+	dohWriteTimeout      = time.Second * 10
+	dohIdleTimeout       = time.Second * 60
+	dohMaxHeaderBytes    = 8 << 10
+)
+
+// NewDoHHandler creates an HTTP handler that serves DNS queries over HTTPS
+// (RFC 8484) by handing them to h. Queries can be made in wire format with GET
+// (?dns=) and POST requests, or with the JSON API (?name=&type=) in which case
+// the response is also in JSON.
+func NewDoHHandler(h dns.Handler) http.Handler {
+	return &dohHandler{h}
+}
+
+// NewDoH creates an HTTPS server listening on the specified host:port that
+// serves DNS queries at DoHPath using h.
+func NewDoH(addr string, config *tls.Config, h dns.Handler) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(DoHPath, NewDoHHandler(h))
+	return &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		TLSConfig:         config,
+		ReadHeaderTimeout: dohReadHeaderTimeout,
+		ReadTimeout:       dohReadTimeout,
+		WriteTimeout:      dohWriteTimeout,
+		IdleTimeout:       dohIdleTimeout,
+		MaxHeaderBytes:    dohMaxHeaderBytes,
+	}
+}
+
+type dohHandler struct {
+	h dns.Handler
+}
+
+func (d *dohHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		req    *dns.Msg
+		err    error
+		asJSON bool
+	)
+	switch {
+	case r.Method == "GET" && r.URL.Query().Get("dns") != "":
+		req, err = dohGetMsg(r)
+	case r.Method == "GET" && r.URL.Query().Get("name") != "":
+		req, err = dohJSONMsg(r)
+		asJSON = true
+	case r.Method == "POST":
+		if ct := r.Header.Get("Content-Type"); ct != dnsMessageType {
+			http.Error(w, fmt.Sprintf("unsupported content type %q", ct), http.StatusUnsupportedMediaType)
+			return
+		}
+		req, err = dohPostMsg(r)
+	default:
+		http.Error(w, "expected GET with dns or name parameter, or POST", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rw := &httpWriter{req: r}
+	d.h.ServeDNS(rw, req)
+	if rw.msg == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(rw.msg)))
+	if asJSON {
+		w.Header().Set("Content-Type", dnsJSONType)
+		writeJSONMsg(w, rw.msg)
+		return
+	}
+	b, err := rw.msg.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dnsMessageType)
+	w.Write(b)
+}
+
+// dohGetMsg parses the base64url-encoded wire format query in dns parameter.
+func dohGetMsg(r *http.Request) (*dns.Msg, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(r.URL.Query().Get("dns"), "="))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode dns parameter: %v", err)
+	}
+	return unpackQuery(b)
+}
+
+// dohPostMsg parses the wire format query in the request body.
+func dohPostMsg(r *http.Request) (*dns.Msg, error) {
+	b, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read request body: %v", err)
+	}
+	return unpackQuery(b)
+}
+
+// dohJSONMsg constructs a query from the name and type (default: A) parameters
+// of the JSON API.
+func dohJSONMsg(r *http.Request) (*dns.Msg, error) {
+	q := r.URL.Query()
+	qType := dns.TypeA
+	if t := q.Get("type"); t != "" {
+		if n, err := strconv.ParseUint(t, 10, 16); err == nil {
+			qType = uint16(n)
+		} else if n, ok := dns.StringToType[strings.ToUpper(t)]; ok {
+			qType = n
+		} else {
+			return nil, fmt.Errorf("unknown type %q", t)
+		}
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(q.Get("name")), qType)
+	m.CheckingDisabled = q.Get("cd") == "1" || q.Get("cd") == "true"
+	return m, nil
+}
+
+func unpackQuery(b []byte) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return nil, fmt.Errorf("cannot parse DNS message: %v", err)
+	}
+	if len(m.Question) == 0 {
+		return nil, fmt.Errorf("DNS message has no questions")
+	}
+	return m, nil
+}
+
+// minTTL returns the smallest TTL of the records in m for HTTP caching.
+func minTTL(m *dns.Msg) uint32 {
+	var (
+		ttl   uint32
+		found bool
+	)
+	for _, l := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range l {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if t := rr.Header().Ttl; !found || t < ttl {
+				ttl, found = t, true
+			}
+		}
+	}
+	return ttl
+}
+
+// jsonMsg is the DNS message representation in the JSON API.
+type jsonMsg struct {
+	Status     int
+	TC         bool
+	RD         bool
+	RA         bool
+	AD         bool
+	CD         bool
+	Question   []jsonQuestion
+	Answer     []jsonRR `json:",omitempty"`
+	Authority  []jsonRR `json:",omitempty"`
+	Additional []jsonRR `json:",omitempty"`
+}
+
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type jsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+func writeJSONMsg(w http.ResponseWriter, m *dns.Msg) {
+	out := jsonMsg{
+		Status:     m.Rcode,
+		TC:         m.Truncated,
+		RD:         m.RecursionDesired,
+		RA:         m.RecursionAvailable,
+		AD:         m.AuthenticatedData,
+		CD:         m.CheckingDisabled,
+		Answer:     toJSONRRs(m.Answer),
+		Authority:  toJSONRRs(m.Ns),
+		Additional: toJSONRRs(m.Extra),
+	}
+	for _, q := range m.Question {
+		out.Question = append(out.Question, jsonQuestion{q.Name, q.Qtype})
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+func toJSONRRs(l []dns.RR) []jsonRR {
+	var out []jsonRR
+	for _, rr := range l {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		out = append(out, jsonRR{
+			Name: h.Name,
+			Type: h.Rrtype,
+			TTL:  h.Ttl,
+			Data: strings.TrimPrefix(rr.String(), h.String()),
+		})
+	}
+	return out
+}
+
+// httpWriter is a dns.ResponseWriter capturing the response to an HTTP
+// request.
+type httpWriter struct {
+	req *http.Request
+	msg *dns.Msg
+}
+
+func (w *httpWriter) LocalAddr() net.Addr {
+	if a, ok := w.req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return a
+	}
+	return nil
+}
+
+func (w *httpWriter) RemoteAddr() net.Addr {
+	a, err := net.ResolveTCPAddr("tcp", w.req.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return a
+}
+
+func (w *httpWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *httpWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+func (w *httpWriter) Close() error        { return nil }
+func (w *httpWriter) TsigStatus() error   { return nil }
+func (w *httpWriter) TsigTimersOnly(bool) {}
+func (w *httpWriter) Hijack()             {}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ahmetalpbalkan/wagl/rrstore"
+	"github.com/ahmetalpbalkan/wagl/tlsconfig"
+	"github.com/miekg/dns"
+)
+
+func TestDoH_wireFormat(t *testing.T) {
+	srv := httptest.NewServer(testDoHHandler())
+	defer srv.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("api.domain.", dns.TypeA)
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// GET
+	resp, err := http.Get(srv.URL + DoHPath + "?dns=" + base64.RawURLEncoding.EncodeToString(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := dohResponse(t, resp); len(r.Answer) != 2 || r.Id != m.Id {
+		t.Fatalf("unexpected response: %v", r)
+	}
+
+	// POST
+	resp, err = http.Post(srv.URL+DoHPath, dnsMessageType, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := dohResponse(t, resp); len(r.Answer) != 2 || r.Id != m.Id {
+		t.Fatalf("unexpected response: %v", r)
+	}
+}
+
+func TestDoH_json(t *testing.T) {
+	srv := httptest.NewServer(testDoHHandler())
+	defer srv.Close()
+
+	cases := []struct {
+		name, qType     string
+		expectedStatus  int
+		expectedAnswers int
+	}{
+		{"api.domain", "", dns.RcodeSuccess, 2},
+		{"api.domain.", "A", dns.RcodeSuccess, 2},
+		{"_web._tcp.domain", "srv", dns.RcodeSuccess, 1},
+		{"_web._tcp.domain", "33", dns.RcodeSuccess, 1},
+		{"nonexistent.domain", "A", dns.RcodeNameError, 0},
+	}
+	for _, c := range cases {
+		q := url.Values{"name": {c.name}, "type": {c.qType}}
+		resp, err := http.Get(srv.URL + DoHPath + "?" + q.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != dnsJSONType {
+			t.Fatalf("wrong content type: %s", ct)
+		}
+		var out jsonMsg
+		err = json.NewDecoder(resp.Body).Decode(&out)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Status != c.expectedStatus || len(out.Answer) != c.expectedAnswers {
+			t.Fatalf("unexpected response for %s %s: %#v", c.qType, c.name, out)
+		}
+	}
+}
+
+func TestDoH_badRequests(t *testing.T) {
+	srv := httptest.NewServer(testDoHHandler())
+	defer srv.Close()
+
+	cases := []struct {
+		method, query, contentType string
+		body                       []byte
+		expectedCode               int
+	}{
+		{"GET", "", "", nil, http.StatusBadRequest},
+		{"GET", "?dns=not-base64!", "", nil, http.StatusBadRequest},
+		{"GET", "?dns=AAAA", "", nil, http.StatusBadRequest},
+		{"GET", "?name=api.domain&type=FOO", "", nil, http.StatusBadRequest},
+		{"POST", "", "text/plain", []byte("hello"), http.StatusUnsupportedMediaType},
+		{"POST", "", dnsMessageType, []byte("hello"), http.StatusBadRequest},
+		{"PUT", "", dnsMessageType, nil, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, srv.URL+DoHPath+c.query, bytes.NewReader(c.body))
+		req.Header.Set("Content-Type", c.contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.expectedCode {
+			t.Fatalf("wrong status for %s %s: expected=%d got=%d", c.method, c.query, c.expectedCode, resp.StatusCode)
+		}
+	}
+}
+
+func TestDoH_tls(t *testing.T) {
+	dir := testCerts(t)
+	defer os.RemoveAll(dir)
+
+	cfg, err := tlsconfig.Server(tlsconfig.Options{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(NewDoH("", cfg, testDNSHandler()).Handler)
+	srv.TLS = cfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	cl := &http.Client{Transport: &http.Transport{TLSClientConfig: testTLSClient(t, dir, false)}}
+	u, _ := url.Parse(srv.URL)
+	resp, err := cl.Get("https://localhost:" + u.Port() + DoHPath + "?name=api.domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %s", resp.Status)
+	}
+}
+
+func TestNewDoH_limits(t *testing.T) {
+	srv := NewDoH(":443", nil, testDNSHandler())
+	if srv.ReadHeaderTimeout == 0 || srv.ReadTimeout == 0 || srv.WriteTimeout == 0 || srv.IdleTimeout == 0 || srv.MaxHeaderBytes == 0 {
+		t.Fatalf("server is not limited against slow clients: %+v", srv)
+	}
+}
+
+func dohResponse(t *testing.T, resp *http.Response) *dns.Msg {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != dnsMessageType {
+		t.Fatalf("wrong content type: %s", ct)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// testDoHHandler gives a DoH handler serving internal records.
+func testDoHHandler() http.Handler {
+	return NewDoHHandler(testDNSHandler())
+}
+
+// testDNSHandler gives a DNS handler serving internal records.
+func testDNSHandler() dns.Handler {
+	rr := rrstore.New()
+	rr.Set(1, rrstore.RRs{
+		dns.TypeA: {
+			"api.domain.": records("10.0.0.1", "10.0.0.2"),
+		},
+		dns.TypeSRV: {
+			"_web._tcp.domain.": records("10.0.0.1:80"),
+		},
+	})
+	return New("domain", ":8053", rr, false, nil).Handler
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Drainer lets the queries being answered by the handlers it wraps finish
+// before the server shuts down. Once draining, new queries are answered
+// REFUSED so that the resolvers try other nameservers right away.
+type Drainer struct {
+	m        sync.RWMutex
+	draining bool
+	inFlight sync.WaitGroup
+}
+
+// Handler wraps the DNS handler h to track the queries it answers.
+func (d *Drainer) Handler(h dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		d.m.RLock()
+		if d.draining {
+			d.m.RUnlock()
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeRefused)
+			w.WriteMsg(m)
+			return
+		}
+		d.inFlight.Add(1)
+		d.m.RUnlock()
+		defer d.inFlight.Done()
+		h.ServeDNS(w, r)
+	})
+}
+
+// Drain stops answering new queries and waits until the queries being
+// answered are answered, or ctx is done, in which case it returns ctx.Err().
+func (d *Drainer) Drain(ctx context.Context) error {
+	d.m.Lock()
+	d.draining = true
+	d.m.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDrainer(t *testing.T) {
+	d := new(Drainer)
+	started, release := make(chan struct{}), make(chan struct{})
+	h := d.Handler(dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		started <- struct{}{}
+		<-release
+		m := new(dns.Msg)
+		m.SetReply(r)
+		w.WriteMsg(m)
+	}))
+	q := new(dns.Msg)
+	q.SetQuestion("api.domain.", dns.TypeA)
+
+	// query in flight
+	inFlight := &answerWriter{}
+	answered := make(chan struct{})
+	go func() {
+		h.ServeDNS(inFlight, q)
+		close(answered)
+	}()
+	<-started
+
+	// times out while the query is being answered
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if err := d.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("drain is not timed out: %v", err)
+	}
+
+	// new queries are refused while draining
+	w := &answerWriter{}
+	h.ServeDNS(w, q)
+	if w.m == nil || w.m.Rcode != dns.RcodeRefused {
+		t.Fatalf("query is not refused while draining: %v", w.m)
+	}
+
+	drained := make(chan error)
+	go func() { drained <- d.Drain(context.Background()) }()
+	select {
+	case <-drained:
+		t.Fatal("drained before the query in flight is answered")
+	case <-time.After(time.Millisecond * 10):
+	}
+	close(release)
+	<-answered
+	if err := <-drained; err != nil {
+		t.Fatal(err)
+	}
+	if inFlight.m == nil || inFlight.m.Rcode != dns.RcodeSuccess {
+		t.Fatalf("query in flight is not answered: %v", inFlight.m)
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/ahmetalpbalkan/wagl/metrics"
+	"github.com/miekg/dns"
+)
+
+// Metrics are the metrics of the queries answered and forwarded.
+type Metrics struct {
+	queries          *metrics.CounterVec
+	queryDuration    *metrics.HistogramVec
+	upstreamDuration *metrics.HistogramVec
+	upstreamErrors   *metrics.CounterVec
+	answerCache      *metrics.CounterVec
+}
+
+// NewMetrics creates the metrics of the queries in the registry r.
+func NewMetrics(r *metrics.Registry) *Metrics {
+	return &Metrics{
+		queries: r.NewCounterVec("wagl_dns_queries_total", "DNS queries, by query type, response code and scope (internal for the names in the domain, external otherwise).",
+			"qtype", "rcode", "scope"),
+		queryDuration: r.NewHistogramVec("wagl_dns_query_duration_seconds", "Time taken to answer DNS queries, by scope.",
+			metrics.DefaultBuckets, "scope"),
+		upstreamDuration: r.NewHistogramVec("wagl_dns_upstream_duration_seconds", "Time taken by the external nameservers to answer the forwarded queries, by nameserver.",
+			metrics.DefaultBuckets, "upstream"),
+		upstreamErrors: r.NewCounterVec("wagl_dns_upstream_errors_total", "Forwarded queries the external nameservers failed to answer, by nameserver.",
+			"upstream"),
+		answerCache: r.NewCounterVec("wagl_dns_answer_cache_total", "Lookups of the prepacked answers for the names in the domain, by result (hit or miss).",
+			"result"),
+	}
+}
+
+// rcodeDropped is the rcode label of the queries not answered, such as the
+// ones dropped by rate limiting.
+const rcodeDropped = "DROPPED"
+
+// Instrument wraps the DNS handler h to count the queries by their response
+// codes and measure the time taken to answer them. Queries for the names in
+// the domain are counted as internal, the others as external.
+func (m *Metrics) Instrument(domain string, h dns.Handler) dns.Handler {
+	domain = strings.ToLower(dns.Fqdn(domain))
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		start := time.Now()
+		mw := &metricsWriter{ResponseWriter: w, rcode: rcodeDropped}
+		h.ServeDNS(mw, r)
+
+		qtype, scope := "", "external"
+		if len(r.Question) > 0 {
+			q := r.Question[0]
+			qtype = typeLabel(q.Qtype)
+			if dns.IsSubDomain(domain, strings.ToLower(q.Name)) {
+				scope = "internal"
+			}
+		}
+		m.queries.With(qtype, mw.rcode, scope).Inc()
+		m.queryDuration.With(scope).Observe(time.Since(start).Seconds())
+	})
+}
+
+// typeLabel gives the label of the query type, grouping the types without a
+// name so that clients cannot create arbitrarily many labels.
+func typeLabel(t uint16) string {
+	if s, ok := dns.TypeToString[t]; ok {
+		return s
+	}
+	return "OTHER"
+}
+
+// metricsWriter is a dns.ResponseWriter keeping the response code of the
+// response written.
+type metricsWriter struct {
+	dns.ResponseWriter
+	rcode string
+}
+
+func (w *metricsWriter) WriteMsg(m *dns.Msg) error {
+	w.rcode = dns.RcodeToString[m.Rcode]
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+func (w *metricsWriter) Write(b []byte) (int, error) {
+	if len(b) >= 4 {
+		w.rcode = dns.RcodeToString[int(b[3]&0xf)]
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ahmetalpbalkan/wagl/metrics"
+	"github.com/miekg/dns"
+)
+
+func TestInstrument(t *testing.T) {
+	m := NewMetrics(metrics.NewRegistry())
+	h := m.Instrument("domain", dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		switch strings.ToLower(r.Question[0].Name) {
+		case "api.domain.":
+			m.SetRcode(r, dns.RcodeNameError)
+			w.WriteMsg(m)
+		case "packed.domain.":
+			m.SetReply(r)
+			b, _ := m.Pack()
+			w.Write(b)
+		case "example.com.":
+			m.SetRcode(r, dns.RcodeServerFailure)
+			w.WriteMsg(m)
+		} // others are dropped
+	}))
+
+	cases := []struct {
+		name  string
+		qType uint16
+		rcode string
+		scope string
+	}{
+		{"API.Domain.", dns.TypeA, "NXDOMAIN", "internal"},
+		{"packed.domain.", dns.TypeSRV, "NOERROR", "internal"},
+		{"example.com.", dns.TypeAAAA, "SERVFAIL", "external"},
+		{"dropped.domain.", dns.TypeA, rcodeDropped, "internal"},
+		{"unknown.domain.", 65280, rcodeDropped, "internal"},
+	}
+	for _, c := range cases {
+		counter := m.queries.With(typeLabel(c.qType), c.rcode, c.scope)
+		r := new(dns.Msg)
+		r.SetQuestion(c.name, c.qType)
+		h.ServeDNS(&answerWriter{network: "udp"}, r)
+		if v := counter.Value(); v != 1 {
+			t.Fatalf("query for %s is not counted as %s %s %s", c.name, typeLabel(c.qType), c.rcode, c.scope)
+		}
+	}
+	if typeLabel(65280) != "OTHER" {
+		t.Fatal("unknown types are not grouped")
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Middleware wraps a DNS handler to add a concern to the handling of the
+// queries, such as logging or blocking some names, as http.Handler wrappers
+// do. It can answer the query itself or pass it to next, possibly with a
+// wrapped dns.ResponseWriter to act on the response.
+type Middleware func(next dns.Handler) dns.Handler
+
+// Chain wraps the handler h with the middlewares, so that the queries pass
+// through them in order before reaching h.
+func Chain(h dns.Handler, m ...Middleware) dns.Handler {
+	for i := len(m) - 1; i >= 0; i-- {
+		h = m[i](h)
+	}
+	return h
+}
+
+// Plugin creates a middleware with its settings in the configuration file,
+// which are of the types the file is parsed to: string, int64, float64, bool,
+// []interface{} or map[string]interface{}. Settings are nil if there are none.
+type Plugin func(settings map[string]interface{}) (Middleware, error)
+
+var (
+	pluginsMu sync.Mutex
+	plugins   = make(map[string]Plugin)
+)
+
+// RegisterPlugin makes the plugin available by name to be used in the
+// configuration. Plugins are registered once at startup, it panics if the name
+// is already registered.
+func RegisterPlugin(name string, p Plugin) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	if _, ok := plugins[name]; ok {
+		panic(fmt.Sprintf("server: duplicate plugin %s", name))
+	}
+	plugins[name] = p
+}
+
+// Plugins gives the names of the registered plugins, sorted.
+func Plugins() []string {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	l := make([]string, 0, len(plugins))
+	for name := range plugins {
+		l = append(l, name)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// NewMiddleware creates the middleware of the registered plugin with the
+// specified settings.
+func NewMiddleware(name string, settings map[string]interface{}) (Middleware, error) {
+	pluginsMu.Lock()
+	p, ok := plugins[name]
+	pluginsMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown plugin '%s'", name)
+	}
+	m, err := p(settings)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid settings of plugin '%s': %v", name, err)
+	}
+	return m, nil
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ahmetalpbalkan/wagl/rrstore"
+	"github.com/miekg/dns"
+)
+
+// tracing gives a middleware appending its name to the trace before passing
+// the query on.
+func tracing(name string, trace *[]string) Middleware {
+	return func(next dns.Handler) dns.Handler {
+		return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			*trace = append(*trace, name)
+			next.ServeDNS(w, r)
+		})
+	}
+}
+
+// refusing is a middleware answering the queries for the name REFUSED.
+func refusing(name string) Middleware {
+	return func(next dns.Handler) dns.Handler {
+		return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			if r.Question[0].Name != name {
+				next.ServeDNS(w, r)
+				return
+			}
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeRefused)
+			w.WriteMsg(m)
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	var trace []string
+	h := Chain(dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		trace = append(trace, "handler")
+	}), tracing("a", &trace), tracing("b", &trace))
+	h.ServeDNS(&answerWriter{}, new(dns.Msg))
+	if expected := []string{"a", "b", "handler"}; !reflect.DeepEqual(trace, expected) {
+		t.Fatalf("wrong order: %v", trace)
+	}
+}
+
+func TestConfig_plugins(t *testing.T) {
+	srv := New("domain", ":8053", rrstore.New(), false, nil)
+	var trace []string
+	query := func(name string) int {
+		trace = nil
+		w := &answerWriter{network: "udp"}
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		srv.Handler.ServeDNS(w, m)
+		return w.m.Rcode
+	}
+
+	srv.SetConfig(Config{Plugins: []Middleware{tracing("log", &trace), refusing("blocked.domain.")}})
+	if rcode := query("blocked.domain."); rcode != dns.RcodeRefused {
+		t.Fatalf("query is not answered by the plugin: %s", dns.RcodeToString[rcode])
+	}
+	if rcode := query("api.domain."); rcode != dns.RcodeNameError {
+		t.Fatalf("query is not answered by the server: %s", dns.RcodeToString[rcode])
+	}
+	if !reflect.DeepEqual(trace, []string{"log"}) {
+		t.Fatalf("query does not pass through the plugins: %v", trace)
+	}
+
+	// clients not allowed are refused before the plugins
+	srv.SetConfig(Config{AllowQuery: cidrs(t, "10.0.0.0/8"), Plugins: []Middleware{tracing("log", &trace)}})
+	if rcode := query("api.domain."); rcode != dns.RcodeRefused || trace != nil {
+		t.Fatalf("query of a client not allowed passes through the plugins: %s %v", dns.RcodeToString[rcode], trace)
+	}
+
+	// plugins are replaced with the configuration
+	srv.SetConfig(Config{})
+	if rcode := query("blocked.domain."); rcode != dns.RcodeNameError || trace != nil {
+		t.Fatalf("plugins are not removed: %s %v", dns.RcodeToString[rcode], trace)
+	}
+}
+
+func TestNewMiddleware(t *testing.T) {
+	RegisterPlugin("test-refusing", func(settings map[string]interface{}) (Middleware, error) {
+		name, ok := settings["name"].(string)
+		if !ok {
+			return nil, errors.New("no name")
+		}
+		return refusing(name), nil
+	})
+	defer func() {
+		pluginsMu.Lock()
+		delete(plugins, "test-refusing")
+		pluginsMu.Unlock()
+	}()
+	if l := Plugins(); !reflect.DeepEqual(l, []string{"test-refusing"}) {
+		t.Fatalf("wrong plugins: %v", l)
+	}
+
+	if _, err := NewMiddleware("test-refusing", map[string]interface{}{"name": "x.domain."}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewMiddleware("test-refusing", nil); err == nil || !strings.Contains(err.Error(), "no name") {
+		t.Fatalf("wrong error for invalid settings: %v", err)
+	}
+	if _, err := NewMiddleware("unknown", nil); err == nil {
+		t.Fatal("middleware of an unknown plugin is created")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("duplicate plugin is registered")
+		}
+	}()
+	RegisterPlugin("test-refusing", nil)
+}
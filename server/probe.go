@@ -0,0 +1,32 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Probe makes a query for the domain to the DNS server listening on the
+// specified host:port over TCP, which is not subject to rate limiting, and
+// returns an error unless it is answered within timeout. Any response counts,
+// as the records may not be synced yet. Servers listening on all interfaces
+// are queried over the loopback interface.
+func Probe(addr, domain string, timeout time.Duration) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	switch host {
+	case "", "0.0.0.0":
+		host = "127.0.0.1"
+	case "::":
+		host = "::1"
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(domain), dns.TypeSOA)
+	c := &dns.Client{Net: "tcp", DialTimeout: timeout, ReadTimeout: timeout, WriteTimeout: timeout}
+	_, _, err = c.Exchange(m, net.JoinHostPort(host, port)) // checks the ID
+	return err
+}
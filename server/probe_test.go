@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ahmetalpbalkan/wagl/rrstore"
+)
+
+func TestProbe(t *testing.T) {
+	srv := New("domain", "", rrstore.New(), false, nil)
+	if srv.Listening() {
+		t.Fatal("listening before started")
+	}
+	addr := serveEphemeral(t, srv)
+	defer srv.Shutdown()
+
+	if err := Probe(addr, "domain", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	srv.TCP.Shutdown()
+	if err := Probe(addr, "domain", time.Second); err == nil {
+		t.Fatal("probe succeeds without a listener")
+	}
+	if _, port, _ := net.SplitHostPort(addr); Probe(port, "domain", time.Second) == nil {
+		t.Fatal("probe succeeds with an invalid address")
+	}
+}
+
+// serveEphemeral starts the server on ephemeral UDP and TCP ports and waits
+// until it is listening. It gives the TCP address.
+func serveEphemeral(t *testing.T, srv *DnsServer) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.PacketConn = pc
+	srv.TCP.Listener = l
+	srv.TCP.Handler = srv.Handler
+	go srv.ActivateAndServe()
+	go srv.TCP.ActivateAndServe()
+	for i := 0; !srv.Listening(); i++ {
+		if i == 100 {
+			t.Fatal("not listening after started")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return l.Addr().String()
+}
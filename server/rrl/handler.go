@@ -0,0 +1,69 @@
+package rrl
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Handler wraps the DNS handler h so that its responses to UDP clients are
+// rate limited. Responses to TCP clients are never limited as the source
+// address of those cannot be spoofed.
+func (l *Limiter) Handler(h dns.Handler) dns.Handler {
+	if !l.Enabled() {
+		return h
+	}
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		addr, ok := w.RemoteAddr().(*net.UDPAddr)
+		if !ok {
+			h.ServeDNS(w, r)
+			return
+		}
+		h.ServeDNS(&limitedWriter{ResponseWriter: w, l: l, client: addr.IP, req: r}, r)
+	})
+}
+
+// limitedWriter is a dns.ResponseWriter that consults the limiter before
+// writing responses.
+type limitedWriter struct {
+	dns.ResponseWriter
+	l      *Limiter
+	client net.IP
+	req    *dns.Msg
+}
+
+func (w *limitedWriter) WriteMsg(m *dns.Msg) error {
+	switch w.l.Check(w.client, m) {
+	case Drop:
+		return nil
+	case Slip:
+		return w.ResponseWriter.WriteMsg(truncated(w.req, m))
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+func (w *limitedWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return w.ResponseWriter.Write(b) // cannot account, let it go
+	}
+	switch w.l.Check(w.client, m) {
+	case Drop:
+		return len(b), nil
+	case Slip:
+		return len(b), w.ResponseWriter.WriteMsg(truncated(w.req, m))
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// truncated gives an empty response with TC bit set for request r based on
+// the original response m.
+func truncated(r, m *dns.Msg) *dns.Msg {
+	tc := new(dns.Msg)
+	tc.SetReply(r)
+	tc.Rcode = m.Rcode
+	tc.Authoritative = m.Authoritative
+	tc.RecursionAvailable = m.RecursionAvailable
+	tc.Truncated = true
+	return tc
+}
@@ -0,0 +1,211 @@
+// Package rrl implements DNS Response Rate Limiting (RRL) to protect the
+// server from being used in floods and reflection attacks over UDP.
+//
+// Responses are accounted in buckets keyed by the client's netblock and the
+// identity of the response (rcode, type and name). Each bucket is credited
+// with a fixed number of responses per second. Once a bucket runs out of
+// credit, responses are dropped; except for every Nth dropped response
+// ("slip") which is sent back empty and truncated (TC=1) so that legitimate
+// clients behind the same netblock can retry over TCP.
+package rrl
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultWindow        = time.Second * 15
+	defaultSlip          = 2
+	defaultIPv4PrefixLen = 24
+	defaultIPv6PrefixLen = 56
+	defaultMaxEntries    = 100000
+)
+
+// Action is the decision made by the limiter for a response.
+type Action int
+
+const (
+	Allow Action = iota // send the response as is
+	Drop                // do not send any response
+	Slip                // send an empty response with TC=1
+)
+
+func (a Action) String() string {
+	switch a {
+	case Allow:
+		return "allow"
+	case Drop:
+		return "drop"
+	case Slip:
+		return "slip"
+	}
+	return fmt.Sprintf("Action(%d)", int(a))
+}
+
+// Config describes the rate limiting policy. Zero values are replaced with
+// sensible defaults except ResponsesPerSecond.
+type Config struct {
+	// ResponsesPerSecond is how many identical responses a netblock can
+	// receive per second. Zero disables rate limiting.
+	ResponsesPerSecond int
+
+	// Slip is the ratio of dropped responses that are sent truncated (e.g.
+	// 2 means every other dropped response is sent with TC=1). Negative
+	// value means dropped responses are never slipped.
+	Slip int
+
+	// Window is how long a bucket is kept around after it is last used.
+	Window time.Duration
+
+	// IPv4PrefixLen and IPv6PrefixLen determine the size of the client
+	// netblocks that share the same bucket.
+	IPv4PrefixLen int
+	IPv6PrefixLen int
+
+	// MaxEntries is the maximum number of buckets. Once reached, the least
+	// recently used bucket is evicted for a new one, so that a flood from
+	// spoofed sources cannot grow the table unbounded.
+	MaxEntries int
+}
+
+func (c Config) withDefaults() Config {
+	if c.Slip == 0 {
+		c.Slip = defaultSlip
+	}
+	if c.Window == 0 {
+		c.Window = defaultWindow
+	}
+	if c.IPv4PrefixLen == 0 {
+		c.IPv4PrefixLen = defaultIPv4PrefixLen
+	}
+	if c.IPv6PrefixLen == 0 {
+		c.IPv6PrefixLen = defaultIPv6PrefixLen
+	}
+	if c.MaxEntries == 0 {
+		c.MaxEntries = defaultMaxEntries
+	}
+	return c
+}
+
+// bucket keeps the remaining credit of a (netblock, response) pair.
+type bucket struct {
+	key     string
+	credit  float64
+	last    time.Time
+	dropped int
+}
+
+// Limiter accounts responses and decides if they should be sent.
+type Limiter struct {
+	cfg Config
+	now func() time.Time // injectable clock
+
+	m     sync.Mutex
+	table map[string]*list.Element // of *bucket, by key
+	lru   *list.List               // buckets, most recently used first
+}
+
+// New creates a Limiter with the specified configuration.
+func New(cfg Config) *Limiter {
+	return &Limiter{
+		cfg:   cfg.withDefaults(),
+		now:   time.Now,
+		table: make(map[string]*list.Element),
+		lru:   list.New(),
+	}
+}
+
+// Enabled returns whether the limiter is going to limit any responses.
+func (l *Limiter) Enabled() bool {
+	return l.cfg.ResponsesPerSecond > 0
+}
+
+// Check accounts the response m going to the client and returns the action
+// that should be taken for the response.
+func (l *Limiter) Check(client net.IP, m *dns.Msg) Action {
+	if !l.Enabled() {
+		return Allow
+	}
+	key := l.netblock(client) + "/" + responseKey(m)
+	now := l.now()
+	rate := float64(l.cfg.ResponsesPerSecond)
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.purge(now)
+	var b *bucket
+	if e, ok := l.table[key]; !ok {
+		if len(l.table) >= l.cfg.MaxEntries {
+			l.remove(l.lru.Back())
+		}
+		b = &bucket{key: key, credit: rate, last: now}
+		l.table[key] = l.lru.PushFront(b)
+	} else {
+		b = e.Value.(*bucket)
+		l.lru.MoveToFront(e)
+		// credit the bucket for the time passed, but not more than a second
+		// worth of responses.
+		b.credit += now.Sub(b.last).Seconds() * rate
+		if b.credit > rate {
+			b.credit = rate
+		}
+		b.last = now
+	}
+
+	if b.credit >= 1 {
+		b.credit--
+		b.dropped = 0
+		return Allow
+	}
+	b.dropped++
+	if l.cfg.Slip > 0 && b.dropped%l.cfg.Slip == 0 {
+		return Slip
+	}
+	return Drop
+}
+
+// purge removes the buckets that have not been used within the window. As
+// they are the least recently used ones, it stops at the first bucket in use,
+// so that each bucket is only visited once when it is removed.
+func (l *Limiter) purge(now time.Time) {
+	for e := l.lru.Back(); e != nil && now.Sub(e.Value.(*bucket).last) > l.cfg.Window; e = l.lru.Back() {
+		l.remove(e)
+	}
+}
+
+func (l *Limiter) remove(e *list.Element) {
+	l.lru.Remove(e)
+	delete(l.table, e.Value.(*bucket).key)
+}
+
+// netblock gives the network address of the ip based on the configured prefix
+// lengths.
+func (l *Limiter) netblock(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(l.cfg.IPv4PrefixLen, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(l.cfg.IPv6PrefixLen, 128)).String()
+}
+
+// responseKey identifies the response. Positive answers are identified by their
+// question, whereas all negative answers and errors with the same rcode share
+// the same identity so that random subdomain floods are also limited.
+func responseKey(m *dns.Msg) string {
+	rcode := dns.RcodeToString[m.Rcode]
+	if m.Rcode != dns.RcodeSuccess || len(m.Question) == 0 {
+		return rcode
+	}
+	q := m.Question[0]
+	if len(m.Answer) == 0 {
+		return rcode + "/NODATA/" + strings.ToLower(q.Name)
+	}
+	return rcode + "/" + dns.TypeToString[q.Qtype] + "/" + strings.ToLower(q.Name)
+}
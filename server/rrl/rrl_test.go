@@ -0,0 +1,218 @@
+package rrl
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeClock is a manually advanced clock.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// testLimiter gives a limiter that uses a fake clock.
+func testLimiter(cfg Config) (*Limiter, *fakeClock) {
+	c := &fakeClock{time.Unix(1445000000, 0)}
+	l := New(cfg)
+	l.now = c.now
+	return l, c
+}
+
+func answer(name string, rcode int, answers int) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	m.Response = true
+	m.Rcode = rcode
+	for i := 0; i < answers; i++ {
+		rr, _ := dns.NewRR(name + " 0 IN A 10.0.0.1")
+		m.Answer = append(m.Answer, rr)
+	}
+	return m
+}
+
+func TestCheck_disabled(t *testing.T) {
+	l, _ := testLimiter(Config{})
+	ip := net.ParseIP("10.0.0.1")
+	for i := 0; i < 100; i++ {
+		if a := l.Check(ip, answer("a.swarm.", dns.RcodeSuccess, 1)); a != Allow {
+			t.Fatalf("wrong action: %v", a)
+		}
+	}
+}
+
+func TestCheck_limitsAndSlips(t *testing.T) {
+	l, _ := testLimiter(Config{ResponsesPerSecond: 5, Slip: 2})
+	ip := net.ParseIP("10.0.0.1")
+	m := answer("a.swarm.", dns.RcodeSuccess, 1)
+
+	expected := []Action{Allow, Allow, Allow, Allow, Allow, Drop, Slip, Drop, Slip}
+	for i, exp := range expected {
+		if a := l.Check(ip, m); a != exp {
+			t.Fatalf("wrong action for response #%d. expected=%v got=%v", i, exp, a)
+		}
+	}
+}
+
+func TestCheck_noSlip(t *testing.T) {
+	l, _ := testLimiter(Config{ResponsesPerSecond: 1, Slip: -1})
+	ip := net.ParseIP("10.0.0.1")
+	m := answer("a.swarm.", dns.RcodeSuccess, 1)
+
+	if a := l.Check(ip, m); a != Allow {
+		t.Fatalf("wrong action: %v", a)
+	}
+	for i := 0; i < 10; i++ {
+		if a := l.Check(ip, m); a != Drop {
+			t.Fatalf("wrong action: %v", a)
+		}
+	}
+}
+
+func TestCheck_creditsOverTime(t *testing.T) {
+	l, c := testLimiter(Config{ResponsesPerSecond: 2, Slip: -1})
+	ip := net.ParseIP("10.0.0.1")
+	m := answer("a.swarm.", dns.RcodeSuccess, 1)
+
+	for i := 0; i < 2; i++ {
+		l.Check(ip, m)
+	}
+	if a := l.Check(ip, m); a != Drop {
+		t.Fatalf("expected drop, got: %v", a)
+	}
+
+	c.advance(time.Millisecond * 500) // credits one response
+	if a := l.Check(ip, m); a != Allow {
+		t.Fatalf("expected allow, got: %v", a)
+	}
+	if a := l.Check(ip, m); a != Drop {
+		t.Fatalf("expected drop, got: %v", a)
+	}
+
+	c.advance(time.Minute) // never credits more than rate
+	for i := 0; i < 2; i++ {
+		if a := l.Check(ip, m); a != Allow {
+			t.Fatalf("expected allow, got: %v", a)
+		}
+	}
+	if a := l.Check(ip, m); a != Drop {
+		t.Fatalf("expected drop, got: %v", a)
+	}
+}
+
+func TestCheck_buckets(t *testing.T) {
+	l, _ := testLimiter(Config{ResponsesPerSecond: 1, Slip: -1})
+	m := answer("a.swarm.", dns.RcodeSuccess, 1)
+
+	l.Check(net.ParseIP("10.0.0.1"), m)
+	if a := l.Check(net.ParseIP("10.0.0.200"), m); a != Drop {
+		t.Fatalf("same /24 should share the bucket, got: %v", a)
+	}
+	if a := l.Check(net.ParseIP("10.0.1.1"), m); a != Allow {
+		t.Fatalf("different /24 should not share the bucket, got: %v", a)
+	}
+	if a := l.Check(net.ParseIP("10.0.0.1"), answer("b.swarm.", dns.RcodeSuccess, 1)); a != Allow {
+		t.Fatalf("different names should not share the bucket, got: %v", a)
+	}
+
+	l.Check(net.ParseIP("2001:db8::1"), m)
+	if a := l.Check(net.ParseIP("2001:db8:0:ff::1"), m); a != Drop {
+		t.Fatalf("same /56 should share the bucket, got: %v", a)
+	}
+
+	// all NXDOMAINs share the same bucket
+	l.Check(net.ParseIP("10.0.2.1"), answer("x.swarm.", dns.RcodeNameError, 0))
+	if a := l.Check(net.ParseIP("10.0.2.1"), answer("y.swarm.", dns.RcodeNameError, 0)); a != Drop {
+		t.Fatalf("NXDOMAINs should share the bucket, got: %v", a)
+	}
+}
+
+func TestCheck_purgesIdleBuckets(t *testing.T) {
+	l, c := testLimiter(Config{ResponsesPerSecond: 1, MaxEntries: 2, Window: time.Second})
+	m := answer("a.swarm.", dns.RcodeSuccess, 1)
+
+	l.Check(net.ParseIP("10.0.0.1"), m)
+	l.Check(net.ParseIP("10.0.1.1"), m)
+	c.advance(time.Second * 2)
+	l.Check(net.ParseIP("10.0.2.1"), m)
+	if n := len(l.table); n != 1 {
+		t.Fatalf("idle buckets are not purged, table size: %d", n)
+	}
+}
+
+func TestCheck_evictsLeastRecentlyUsed(t *testing.T) {
+	l, c := testLimiter(Config{ResponsesPerSecond: 1, MaxEntries: 2})
+	m := answer("a.swarm.", dns.RcodeSuccess, 1)
+
+	l.Check(net.ParseIP("10.0.0.1"), m)
+	l.Check(net.ParseIP("10.0.1.1"), m)
+	c.advance(time.Millisecond)
+	l.Check(net.ParseIP("10.0.0.1"), m) // 10.0.1.1 is the least recently used
+	l.Check(net.ParseIP("10.0.2.1"), m)
+	if n := len(l.table); n != 2 {
+		t.Fatalf("table grows past the max entries, size: %d", n)
+	}
+	if a := l.Check(net.ParseIP("10.0.0.1"), m); a == Allow {
+		t.Fatal("recently used bucket is evicted")
+	}
+	if a := l.Check(net.ParseIP("10.0.1.1"), m); a != Allow {
+		t.Fatal("least recently used bucket is not evicted")
+	}
+}
+
+// fakeWriter is a dns.ResponseWriter that records the written messages.
+type fakeWriter struct {
+	dns.ResponseWriter
+	remote net.Addr
+	msgs   []*dns.Msg
+}
+
+func (w *fakeWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *fakeWriter) WriteMsg(m *dns.Msg) error {
+	w.msgs = append(w.msgs, m)
+	return nil
+}
+func (w *fakeWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	return len(b), w.WriteMsg(m)
+}
+
+func TestHandler(t *testing.T) {
+	l, _ := testLimiter(Config{ResponsesPerSecond: 1, Slip: 2})
+	h := l.Handler(dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(answer(r.Question[0].Name, dns.RcodeSuccess, 1))
+	}))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.swarm.", dns.TypeA)
+
+	udp := &fakeWriter{remote: &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}}
+	for i := 0; i < 3; i++ {
+		h.ServeDNS(udp, req)
+	}
+	if len(udp.msgs) != 2 {
+		t.Fatalf("wrong number of responses: %d", len(udp.msgs))
+	}
+	if udp.msgs[0].Truncated || len(udp.msgs[0].Answer) != 1 {
+		t.Fatalf("first response should be intact: %v", udp.msgs[0])
+	}
+	if !udp.msgs[1].Truncated || len(udp.msgs[1].Answer) != 0 || udp.msgs[1].Id != req.Id {
+		t.Fatalf("slipped response should be empty and truncated: %v", udp.msgs[1])
+	}
+
+	tcp := &fakeWriter{remote: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}}
+	for i := 0; i < 3; i++ {
+		h.ServeDNS(tcp, req)
+	}
+	if len(tcp.msgs) != 3 {
+		t.Fatalf("TCP responses should not be limited, got %d responses", len(tcp.msgs))
+	}
+}
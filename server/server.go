@@ -1,86 +1,269 @@
 package server
 
 import (
-	"log"
+	"context"
+	"errors"
+	"log/slog"
 	"math/rand"
+	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/ahmetalpbalkan/wagl/metrics"
 	"github.com/ahmetalpbalkan/wagl/rrstore"
 	"github.com/ahmetalpbalkan/wagl/rrtype"
 	"github.com/miekg/dns"
 )
 
 var (
-	rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+	errRecursionDisabled = errors.New("recursion disabled")
+	errRefused           = errors.New("refused by ACL")
 )
 
 type DnsServer struct {
-	*dns.Server
+	*dns.Server // UDP server
+
+	// TCP is the server accepting queries over TCP on the same address,
+	// started with ListenAndServeTCP.
+	TCP *dns.Server
+
 	rr rrstore.RRReader
 
-	recurse     bool
-	nameservers []string
+	mux    dns.Handler  // answers the queries once they pass the plugins
+	config atomic.Value // holds *activeConfig, never modified after stored
+
+	udpUp, tcpUp int32        // set atomically once listening
+	addr         atomic.Value // holds the address bound by Listen, a string
+
+	// Logger logs the events of the server and the sampled queries.
+	Logger *slog.Logger
+
+	// Tap records the queries forwarded to the external nameservers and
+	// their responses, if set.
+	Tap ForwardTap
+
+	// Metrics are the metrics the answers and the forwarded queries are
+	// counted in, created in a registry of their own by New.
+	Metrics *Metrics
+}
+
+// ForwardTap records the queries forwarded to the external nameservers, e.g.
+// as dnstap messages.
+type ForwardTap interface {
+	// Forwarded is called once the query sent at queryTime to the
+	// nameserver at addr in host:port form over network ("udp", "tcp" or
+	// "tls") is answered with resp at respTime, or not answered (resp is
+	// nil).
+	Forwarded(addr, network string, query *dns.Msg, queryTime time.Time, resp *dns.Msg, respTime time.Time)
+}
+
+// Config is the configuration of the server that can be changed while it is
+// serving queries with SetConfig.
+type Config struct {
+	// Recurse enables forwarding the queries outside the domain to the
+	// Nameservers.
+	Recurse     bool
+	Nameservers []Upstream
+
+	// ForwardZones are the nameservers the queries for the names in the
+	// zones (lowercase FQDNs) are forwarded to, even if Recurse is off. The
+	// zone with the longest matching suffix is used.
+	ForwardZones map[string][]Upstream
+
+	// AllowQuery and AllowRecursion are the networks of the clients that
+	// can query the server and have their queries forwarded, respectively.
+	// Others are answered REFUSED. All clients are allowed if nil.
+	AllowQuery     []*net.IPNet
+	AllowRecursion []*net.IPNet
+
+	// QueryLogSample is the fraction of the queries that are logged, from 0
+	// (none) to 1 (all).
+	QueryLogSample float64
+
+	// Plugins are the middlewares the queries of the allowed clients pass
+	// through, in order, before they are answered.
+	Plugins []Middleware
+}
+
+// activeConfig is the configuration in use with the handler chaining its
+// plugins.
+type activeConfig struct {
+	Config
+	handler dns.Handler
 }
 
 // New creates a DnsServer ready to serve queries for the specified domain on
 // the given host:port using the specified DNS Resource Record table as the
 // source of truth.
-func New(domain, addr string, rr rrstore.RRReader, recurse bool, nameservers []string) *DnsServer {
-	d := &DnsServer{rr: rr,
-		recurse:     recurse,
-		nameservers: nameservers}
-
+func New(domain, addr string, rr rrstore.RRReader, recurse bool, nameservers []Upstream) *DnsServer {
+	d := &DnsServer{rr: rr, Logger: slog.Default(), Metrics: NewMetrics(metrics.NewRegistry())}
 	mux := dns.NewServeMux()
 	mux.HandleFunc(".", d.handleExternal)
 	mux.HandleFunc(dns.Fqdn(domain), d.handleDomain)
+	d.mux = mux
+	d.SetConfig(Config{Recurse: recurse, Nameservers: nameservers})
+
 	d.Server = &dns.Server{
-		Addr:    addr,
-		Net:     "udp",
-		Handler: mux,
+		Addr:           addr,
+		Net:            "udp",
+		Handler:        d.allowQuery(dns.HandlerFunc(d.servePlugins)),
+		DecorateReader: nonblocking,
 	}
 	d.Server.NotifyStartedFunc = func() {
-		log.Printf("DNS server started listening at %s", d.Server.Addr)
+		atomic.StoreInt32(&d.udpUp, 1)
+		d.Logger.Info("DNS server started listening", "addr", d.Addr(), "net", "udp")
+	}
+	d.TCP = &dns.Server{
+		Addr: addr,
+		Net:  "tcp",
+	}
+	d.TCP.NotifyStartedFunc = func() {
+		atomic.StoreInt32(&d.tcpUp, 1)
+		d.Logger.Info("DNS server started listening", "addr", d.Addr(), "net", "tcp")
 	}
 	return d
 }
 
+// Config returns the current configuration of the server.
+func (d *DnsServer) Config() Config {
+	return d.config.Load().(*activeConfig).Config
+}
+
+// SetConfig replaces the configuration of the server. Queries being answered
+// keep using the previous configuration.
+func (d *DnsServer) SetConfig(c Config) {
+	d.config.Store(&activeConfig{c, Chain(d.mux, c.Plugins...)})
+}
+
+// servePlugins passes the query through the plugins of the configuration to be
+// answered.
+func (d *DnsServer) servePlugins(w dns.ResponseWriter, r *dns.Msg) {
+	d.config.Load().(*activeConfig).handler.ServeDNS(w, r)
+}
+
+// Listening returns if the server has started listening for queries over
+// both UDP and TCP.
+func (d *DnsServer) Listening() bool {
+	return atomic.LoadInt32(&d.udpUp) == 1 && atomic.LoadInt32(&d.tcpUp) == 1
+}
+
+// Listen binds the UDP and TCP sockets of the server to its address, with the
+// same port for both. If the port is 0, a free one is picked. ListenAndServe
+// and ListenAndServeTCP then serve on these sockets.
+func (d *DnsServer) Listen() error {
+	host, port, err := net.SplitHostPort(d.Server.Addr)
+	if err != nil {
+		return err
+	}
+	for i := 1; ; i++ {
+		pc, err := net.ListenPacket("udp", d.Server.Addr)
+		if err != nil {
+			return err
+		}
+		_, bound, _ := net.SplitHostPort(pc.LocalAddr().String())
+		addr := net.JoinHostPort(host, bound)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			pc.Close()
+			if port == "0" && i < listenAttempts {
+				continue // the port picked is taken over TCP, pick another
+			}
+			return err
+		}
+		d.Server.PacketConn, d.TCP.Listener = pc, l
+		d.addr.Store(addr)
+		return nil
+	}
+}
+
+// listenAttempts is how many free ports Listen tries before giving up.
+const listenAttempts = 10
+
+// Addr returns the address the server is bound to by Listen, which has the
+// port picked if it is 0, or the address it is created with until then.
+func (d *DnsServer) Addr() string {
+	if addr, ok := d.addr.Load().(string); ok {
+		return addr
+	}
+	return d.Server.Addr
+}
+
+// ListenAndServe starts accepting queries over UDP and blocks, on the socket
+// bound by Listen if it is called.
+func (d *DnsServer) ListenAndServe() error {
+	if d.Server.PacketConn != nil {
+		return d.Server.ActivateAndServe()
+	}
+	return d.Server.ListenAndServe()
+}
+
+// ListenAndServeTCP starts accepting queries over TCP using the same handler
+// as the UDP server and blocks, on the socket bound by Listen if it is
+// called.
+func (d *DnsServer) ListenAndServeTCP() error {
+	d.TCP.Handler = d.Handler
+	if d.TCP.Listener != nil {
+		return d.TCP.ActivateAndServe()
+	}
+	return d.TCP.ListenAndServe()
+}
+
 // handleExternal handles DNS queries that are outside the cluster's domain such
 // as the Public Internet.
 func (d *DnsServer) handleExternal(w dns.ResponseWriter, r *dns.Msg) {
+	cfg := d.Config()
 	dom, qType := parseQuestion(r)
-	q := dns.TypeToString[qType] + " " + dom
-	log.Printf("--> External: %s", q)
+	logQuery := d.queryLogger(cfg, w, dom, qType)
 
-	if !d.recurse {
-		log.Printf("<-x %s: SERVFAIL: recursion disabled", q)
+	nameservers := cfg.upstreams(dom)
+	if nameservers != nil && !allowed(cfg.AllowRecursion, w) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+		logQuery(m.Rcode, "", errRefused)
+	} else if nameservers == nil {
 		m := new(dns.Msg)
 		m.SetReply(r)
 		m.SetRcode(r, dns.RcodeServerFailure)
 		m.Authoritative = false
 		m.RecursionAvailable = false
 		w.WriteMsg(m)
+		logQuery(m.Rcode, "", errRecursionDisabled)
 	} else {
-		in, ns, err := d.queryExternal(r)
+		network := clientNetwork(w)
+		in, ns, err := d.queryExternal(nameservers, r, network)
 		if err != nil {
-			log.Printf("<-x %s (@%s): SERVFAIL: %v", q, ns, err)
 			m := new(dns.Msg)
 			m.SetReply(r)
 			m.SetRcode(r, dns.RcodeServerFailure)
 			w.WriteMsg(m)
+			logQuery(m.Rcode, ns.String(), err)
 		} else {
-			log.Printf("<-- %s (@%s): %d answers, %d extra, %d ns", q, ns, len(in.Answer), len(in.Extra), len(in.Ns))
 			in.Compress = true
+			if network == "udp" {
+				truncate(in, udpSize(r))
+			}
 			w.WriteMsg(in)
+			logQuery(in.Rcode, ns.String(), nil)
 		}
 	}
 }
 
-// handleDomain handles DNS queries that come to the cluster
+// handleDomain handles DNS queries that come to the cluster. Answers are
+// served prepacked unless they do not fit in a UDP response.
 func (d *DnsServer) handleDomain(w dns.ResponseWriter, r *dns.Msg) {
 	dom, qType := parseQuestion(r)
-	q := dns.TypeToString[qType] + " " + dom
-	log.Printf("--> Internal: %s", q)
+	logQuery := d.queryLogger(d.Config(), w, dom, qType)
+
+	if rrtype.IsSupported(qType) {
+		if a, ok := d.rr.Answer(dom, qType); ok && writeAnswer(w, r, a) {
+			d.Metrics.answerCache.With("hit").Inc()
+			logQuery(dns.RcodeSuccess, "", nil)
+			return
+		}
+		d.Metrics.answerCache.With("miss").Inc()
+	}
 
 	m := new(dns.Msg)
 	m.SetReply(r)
@@ -88,42 +271,144 @@ func (d *DnsServer) handleDomain(w dns.ResponseWriter, r *dns.Msg) {
 
 	supported, found, recs := d.queryRR(qType, dom)
 	if !supported {
-		log.Printf("<-x %s: NOTIMP", q)
 		m.SetRcode(r, dns.RcodeNotImplemented) // NOTIMP
 	} else if !found {
-		log.Printf("<-x %s: NXDOMAIN", q)
 		m.SetRcode(r, dns.RcodeNameError) // NXDOMAIN
 	} else {
 		for _, rec := range recs {
-			rr, err := rrtype.ToRR(qType, dom, rec)
-			if err != nil {
-				log.Printf("<-x %s SERVFAIL: record conv err: %v", q, err)
-				m.SetRcode(r, dns.RcodeServerFailure)
-				break
-			} else {
-				log.Printf("<-- %s: %s", q, rr.String())
-				m.Answer = append(m.Answer, rr)
-			}
+			m.Answer = append(m.Answer, rec.RR())
 		}
 	}
+	if clientNetwork(w) == "udp" {
+		truncate(m, udpSize(r))
+	}
 	w.WriteMsg(m)
+	logQuery(m.Rcode, "", nil)
+}
+
+// allowQuery wraps the DNS handler h so that the queries of the clients not
+// allowed to query the server are answered REFUSED.
+func (d *DnsServer) allowQuery(h dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		cfg := d.Config()
+		if allowed(cfg.AllowQuery, w) {
+			h.ServeDNS(w, r)
+			return
+		}
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+		if len(r.Question) > 0 {
+			dom, qType := parseQuestion(r)
+			d.queryLogger(cfg, w, dom, qType)(m.Rcode, "", errRefused)
+		}
+	})
+}
+
+// allowed returns if the client is in one of the networks, or if nets is nil.
+func allowed(nets []*net.IPNet, w dns.ResponseWriter) bool {
+	if nets == nil {
+		return true
+	}
+	var ip net.IP
+	switch a := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	for _, n := range nets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreams gives the nameservers the query for the name is forwarded to: the
+// ones of the forward zone with the longest matching suffix, or the external
+// nameservers if there is none. It gives nil if the query is not forwarded.
+func (c Config) upstreams(name string) []Upstream {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if ns := c.ForwardZones[name[off:]]; len(ns) > 0 {
+			return ns
+		}
+	}
+	if ns := c.ForwardZones["."]; len(ns) > 0 {
+		return ns
+	}
+	if !c.Recurse || len(c.Nameservers) == 0 {
+		return nil
+	}
+	return c.Nameservers
+}
+
+// queryLogger gives the function that logs the query once it is answered with
+// the response code, along with the upstream nameserver the query is
+// forwarded to and the error, if any. Queries are sampled to be logged and the
+// function does nothing for the ones that are not.
+func (d *DnsServer) queryLogger(cfg Config, w dns.ResponseWriter, qname string, qType uint16) func(rcode int, upstream string, err error) {
+	if cfg.QueryLogSample <= 0 || rand.Float64() >= cfg.QueryLogSample {
+		return func(int, string, error) {}
+	}
+	start := time.Now()
+	return func(rcode int, upstream string, err error) {
+		attrs := []slog.Attr{
+			slog.String("qname", qname),
+			slog.String("qtype", dns.Type(qType).String()),
+			slog.String("rcode", dns.RcodeToString[rcode]),
+		}
+		if upstream != "" {
+			attrs = append(attrs, slog.String("upstream", upstream))
+		}
+		attrs = append(attrs, slog.Duration("duration", time.Since(start)))
+		if addr := w.RemoteAddr(); addr != nil {
+			attrs = append(attrs, slog.String("client", addr.String()))
+		}
+		if err != nil {
+			attrs = append(attrs, slog.String("error", err.Error()))
+		}
+		d.Logger.LogAttrs(context.Background(), slog.LevelInfo, "Query", attrs...)
+	}
 }
 
-// queryExternal makes an external DNS query to a randomly picked external
-// nameserver.
-func (d *DnsServer) queryExternal(req *dns.Msg) (*dns.Msg, string, error) {
+// queryExternal makes an external DNS query to a randomly picked nameserver
+// over the specified network. If the answer received over UDP is truncated,
+// the query is retried over TCP.
+func (d *DnsServer) queryExternal(nameservers []Upstream, req *dns.Msg, network string) (*dns.Msg, Upstream, error) {
 	// TODO use other nameservers in case of failure?
-	ns := d.nameservers[rnd.Intn(len(d.nameservers))]
-	c := new(dns.Client)
-	in, _, err := c.Exchange(req, ns)
+	ns := nameservers[rand.Intn(len(nameservers))]
+	in, err := d.exchange(ns, req, network)
+	if err == nil && in.Truncated && network == "udp" {
+		d.Logger.Debug("Truncated answer, retrying over TCP", "upstream", ns.String())
+		in, err = d.exchange(ns, req, "tcp")
+	}
 	return in, ns, err
 }
 
+// exchange sends the query to the nameserver, measuring the time it takes to
+// answer and recording the query to the Tap.
+func (d *DnsServer) exchange(ns Upstream, req *dns.Msg, network string) (*dns.Msg, error) {
+	start := time.Now()
+	in, err := ns.Exchange(req, network)
+	end := time.Now()
+	if err != nil {
+		d.Metrics.upstreamErrors.With(ns.String()).Inc()
+	} else {
+		d.Metrics.upstreamDuration.With(ns.String()).Observe(end.Sub(start).Seconds())
+	}
+	if d.Tap != nil {
+		addr, network := transport(ns, network)
+		d.Tap.Forwarded(addr, network, req, start, in, end)
+	}
+	return in, err
+}
+
 // queryRR queries the DNS Resource Records for given record type. If the record
 // type is not supported or record is not found, false is returned from return
 // values, respectively. If records are found, they are returned in a shuffled
 // manner.
-func (d *DnsServer) queryRR(qType uint16, domain string) (supported bool, found bool, records []string) {
+func (d *DnsServer) queryRR(qType uint16, domain string) (supported bool, found bool, records []rrstore.Record) {
 	if !rrtype.IsSupported(qType) {
 		return false, false, nil
 	}
@@ -142,10 +427,12 @@ func parseQuestion(r *dns.Msg) (domain string, qType uint16) {
 	return strings.TrimSpace(strings.ToLower(q.Name)), q.Qtype
 }
 
-// shuffle is an implementation of Modern Fisher–Yates shuffle algortihm.
-func shuffle(a []string) {
+// shuffle is an implementation of Modern Fisher–Yates shuffle algortihm. It
+// uses the top-level functions of math/rand, which are safe for concurrent
+// use by the handlers.
+func shuffle(a []rrstore.Record) {
 	for i := len(a) - 1; i > 0; i-- {
-		r := rnd.Intn(i)
+		r := rand.Intn(i + 1)
 		a[i], a[r] = a[r], a[i]
 	}
 }
@@ -1,9 +1,16 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
+	"log/slog"
+	"net"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/ahmetalpbalkan/wagl/rrstore"
 	"github.com/miekg/dns"
@@ -14,7 +21,7 @@ func TestHandleExternalOff(t *testing.T) {
 	<-ready
 	defer srv.Shutdown()
 
-	if r, err := query(srv.Addr, "example.com", dns.TypeA); err != nil {
+	if r, err := query(srv.Addr(), "example.com", dns.TypeA); err != nil {
 		t.Fatalf("exchange failed: %v", err)
 	} else if r.Rcode != dns.RcodeServerFailure {
 		t.Fatalf("unexpected rcode. expected=%s got=%s",
@@ -54,7 +61,7 @@ func TestHandleExternalOn(t *testing.T) {
 	for _, c := range cases {
 		q := fmt.Sprintf("%s %s", dns.TypeToString[c.qType], c.fqdn)
 
-		if r, err := query(srv.Addr, c.fqdn, c.qType); err != nil {
+		if r, err := query(srv.Addr(), c.fqdn, c.qType); err != nil {
 			t.Fatalf("exchange failed (%s): %v", q, err)
 		} else if r.Rcode != c.expectedRCode {
 			t.Fatalf("unexpected rcode (%s). expected=%s got=%s", q,
@@ -68,16 +75,19 @@ func TestHandleExternalOn(t *testing.T) {
 
 func TestHandleDomain(t *testing.T) {
 	rr := rrstore.New()
-	rr.Set(map[uint16]map[string][]string{
+	rr.Set(1, rrstore.RRs{
 		dns.TypeA: {
-			"api.domain.":  []string{"10.0.0.1", "10.0.0.2"},
-			"blog.domain.": []string{"10.0.1.1", "10.0.1.2", "10.0.1.3"},
+			"api.domain.":  records("10.0.0.1", "10.0.0.2"),
+			"blog.domain.": records("10.0.1.1", "10.0.1.2", "10.0.1.3"),
 		},
 		dns.TypeSRV: {
-			"_web._tcp.domain.": []string{"10.0.0.1:80"},
-			"_web._udp.domain.": []string{"10.0.0.1:5001",
+			"_web._tcp.domain.": records("10.0.0.1:80"),
+			"_web._udp.domain.": records("10.0.0.1:5001",
 				"10.0.0.2:5002",
-				"10.0.0.3:5003"},
+				"10.0.0.3:5003"),
+		},
+		dns.TypeTXT: {
+			"api.domain.": {{Text: []string{"owner=team-a", "tier=web"}}},
 		},
 	})
 
@@ -95,7 +105,10 @@ func TestHandleDomain(t *testing.T) {
 		// domain.
 		{"nonexistent.domain.", dns.TypeA, dns.RcodeNameError, 0},
 		{"nonexistent.domain.", dns.TypeSRV, dns.RcodeNameError, 0},
+		{"nonexistent.domain.", dns.TypeTXT, dns.RcodeNameError, 0},
 		{"api.domain", dns.TypeA, dns.RcodeSuccess, 2},
+		{"api.domain", dns.TypeTXT, dns.RcodeSuccess, 1},
+		{"api.domain", dns.TypeMX, dns.RcodeNotImplemented, 0},
 		{"_web._tcp.domain", dns.TypeSRV, dns.RcodeSuccess, 1},
 		{"_WEB._UDP.domain", dns.TypeSRV, dns.RcodeSuccess, 3},
 	}
@@ -103,14 +116,14 @@ func TestHandleDomain(t *testing.T) {
 	for _, c := range cases {
 		q := fmt.Sprintf("%s %s", dns.TypeToString[c.qType], c.fqdn)
 
-		if r, err := query(srv.Addr, c.fqdn, c.qType); err != nil {
+		if r, err := query(srv.Addr(), c.fqdn, c.qType); err != nil {
 			t.Fatalf("exchange failed (%s): %v", q, err)
 		} else if r.Rcode != c.expectedRCode {
 			t.Fatalf("unexpected rcode (%s). expected=%s got=%s", q,
 				dns.RcodeToString[c.expectedRCode], dns.RcodeToString[r.Rcode])
 		} else if len(r.Answer) != c.expectedAnswers {
-			t.Fatalf("unexpected answers count. expected=%d got=%d", q,
-				len(r.Answer), c.expectedAnswers)
+			t.Fatalf("unexpected answers count (%s). expected=%d got=%d", q,
+				c.expectedAnswers, len(r.Answer))
 		}
 	}
 }
@@ -118,8 +131,8 @@ func TestHandleDomain(t *testing.T) {
 func TestRRShuffling(t *testing.T) {
 	rr := rrstore.New()
 	recs := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
-	rr.Set(map[uint16]map[string][]string{
-		dns.TypeA: {"a.domain.": []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}}})
+	rr.Set(1, rrstore.RRs{
+		dns.TypeA: {"a.domain.": records("10.0.0.1", "10.0.0.2", "10.0.0.3")}})
 
 	srv, ready := testServer(t, rr)
 	<-ready
@@ -128,7 +141,7 @@ func TestRRShuffling(t *testing.T) {
 	n := 50
 	same := true
 	for i := 0; i < n; i++ {
-		r, err := query(srv.Addr, "a.domain.", dns.TypeA)
+		r, err := query(srv.Addr(), "a.domain.", dns.TypeA)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -149,6 +162,162 @@ func TestRRShuffling(t *testing.T) {
 	}
 }
 
+func TestShuffle(t *testing.T) {
+	// every record ends up in every position, including its own
+	seen := make(map[[2]int]bool)
+	for i := 0; i < 1000; i++ {
+		recs := records("10.0.0.0", "10.0.0.1", "10.0.0.2")
+		shuffle(recs)
+		for pos, rec := range recs {
+			seen[[2]int{int(rec.Addr.To4()[3]), pos}] = true
+		}
+	}
+	if len(seen) != 9 {
+		t.Fatalf("records are not shuffled uniformly, (record, position) seen: %v", seen)
+	}
+}
+
+func TestHandleDomain_concurrent(t *testing.T) {
+	rr := rrstore.New()
+	rr.Set(1, rrstore.RRs{
+		dns.TypeA: {"api.domain.": records("10.0.0.1", "10.0.0.2", "10.0.0.3")}})
+	srv := New("domain", ":0", noAnswers{rr}, false, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				w := &answerWriter{network: "tcp"}
+				srv.handleDomain(w, new(dns.Msg).SetQuestion("api.domain.", dns.TypeA))
+				if len(w.m.Answer) != 3 {
+					t.Errorf("wrong answers: %v", w.m.Answer)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestHandleExternal_transport(t *testing.T) {
+	upstream, counts := testUpstream(t, "127.0.0.1:8054", 40)
+	defer upstream[0].Shutdown()
+	defer upstream[1].Shutdown()
+
+	ns, _ := ParseUpstream("127.0.0.1:8054")
+	srv := New("domain", ":8053", rrstore.New(), true, []Upstream{ns})
+	tap := new(testTap)
+	srv.Tap = tap
+	ready := make(chan struct{}, 2)
+	srv.NotifyStartedFunc = func() { ready <- struct{}{} }
+	srv.TCP.NotifyStartedFunc = func() { ready <- struct{}{} }
+	go srv.ListenAndServe()
+	go srv.ListenAndServeTCP()
+	<-ready
+	<-ready
+	defer srv.Shutdown()
+	defer srv.TCP.Shutdown()
+
+	cases := []struct {
+		network           string
+		bufSize           uint16 // EDNS0 buffer size, 0 means no EDNS0
+		expectedTruncated bool
+		expectedUDP       int // queries seen by upstream
+		expectedTCP       int
+	}{
+		// truncated UDP answer is retried over TCP and truncated to 512 bytes
+		{"udp", 0, true, 1, 1},
+		// large enough buffer for the entire answer
+		{"udp", 4096, false, 1, 1},
+		// client's transport is used
+		{"tcp", 0, false, 0, 1},
+	}
+	for _, c := range cases {
+		counts.reset()
+		tap.reset()
+		m := new(dns.Msg)
+		m.SetQuestion("big.example.", dns.TypeA)
+		if c.bufSize > 0 {
+			m.SetEdns0(c.bufSize, false)
+		}
+		// read the raw response, as truncated messages are unpacked without
+		// any records
+		co, err := dns.Dial(c.network, "127.0.0.1:8053")
+		if err != nil {
+			t.Fatal(err)
+		}
+		co.UDPSize = dns.MaxMsgSize
+		if err := co.WriteMsg(m); err != nil {
+			t.Fatal(err)
+		}
+		var h dns.Header
+		b, err := co.ReadMsgHeader(&h)
+		co.Close()
+		if err != nil {
+			t.Fatalf("exchange failed (%s, bufsize=%d): %v", c.network, c.bufSize, err)
+		}
+		truncated := h.Bits&(1<<9) != 0 // TC bit
+		if truncated != c.expectedTruncated {
+			t.Fatalf("wrong TC (%s, bufsize=%d): %v", c.network, c.bufSize, truncated)
+		}
+		if c.expectedTruncated {
+			if h.Ancount == 0 || h.Ancount >= 40 {
+				t.Fatalf("wrong answer count for truncated answer: %d", h.Ancount)
+			}
+			if len(b) > dns.MinMsgSize {
+				t.Fatalf("truncated response too large: %d bytes", len(b))
+			}
+		} else if h.Ancount != 40 {
+			t.Fatalf("wrong answer count (%s, bufsize=%d): %d", c.network, c.bufSize, h.Ancount)
+		}
+		if udp, tcp := counts.get(); udp != c.expectedUDP || tcp != c.expectedTCP {
+			t.Fatalf("wrong upstream queries (%s, bufsize=%d). expected udp=%d tcp=%d, got udp=%d tcp=%d",
+				c.network, c.bufSize, c.expectedUDP, c.expectedTCP, udp, tcp)
+		}
+		var expectedTapped []string
+		for i := 0; i < c.expectedUDP; i++ {
+			expectedTapped = append(expectedTapped, "127.0.0.1:8054/udp")
+		}
+		for i := 0; i < c.expectedTCP; i++ {
+			expectedTapped = append(expectedTapped, "127.0.0.1:8054/tcp")
+		}
+		if tapped := tap.get(); !reflect.DeepEqual(tapped, expectedTapped) {
+			t.Fatalf("wrong forwarded queries tapped (%s, bufsize=%d). expected: %v got: %v",
+				c.network, c.bufSize, expectedTapped, tapped)
+		}
+	}
+}
+
+// testTap records the addresses and networks of the answered forwarded
+// queries.
+type testTap struct {
+	m      sync.Mutex
+	tapped []string
+}
+
+func (t *testTap) Forwarded(addr, network string, query *dns.Msg, queryTime time.Time, resp *dns.Msg, respTime time.Time) {
+	if resp == nil || respTime.Before(queryTime) {
+		return
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.tapped = append(t.tapped, addr+"/"+network)
+}
+
+func (t *testTap) reset() {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.tapped = nil
+}
+
+func (t *testTap) get() []string {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.tapped
+}
+
 func query(addr string, domain string, qType uint16) (*dns.Msg, error) {
 	c, m := new(dns.Client), new(dns.Msg)
 	m.SetQuestion(dns.Fqdn(domain), qType)
@@ -156,9 +325,43 @@ func query(addr string, domain string, qType uint16) (*dns.Msg, error) {
 	return r, err
 }
 
+func TestListen(t *testing.T) {
+	rr := rrstore.New()
+	rr.Set(1, rrstore.RRs{
+		dns.TypeA: {"api.domain.": records("10.0.0.1")},
+	})
+	srv := New("domain", "127.0.0.1:0", rr, false, nil)
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	if _, port, _ := net.SplitHostPort(srv.Addr()); port == "0" {
+		t.Fatalf("port is not picked: %s", srv.Addr())
+	}
+	go srv.ListenAndServe()
+	go srv.ListenAndServeTCP()
+	for i := 0; !srv.Listening(); i++ {
+		if i == 100 {
+			t.Fatal("server is not listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer srv.Shutdown()
+	defer srv.TCP.Shutdown()
+
+	for _, network := range []string{"udp", "tcp"} {
+		c, m := &dns.Client{Net: network}, new(dns.Msg)
+		m.SetQuestion("api.domain.", dns.TypeA)
+		if r, _, err := c.Exchange(m, srv.Addr()); err != nil {
+			t.Fatalf("exchange over %s failed: %v", network, err)
+		} else if len(r.Answer) != 1 {
+			t.Fatalf("wrong answer over %s: %v", network, r)
+		}
+	}
+}
+
 // testServer gives a test server capable of serving only internal requests.
 func testServer(t *testing.T, rr rrstore.RRReader) (*DnsServer, <-chan struct{}) {
-	srv := New("domain", ":8053", rr, false, []string{})
+	srv := New("domain", ":8053", rr, false, nil)
 
 	ready := make(chan struct{}, 1)
 	srv.NotifyStartedFunc = func() {
@@ -168,10 +371,31 @@ func testServer(t *testing.T, rr rrstore.RRReader) (*DnsServer, <-chan struct{})
 	return srv, ready
 }
 
+// records gives the records for the specified addresses in IP or IP:port form.
+func records(addrs ...string) []rrstore.Record {
+	l := make([]rrstore.Record, len(addrs))
+	for i, v := range addrs {
+		host, port, err := net.SplitHostPort(v)
+		if err != nil {
+			host, port = v, "0"
+		}
+		p, _ := strconv.Atoi(port)
+		l[i] = rrstore.Record{Addr: net.ParseIP(host), Port: uint16(p), Priority: 1, Weight: 1}
+	}
+	return l
+}
+
 // testServerExternal gives a test server capable of serving only external
 // requests.
 func testServerExternal(t *testing.T) (*DnsServer, <-chan struct{}) {
-	ns := []string{"8.8.8.8:53", "8.8.4.4:53"}
+	var ns []Upstream
+	for _, v := range []string{"8.8.8.8:53", "8.8.4.4:53"} {
+		u, err := ParseUpstream(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ns = append(ns, u)
+	}
 	srv := New("dontcare", ":8053", rrstore.New(), true, ns)
 	ready := make(chan struct{}, 1)
 	srv.NotifyStartedFunc = func() {
@@ -180,3 +404,244 @@ func testServerExternal(t *testing.T) (*DnsServer, <-chan struct{}) {
 	go srv.ListenAndServe()
 	return srv, ready
 }
+
+// queryCounts counts the queries received by the test upstream per transport.
+type queryCounts struct {
+	m        sync.Mutex
+	udp, tcp int
+}
+
+func (c *queryCounts) reset() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.udp, c.tcp = 0, 0
+}
+
+func (c *queryCounts) get() (int, int) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.udp, c.tcp
+}
+
+// testUpstream starts UDP and TCP nameservers answering every query with n A
+// records. The UDP server always responds truncated without any records.
+func testUpstream(t *testing.T, addr string, n int) ([2]*dns.Server, *queryCounts) {
+	counts := new(queryCounts)
+	h := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		counts.m.Lock()
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			counts.udp++
+			m.Truncated = true
+		} else {
+			counts.tcp++
+			for i := 0; i < n; i++ {
+				rr, _ := dns.NewRR(fmt.Sprintf("%s 60 IN A 10.0.%d.%d", r.Question[0].Name, i/256, i%256))
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		counts.m.Unlock()
+		w.WriteMsg(m)
+	})
+
+	ready := make(chan struct{}, 2)
+	var srvs [2]*dns.Server
+	for i, network := range []string{"udp", "tcp"} {
+		srvs[i] = &dns.Server{Addr: addr, Net: network, Handler: h, DecorateReader: nonblocking,
+			NotifyStartedFunc: func() { ready <- struct{}{} }}
+		go srvs[i].ListenAndServe()
+	}
+	<-ready
+	<-ready
+	return srvs, counts
+}
+
+// lineWriter sends every write, a line of log, to the channel.
+type lineWriter chan []byte
+
+func (w lineWriter) Write(b []byte) (int, error) {
+	w <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func TestQueryLog(t *testing.T) {
+	rr := rrstore.New()
+	rr.Set(1, rrstore.RRs{
+		dns.TypeA: {"api.domain.": records("10.0.0.1")},
+	})
+	lines := make(lineWriter, 10)
+	srv := New("domain", ":8053", rr, false, nil)
+	srv.Logger = slog.New(slog.NewJSONHandler(lines, nil))
+	srv.SetConfig(Config{QueryLogSample: 1})
+	ready := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(ready) }
+	go srv.ListenAndServe()
+	<-ready
+	defer srv.Shutdown()
+
+	cases := []struct {
+		name  string
+		qType uint16
+		rcode string
+		err   string
+	}{
+		{"api.domain.", dns.TypeA, "NOERROR", ""},
+		{"API.domain.", dns.TypeSRV, "NXDOMAIN", ""},
+		{"example.com.", dns.TypeMX, "SERVFAIL", "recursion disabled"},
+	}
+	for _, c := range cases {
+		if _, err := query(srv.Addr(), c.name, c.qType); err != nil {
+			t.Fatalf("exchange failed: %v", err)
+		}
+		var l map[string]interface{}
+		select {
+		case b := <-lines:
+			if err := json.Unmarshal(b, &l); err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s is not logged", c.name)
+		}
+		if l["msg"] != "Query" || l["qname"] != strings.ToLower(c.name) ||
+			l["qtype"] != dns.TypeToString[c.qType] || l["rcode"] != c.rcode ||
+			l["duration"] == nil || !strings.HasPrefix(l["client"].(string), "127.0.0.1:") {
+			t.Fatalf("wrong query log for %s: %v", c.name, l)
+		}
+		if e, _ := l["error"].(string); e != c.err {
+			t.Fatalf("wrong error in query log for %s: %q", c.name, e)
+		}
+	}
+}
+
+func TestQueryLog_sample(t *testing.T) {
+	lines := make(lineWriter, 100)
+	srv := New("domain", ":8053", rrstore.New(), false, nil)
+	srv.Logger = slog.New(slog.NewJSONHandler(lines, nil))
+	w := &answerWriter{}
+
+	for _, c := range []struct {
+		sample   float64
+		min, max int
+	}{
+		{0, 0, 0},
+		{0.5, 20, 80},
+		{1, 100, 100},
+	} {
+		cfg := Config{QueryLogSample: c.sample}
+		for i := 0; i < 100; i++ {
+			srv.queryLogger(cfg, w, "api.domain.", dns.TypeA)(dns.RcodeSuccess, "", nil)
+		}
+		if n := len(lines); n < c.min || n > c.max {
+			t.Fatalf("sample %v: wrong number of queries logged: %d", c.sample, n)
+		}
+		for len(lines) > 0 {
+			<-lines
+		}
+	}
+}
+
+// cidrs parses the networks in CIDR notation.
+func cidrs(t *testing.T, l ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, v := range l {
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func TestAllowQuery(t *testing.T) {
+	srv := New("domain", ":8053", rrstore.New(), false, nil)
+
+	cases := []struct {
+		allow    []*net.IPNet
+		expected int
+	}{
+		{nil, dns.RcodeNameError},
+		{cidrs(t, "10.0.0.0/8"), dns.RcodeRefused},
+		{cidrs(t, "10.0.0.0/8", "127.0.0.0/8"), dns.RcodeNameError},
+		{[]*net.IPNet{}, dns.RcodeRefused},
+	}
+	for _, c := range cases {
+		srv.SetConfig(Config{AllowQuery: c.allow})
+		w := &answerWriter{network: "udp"}
+		m := new(dns.Msg)
+		m.SetQuestion("api.domain.", dns.TypeA)
+		srv.Handler.ServeDNS(w, m)
+		if w.m == nil || w.m.Rcode != c.expected {
+			t.Fatalf("wrong response for allowed %v: %v", c.allow, w.m)
+		}
+	}
+}
+
+func TestConfig_upstreams(t *testing.T) {
+	a, _ := ParseUpstream("10.0.0.1")
+	b, _ := ParseUpstream("10.0.0.2")
+	ns, _ := ParseUpstream("10.0.0.3")
+	zones := map[string][]Upstream{
+		"example.":      {a},
+		"corp.example.": {b},
+	}
+
+	cases := []struct {
+		recurse  bool
+		name     string
+		expected []Upstream
+	}{
+		{false, "db.corp.example.", []Upstream{b}},
+		{false, "corp.example.", []Upstream{b}},
+		{false, "xcorp.example.", []Upstream{a}},
+		{false, "example.", []Upstream{a}},
+		{false, "example.com.", nil},
+		{true, "example.com.", []Upstream{ns}},
+		{true, "www.example.", []Upstream{a}},
+	}
+	for _, c := range cases {
+		cfg := Config{Recurse: c.recurse, Nameservers: []Upstream{ns}, ForwardZones: zones}
+		if got := cfg.upstreams(c.name); !reflect.DeepEqual(got, c.expected) {
+			t.Fatalf("wrong nameservers for %s (recurse: %v). expected: %v got: %v", c.name, c.recurse, c.expected, got)
+		}
+	}
+}
+
+func TestHandleExternal_forwardZones(t *testing.T) {
+	upstream, counts := testUpstream(t, "127.0.0.1:8054", 1)
+	defer upstream[0].Shutdown()
+	defer upstream[1].Shutdown()
+
+	ns, _ := ParseUpstream("127.0.0.1:8054")
+	srv := New("domain", ":8053", rrstore.New(), false, nil)
+
+	cases := []struct {
+		name           string
+		allowRecursion []*net.IPNet
+		expected       int
+		expectedTCP    int // queries seen by upstream
+	}{
+		{"db.corp.example.", nil, dns.RcodeSuccess, 1},
+		{"example.com.", nil, dns.RcodeServerFailure, 0}, // recursion is off
+		{"db.corp.example.", cidrs(t, "10.0.0.0/8"), dns.RcodeRefused, 0},
+		{"db.corp.example.", cidrs(t, "127.0.0.1/32"), dns.RcodeSuccess, 1},
+	}
+	for _, c := range cases {
+		counts.reset()
+		srv.SetConfig(Config{
+			ForwardZones:   map[string][]Upstream{"corp.example.": {ns}},
+			AllowRecursion: c.allowRecursion,
+		})
+		w := &answerWriter{network: "tcp"}
+		m := new(dns.Msg)
+		m.SetQuestion(c.name, dns.TypeA)
+		srv.Handler.ServeDNS(w, m)
+		if w.m == nil || w.m.Rcode != c.expected {
+			t.Fatalf("wrong response for %s (allowed: %v): %v", c.name, c.allowRecursion, w.m)
+		}
+		if _, tcp := counts.get(); tcp != c.expectedTCP {
+			t.Fatalf("wrong upstream queries for %s (allowed: %v): %d", c.name, c.allowRecursion, tcp)
+		}
+	}
+}
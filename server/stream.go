@@ -0,0 +1,37 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// readStreamMsg reads a DNS message prefixed with its two-byte length from a
+// stream connection (such as TCP or TLS) as described in RFC 1035 4.2.2.
+func readStreamMsg(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint16(l[:])
+	if n == 0 {
+		return nil, errors.New("zero-length message")
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// writeStreamMsg writes the DNS message b prefixed with its two-byte length to
+// a stream connection in a single write.
+func writeStreamMsg(w io.Writer, b []byte) error {
+	if len(b) > 0xffff {
+		return errors.New("message too large")
+	}
+	out := make([]byte, 2, len(b)+2)
+	binary.BigEndian.PutUint16(out, uint16(len(b)))
+	_, err := w.Write(append(out, b...))
+	return err
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// tlsIdleTimeout is how long a DNS-over-TLS connection is kept open
+	// without receiving any queries.
+	tlsIdleTimeout = time.Second * 10
+
+	// tlsWriteTimeout is the time allotted for writing a response.
+	tlsWriteTimeout = time.Second * 2
+
+	// defaultTLSMaxInFlight is the default number of pipelined queries of a
+	// connection handled at the same time.
+	defaultTLSMaxInFlight = 32
+)
+
+// TLSServer serves DNS queries over TLS (RFC 7858).
+type TLSServer struct {
+	Addr    string
+	Config  *tls.Config
+	Handler dns.Handler
+
+	// NotifyStartedFunc is called once the server starts listening.
+	NotifyStartedFunc func()
+
+	// MaxInFlight is the number of pipelined queries of a connection handled
+	// at the same time. Further queries are not read from the connection until
+	// one of them is answered. Zero means the default.
+	MaxInFlight int
+
+	// Logger logs the events of the server.
+	Logger *slog.Logger
+
+	m        sync.Mutex
+	listener net.Listener
+	shutdown bool // no connections or queries are accepted once set
+	conns    map[net.Conn]struct{}
+	inFlight sync.WaitGroup
+}
+
+// NewTLS creates a DNS-over-TLS server listening on the specified host:port
+// that hands the queries to h. The TLS config must have a server certificate
+// and can require client certificates for mutual TLS authentication.
+func NewTLS(addr string, config *tls.Config, h dns.Handler) *TLSServer {
+	s := &TLSServer{
+		Addr:        addr,
+		Config:      config,
+		Handler:     h,
+		MaxInFlight: defaultTLSMaxInFlight,
+		Logger:      slog.Default(),
+		conns:       make(map[net.Conn]struct{}),
+	}
+	s.NotifyStartedFunc = func() {
+		s.Logger.Info("DNS-over-TLS server started listening", "addr", s.Addr)
+	}
+	return s
+}
+
+// ListenAndServe starts accepting TLS connections and blocks until the server
+// is shut down.
+func (s *TLSServer) ListenAndServe() error {
+	if err := s.checkConfig(); err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts TLS connections on the TCP listener l, e.g. one listening on
+// an ephemeral port, and blocks until the server is shut down.
+func (s *TLSServer) Serve(l net.Listener) error {
+	if err := s.checkConfig(); err != nil {
+		l.Close()
+		return err
+	}
+	l = tls.NewListener(l, s.Config)
+	s.m.Lock()
+	if s.shutdown {
+		s.m.Unlock()
+		l.Close()
+		return nil
+	}
+	s.listener = l
+	s.m.Unlock()
+
+	if s.NotifyStartedFunc != nil {
+		s.NotifyStartedFunc()
+	}
+	var delay time.Duration // before accepting again after an error
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if s.closed() {
+				return nil
+			}
+			// The listener is open, the error is of the connection being
+			// accepted or of running out of resources such as file
+			// descriptors. Back off as net/http does.
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			s.Logger.Warn("Error accepting DNS-over-TLS connection", "error", err, "retry_in", delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		if !s.track(c, true) {
+			c.Close()
+			continue
+		}
+		go s.serveConn(c)
+	}
+}
+
+// Shutdown stops accepting new connections, closes the existing ones and waits
+// for the queries in flight.
+func (s *TLSServer) Shutdown() error {
+	s.m.Lock()
+	if s.listener == nil {
+		s.m.Unlock()
+		return errors.New("server not started")
+	}
+	err := s.listener.Close()
+	s.shutdown = true
+	for c := range s.conns {
+		c.Close()
+	}
+	s.m.Unlock()
+	s.inFlight.Wait()
+	return err
+}
+
+func (s *TLSServer) checkConfig() error {
+	if s.Config == nil || len(s.Config.Certificates) == 0 {
+		return errors.New("TLS server requires a certificate")
+	}
+	return nil
+}
+
+func (s *TLSServer) closed() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.shutdown
+}
+
+// track adds the connection to the ones closed on shutdown, or removes it. It
+// returns false if the connection is not added as the server is shut down.
+func (s *TLSServer) track(c net.Conn, add bool) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if !add {
+		delete(s.conns, c)
+		return true
+	}
+	if s.shutdown {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+
+// startQuery counts a query in flight, unless the server is shut down, so
+// that Shutdown waits for it.
+func (s *TLSServer) startQuery() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.shutdown {
+		return false
+	}
+	s.inFlight.Add(1)
+	return true
+}
+
+// serveConn reads queries from the connection until the client closes it or
+// the connection stays idle. Queries are handled concurrently, up to
+// MaxInFlight at a time, therefore the responses may be sent out of order
+// (RFC 7766 6.2.1.1).
+func (s *TLSServer) serveConn(c net.Conn) {
+	defer s.track(c, false)
+	defer c.Close()
+
+	max := s.MaxInFlight
+	if max <= 0 {
+		max = defaultTLSMaxInFlight
+	}
+	sem := make(chan struct{}, max)
+	w := &streamWriter{conn: c}
+	for {
+		c.SetReadDeadline(time.Now().Add(tlsIdleTimeout))
+		b, err := readStreamMsg(c)
+		if err != nil {
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(b); err != nil || len(req.Question) == 0 {
+			return // not a DNS client, hang up
+		}
+		sem <- struct{}{}
+		if !s.startQuery() {
+			return
+		}
+		go func() {
+			defer s.inFlight.Done()
+			defer func() { <-sem }()
+			s.Handler.ServeDNS(w, req)
+		}()
+	}
+}
+
+// streamWriter is a dns.ResponseWriter writing length-prefixed messages to a
+// stream connection shared by concurrent queries.
+type streamWriter struct {
+	conn net.Conn
+	m    sync.Mutex
+}
+
+func (w *streamWriter) LocalAddr() net.Addr  { return w.conn.LocalAddr() }
+func (w *streamWriter) RemoteAddr() net.Addr { return w.conn.RemoteAddr() }
+
+func (w *streamWriter) WriteMsg(m *dns.Msg) error {
+	b, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func (w *streamWriter) Write(b []byte) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	w.conn.SetWriteDeadline(time.Now().Add(tlsWriteTimeout))
+	if err := writeStreamMsg(w.conn, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (w *streamWriter) Close() error        { return w.conn.Close() }
+func (w *streamWriter) TsigStatus() error   { return nil }
+func (w *streamWriter) TsigTimersOnly(bool) {}
+func (w *streamWriter) Hijack()             {}
@@ -0,0 +1,369 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ahmetalpbalkan/wagl/rrstore"
+	"github.com/ahmetalpbalkan/wagl/tlsconfig"
+	"github.com/miekg/dns"
+)
+
+func TestTLSServer(t *testing.T) {
+	dir := testCerts(t)
+	defer os.RemoveAll(dir)
+
+	cfg, err := tlsconfig.Server(tlsconfig.Options{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := testTLSServer(t, cfg)
+	defer srv.Shutdown()
+
+	cl := testTLSClient(t, dir, false)
+	r, err := queryTLS(srv.Addr, cl, "api.domain.", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 2 {
+		t.Fatalf("unexpected response: %v", r)
+	}
+}
+
+func TestTLSServer_clientAuth(t *testing.T) {
+	dir := testCerts(t)
+	defer os.RemoveAll(dir)
+
+	cfg, err := tlsconfig.Server(tlsconfig.Options{
+		CAFile:     filepath.Join(dir, "ca.pem"),
+		CertFile:   filepath.Join(dir, "server.pem"),
+		KeyFile:    filepath.Join(dir, "server-key.pem"),
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := testTLSServer(t, cfg)
+	defer srv.Shutdown()
+
+	if _, err := queryTLS(srv.Addr, testTLSClient(t, dir, false), "api.domain.", dns.TypeA); err == nil {
+		t.Fatal("query without client certificate succeeded")
+	}
+	r, err := queryTLS(srv.Addr, testTLSClient(t, dir, true), "api.domain.", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 2 {
+		t.Fatalf("unexpected response: %v", r)
+	}
+}
+
+func TestTLSServer_pipelining(t *testing.T) {
+	dir := testCerts(t)
+	defer os.RemoveAll(dir)
+
+	cfg, err := tlsconfig.Server(tlsconfig.Options{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := testTLSServer(t, cfg)
+	defer srv.Shutdown()
+
+	c, err := tls.Dial("tcp", srv.Addr, testTLSClient(t, dir, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// send all queries before reading any responses
+	ids := make(map[uint16]bool)
+	for _, name := range []string{"api.domain.", "blog.domain.", "nonexistent.domain."} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		b, _ := m.Pack()
+		if err := writeStreamMsg(c, b); err != nil {
+			t.Fatal(err)
+		}
+		ids[m.Id] = true
+	}
+	for range ids {
+		b, err := readStreamMsg(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := new(dns.Msg)
+		if err := r.Unpack(b); err != nil {
+			t.Fatal(err)
+		}
+		if !ids[r.Id] {
+			t.Fatalf("unexpected response id: %d", r.Id)
+		}
+		delete(ids, r.Id)
+	}
+}
+
+func TestTLSServer_maxInFlight(t *testing.T) {
+	dir := testCerts(t)
+	defer os.RemoveAll(dir)
+
+	cfg, err := tlsconfig.Server(tlsconfig.Options{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	release := make(chan struct{})
+	srv := NewTLS("", cfg, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		if running++; running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+		resp := new(dns.Msg)
+		w.WriteMsg(resp.SetReply(r))
+	}))
+	srv.MaxInFlight = 2
+	serveTLS(t, srv)
+	defer srv.Shutdown()
+
+	c, err := tls.Dial("tcp", srv.Addr, testTLSClient(t, dir, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 5; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("api.domain.", dns.TypeA)
+		b, _ := m.Pack()
+		if err := writeStreamMsg(c, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; ; i++ {
+		mu.Lock()
+		n := running
+		mu.Unlock()
+		if n == 2 {
+			break
+		} else if i == 500 {
+			t.Fatalf("expected 2 queries handled at the same time, got: %d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond) // no more queries are handled meanwhile
+	close(release)
+	for i := 0; i < 5; i++ {
+		if _, err := readStreamMsg(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if maxRunning != 2 {
+		t.Fatalf("expected 2 queries handled at the same time, got: %d", maxRunning)
+	}
+}
+
+func TestTLSServer_shutdownWhileQuerying(t *testing.T) {
+	dir := testCerts(t)
+	defer os.RemoveAll(dir)
+
+	cfg, err := tlsconfig.Server(tlsconfig.Options{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := testTLSServer(t, cfg)
+
+	// clients keep connecting and querying while the server shuts down
+	cl := testTLSClient(t, dir, false)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if _, err := queryTLS(srv.Addr, cl, "api.domain.", dns.TypeA); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Shutdown() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown does not return")
+	}
+	wg.Wait()
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if srv.track(c1, true) {
+		t.Fatal("connection is accepted after shutdown")
+	}
+	if srv.startQuery() {
+		t.Fatal("query is handled after shutdown")
+	}
+}
+
+// queryTLS makes a DNS query over TLS.
+func queryTLS(addr string, cfg *tls.Config, domain string, qType uint16) (*dns.Msg, error) {
+	c, err := tls.Dial("tcp", addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(domain), qType)
+	b, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeStreamMsg(c, b); err != nil {
+		return nil, err
+	}
+	if b, err = readStreamMsg(c); err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	return r, r.Unpack(b)
+}
+
+// testTLSServer starts a DNS-over-TLS test server serving internal records.
+func testTLSServer(t *testing.T, cfg *tls.Config) *TLSServer {
+	rr := rrstore.New()
+	rr.Set(1, rrstore.RRs{
+		dns.TypeA: {
+			"api.domain.":  records("10.0.0.1", "10.0.0.2"),
+			"blog.domain.": records("10.0.1.1"),
+		},
+	})
+	h := New("domain", ":0", rr, false, nil).Handler
+	return serveTLS(t, NewTLS("", cfg, h))
+}
+
+// serveTLS starts the server on an ephemeral port, which it sets as the
+// address of the server, and waits until it is listening.
+func serveTLS(t *testing.T, srv *TLSServer) *TLSServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Addr = l.Addr().String()
+	ready := make(chan struct{})
+	srv.NotifyStartedFunc = func() {
+		close(ready)
+	}
+	go srv.Serve(l)
+	<-ready
+	return srv
+}
+
+// testTLSClient gives a client TLS config trusting the test CA, optionally
+// with a client certificate.
+func testTLSClient(t *testing.T, dir string, withCert bool) *tls.Config {
+	opts := tlsconfig.Options{CAFile: filepath.Join(dir, "ca.pem")}
+	if withCert {
+		opts.CertFile = filepath.Join(dir, "client.pem")
+		opts.KeyFile = filepath.Join(dir, "client-key.pem")
+	}
+	cfg, err := tlsconfig.Client(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ServerName = "localhost"
+	return cfg
+}
+
+// testCerts generates a CA, and server and client certificates signed by it
+// into a temporary directory.
+func testCerts(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "wagl-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "wagl test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", caDER)
+
+	for i, name := range []string{"server", "client"} {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		cert := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writePEM(t, filepath.Join(dir, name+".pem"), "CERTIFICATE", der)
+		writePEM(t, filepath.Join(dir, name+"-key.pem"), "EC PRIVATE KEY", keyDER)
+	}
+	return dir
+}
+
+func writePEM(t *testing.T, path, typ string, b []byte) {
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
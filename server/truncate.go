@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// clientNetwork returns the transport ("udp" or "tcp") the client used to send
+// the query.
+func clientNetwork(w dns.ResponseWriter) string {
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// udpSize returns the maximum UDP response size the client of request r can
+// receive, as advertised with EDNS0 or the DNS default of 512 bytes.
+func udpSize(r *dns.Msg) int {
+	if opt := r.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
+
+// truncate removes records from the response m until it fits in size bytes.
+// Additional records are removed first, and if that is not enough, authority
+// and answer records are removed from the end and the TC bit is set (RFC 2181
+// 9). OPT record is always kept.
+func truncate(m *dns.Msg, size int) {
+	if m.Len() <= size {
+		return
+	}
+
+	var opt dns.RR
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			opt = rr
+		}
+	}
+	m.Extra = nil
+	if opt != nil {
+		m.Extra = []dns.RR{opt}
+	}
+	if m.Len() <= size {
+		return
+	}
+
+	m.Truncated = true
+	for len(m.Ns) > 0 && m.Len() > size {
+		m.Ns = m.Ns[:len(m.Ns)-1]
+	}
+	for len(m.Answer) > 0 && m.Len() > size {
+		m.Answer = m.Answer[:len(m.Answer)-1]
+	}
+}
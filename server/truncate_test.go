@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestUDPSize(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	if s := udpSize(m); s != 512 {
+		t.Fatalf("wrong size without EDNS0: %d", s)
+	}
+	m.SetEdns0(256, false)
+	if s := udpSize(m); s != 512 {
+		t.Fatalf("wrong size for small EDNS0 buffer: %d", s)
+	}
+	m.IsEdns0().SetUDPSize(1232)
+	if s := udpSize(m); s != 1232 {
+		t.Fatalf("wrong size for EDNS0 buffer: %d", s)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	msg := func(answers, extras int) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		m.Response = true
+		for i := 0; i < answers; i++ {
+			rr, _ := dns.NewRR(fmt.Sprintf("example.com. 60 IN A 10.0.0.%d", i))
+			m.Answer = append(m.Answer, rr)
+		}
+		for i := 0; i < extras; i++ {
+			rr, _ := dns.NewRR(fmt.Sprintf("ns%d.example.com. 60 IN A 10.0.1.%d", i, i))
+			m.Extra = append(m.Extra, rr)
+		}
+		m.SetEdns0(4096, false)
+		m.Compress = true
+		return m
+	}
+
+	// fits, untouched
+	m := msg(5, 5)
+	truncate(m, 512)
+	if m.Truncated || len(m.Answer) != 5 || len(m.Extra) != 6 {
+		t.Fatalf("message should not be truncated: %v", m)
+	}
+
+	// fits after dropping additional records, no TC
+	m = msg(20, 20)
+	truncate(m, 512)
+	if m.Truncated || len(m.Answer) != 20 || len(m.Extra) != 1 {
+		t.Fatalf("only additional records should be dropped: %v", m)
+	}
+	if m.IsEdns0() == nil {
+		t.Fatal("OPT record is removed")
+	}
+
+	// answers dropped, TC set
+	m = msg(100, 0)
+	truncate(m, 512)
+	if !m.Truncated || len(m.Answer) == 0 || len(m.Answer) >= 100 {
+		t.Fatalf("message should be truncated: %v", m)
+	}
+	if b, _ := m.Pack(); len(b) > 512 {
+		t.Fatalf("truncated message too large: %d bytes", len(b))
+	}
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// nonblockingReader is a dns.Reader putting the UDP socket back in
+// non-blocking mode before reading from it. The dns package sets the options
+// of the socket through its file, which puts the socket in blocking mode.
+// Reads from a blocking socket ignore their deadline and cannot be interrupted
+// by closing it, so shutting down the server would wait for the next query.
+type nonblockingReader struct {
+	dns.Reader
+	once sync.Once
+}
+
+// nonblocking is the dns.DecorateReader of the UDP servers, reading with a
+// nonblockingReader.
+func nonblocking(r dns.Reader) dns.Reader {
+	return &nonblockingReader{Reader: r}
+}
+
+func (r *nonblockingReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	var err error
+	r.once.Do(func() { err = setNonblock(conn) })
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.Reader.ReadUDP(conn, timeout)
+}
+
+// setNonblock puts the socket of the connection in non-blocking mode.
+func setNonblock(conn syscall.Conn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := raw.Control(func(fd uintptr) { serr = syscall.SetNonblock(int(fd), true) }); err != nil {
+		return err
+	}
+	return serr
+}
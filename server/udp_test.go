@@ -0,0 +1,25 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ahmetalpbalkan/wagl/rrstore"
+)
+
+func TestShutdown_udp(t *testing.T) {
+	srv := New("domain", "", rrstore.New(), false, nil)
+	serveEphemeral(t, srv)
+	defer srv.TCP.Shutdown()
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Shutdown() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown is blocked by the reader waiting for a query")
+	}
+}
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ahmetalpbalkan/wagl/tlsconfig"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultDNSPort = "53"
+	defaultTLSPort = "853"
+
+	// upstreamTimeout is the time allotted for an upstream to answer.
+	upstreamTimeout = time.Second * 2
+
+	// tlsPoolSize is the number of persistent connections kept to each
+	// DNS-over-TLS upstream. Queries are pipelined over these connections.
+	tlsPoolSize = 2
+)
+
+// Upstream is an external nameserver to which the queries outside the domain
+// are forwarded.
+type Upstream interface {
+	// Exchange sends the query m to the nameserver over the specified
+	// network ("udp" or "tcp") and returns its response. Nameservers that
+	// have a dedicated transport (such as TLS) ignore the network.
+	Exchange(m *dns.Msg, network string) (*dns.Msg, error)
+
+	// String gives the address of the nameserver.
+	String() string
+}
+
+// ParseUpstream parses a nameserver address in IP[:port] form for plain DNS or
+// tls://IP[:port][#server-name] form for DNS over TLS, where the server name
+// is used to verify the nameserver's certificate (default is the IP). IPv6
+// addresses can be in brackets, which they must be if the port is specified.
+func ParseUpstream(s string) (Upstream, error) {
+	var (
+		useTLS     bool
+		serverName string
+		port       = defaultDNSPort
+	)
+	if strings.HasPrefix(s, "tls://") {
+		useTLS = true
+		port = defaultTLSPort
+		s = strings.TrimPrefix(s, "tls://")
+		if i := strings.Index(s, "#"); i >= 0 {
+			s, serverName = s[:i], s[i+1:]
+		}
+	}
+
+	host := s
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		host, port = h, p
+	} else if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		host = s[1 : len(s)-1] // IPv6 address without a port
+	}
+	// Make sure hostname is IP (do not support domain names as nameservers)
+	if ip := net.ParseIP(host); ip == nil {
+		return nil, fmt.Errorf("Nameserver is not an IP address: '%s'", host)
+	}
+	addr := net.JoinHostPort(host, port)
+
+	if !useTLS {
+		return &plainUpstream{addr}, nil
+	}
+	if serverName == "" {
+		serverName = host
+	}
+	cfg := tlsconfig.ClientDefault.Clone()
+	cfg.ServerName = serverName
+	return newTLSUpstream(addr, cfg), nil
+}
+
+// transport gives the address of the nameserver in host:port form and the
+// network ("udp", "tcp" or "tls") a query sent over network is exchanged over.
+func transport(ns Upstream, network string) (string, string) {
+	switch u := ns.(type) {
+	case *plainUpstream:
+		return u.addr, network
+	case *tlsUpstream:
+		return u.addr, "tls"
+	}
+	return ns.String(), network
+}
+
+// plainUpstream is a nameserver queried over UDP or TCP.
+type plainUpstream struct {
+	addr string
+}
+
+func (u *plainUpstream) String() string { return u.addr }
+
+func (u *plainUpstream) Exchange(m *dns.Msg, network string) (*dns.Msg, error) {
+	c := &dns.Client{Net: network}
+	in, _, err := c.Exchange(m, u.addr)
+	return in, err
+}
+
+// tlsUpstream is a nameserver queried over TLS using a pool of persistent
+// connections.
+type tlsUpstream struct {
+	addr   string
+	config *tls.Config
+
+	m     sync.Mutex
+	conns []*pipeConn
+	dials []*tlsDial // dials in progress to replace the connections
+	next  int
+}
+
+// tlsDial is a dial in progress, which the queries needing its connection
+// wait for instead of dialing again.
+type tlsDial struct {
+	done chan struct{} // closed once c or err is set
+	c    *pipeConn
+	err  error
+}
+
+func newTLSUpstream(addr string, config *tls.Config) *tlsUpstream {
+	return &tlsUpstream{
+		addr:   addr,
+		config: config,
+		conns:  make([]*pipeConn, tlsPoolSize),
+		dials:  make([]*tlsDial, tlsPoolSize),
+	}
+}
+
+func (u *tlsUpstream) String() string {
+	return "tls://" + u.addr + "#" + u.config.ServerName
+}
+
+func (u *tlsUpstream) Exchange(m *dns.Msg, network string) (*dns.Msg, error) {
+	c, err := u.conn()
+	if err != nil {
+		return nil, err
+	}
+	return c.exchange(m, upstreamTimeout)
+}
+
+// conn picks the next connection from the pool in a round robin fashion and
+// replaces it with a new one if it is broken. Dialing is done without holding
+// the lock, so that a slow nameserver does not hold up the queries over the
+// other connections.
+func (u *tlsUpstream) conn() (*pipeConn, error) {
+	u.m.Lock()
+	i := u.next
+	u.next = (u.next + 1) % len(u.conns)
+	if c := u.conns[i]; c != nil && !c.isClosed() {
+		u.m.Unlock()
+		return c, nil
+	}
+	if d := u.dials[i]; d != nil {
+		u.m.Unlock()
+		<-d.done
+		return d.c, d.err
+	}
+	d := &tlsDial{done: make(chan struct{})}
+	u.dials[i] = d
+	u.m.Unlock()
+
+	nc, err := tls.DialWithDialer(&net.Dialer{Timeout: upstreamTimeout}, "tcp", u.addr, u.config)
+	if err != nil {
+		d.err = err
+	} else {
+		d.c = newPipeConn(nc)
+	}
+
+	u.m.Lock()
+	u.dials[i] = nil
+	if d.c != nil {
+		u.conns[i] = d.c
+	}
+	u.m.Unlock()
+	close(d.done)
+	return d.c, d.err
+}
+
+var (
+	errConnClosed = errors.New("connection to nameserver closed")
+	errIDsInUse   = errors.New("too many queries in flight to nameserver")
+)
+
+// pipeConn is a stream connection to a nameserver over which multiple queries
+// can be sent without waiting for the responses (RFC 7766 6.2.1.1). Since
+// queries from different clients may have the same message ID, queries are
+// sent with IDs unique to the connection and mapped back upon response.
+type pipeConn struct {
+	conn net.Conn
+
+	wm sync.Mutex // serializes writes
+
+	m       sync.Mutex
+	pending map[uint16]chan []byte
+	lastID  uint16
+	err     error
+}
+
+func newPipeConn(c net.Conn) *pipeConn {
+	p := &pipeConn{
+		conn:    c,
+		pending: make(map[uint16]chan []byte),
+	}
+	go p.readLoop()
+	return p
+}
+
+func (p *pipeConn) isClosed() bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.err != nil
+}
+
+// exchange sends the query and waits for its response.
+func (p *pipeConn) exchange(m *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	b, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan []byte, 1)
+	p.m.Lock()
+	if p.err != nil {
+		p.m.Unlock()
+		return nil, p.err
+	}
+	if len(p.pending) > 0xffff {
+		p.m.Unlock()
+		return nil, errIDsInUse
+	}
+	id := p.lastID
+	for {
+		id++
+		if _, inUse := p.pending[id]; !inUse {
+			break
+		}
+	}
+	p.lastID = id
+	p.pending[id] = ch
+	p.m.Unlock()
+	defer func() {
+		p.m.Lock()
+		delete(p.pending, id)
+		p.m.Unlock()
+	}()
+
+	binary.BigEndian.PutUint16(b, id)
+	p.wm.Lock()
+	p.conn.SetWriteDeadline(time.Now().Add(timeout))
+	err = writeStreamMsg(p.conn, b)
+	p.wm.Unlock()
+	if err != nil {
+		p.close(err)
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, p.closeErr()
+		}
+		r := new(dns.Msg)
+		if err := r.Unpack(resp); err != nil {
+			return nil, err
+		}
+		r.Id = m.Id
+		return r, nil
+	case <-time.After(timeout):
+		return nil, errors.New("timed out waiting for nameserver response")
+	}
+}
+
+// readLoop dispatches the responses to the waiting queries until the
+// connection is closed.
+func (p *pipeConn) readLoop() {
+	for {
+		b, err := readStreamMsg(p.conn)
+		if err != nil {
+			p.close(err)
+			return
+		}
+		if len(b) < 2 {
+			continue
+		}
+		id := binary.BigEndian.Uint16(b)
+		p.m.Lock()
+		ch := p.pending[id]
+		delete(p.pending, id)
+		p.m.Unlock()
+		if ch != nil {
+			ch <- b
+		}
+	}
+}
+
+// close closes the connection and fails the pending queries.
+func (p *pipeConn) close(err error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.err != nil {
+		return
+	}
+	p.err = errConnClosed
+	if err != nil {
+		p.err = fmt.Errorf("%v: %v", errConnClosed, err)
+	}
+	p.conn.Close()
+	for id, ch := range p.pending {
+		close(ch)
+		delete(p.pending, id)
+	}
+}
+
+func (p *pipeConn) closeErr() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.err
+}
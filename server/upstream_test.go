@@ -0,0 +1,222 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ahmetalpbalkan/wagl/tlsconfig"
+	"github.com/miekg/dns"
+)
+
+func TestParseUpstream(t *testing.T) {
+	cases := []struct {
+		in       string
+		expected string
+		isTLS    bool
+		bad      bool
+	}{
+		{"8.8.8.8", "8.8.8.8:53", false, false},
+		{"8.8.8.8:5353", "8.8.8.8:5353", false, false},
+		{"2001:4860:4860::8888", "[2001:4860:4860::8888]:53", false, false},
+		{"[2001:4860:4860::8888]:5353", "[2001:4860:4860::8888]:5353", false, false},
+		{"[2001:4860:4860::8888]", "[2001:4860:4860::8888]:53", false, false},
+		{"tls://1.1.1.1", "tls://1.1.1.1:853#1.1.1.1", true, false},
+		{"tls://1.1.1.1:853#cloudflare-dns.com", "tls://1.1.1.1:853#cloudflare-dns.com", true, false},
+		{"tls://1.1.1.1#cloudflare-dns.com", "tls://1.1.1.1:853#cloudflare-dns.com", true, false},
+		{"tls://[2606:4700::1111]#cloudflare-dns.com", "tls://[2606:4700::1111]:853#cloudflare-dns.com", true, false},
+		{"tls://[2606:4700::1111]", "tls://[2606:4700::1111]:853#2606:4700::1111", true, false},
+		{"google-public-dns-a.google.com", "", false, true},
+		{"tls://cloudflare-dns.com", "", false, true},
+		{"[8.8.8.8", "", false, true},
+	}
+	for _, c := range cases {
+		u, err := ParseUpstream(c.in)
+		if c.bad {
+			if err == nil {
+				t.Fatalf("expected error for %q", c.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", c.in, err)
+		}
+		if u.String() != c.expected {
+			t.Fatalf("wrong address for %q. expected=%q got=%q", c.in, c.expected, u.String())
+		}
+		if _, ok := u.(*tlsUpstream); ok != c.isTLS {
+			t.Fatalf("wrong upstream type for %q: %T", c.in, u)
+		}
+	}
+}
+
+func TestTLSUpstream(t *testing.T) {
+	dir := testCerts(t)
+	defer os.RemoveAll(dir)
+
+	cfg, err := tlsconfig.Server(tlsconfig.Options{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := testTLSServer(t, cfg)
+	defer srv.Shutdown()
+
+	u := newTLSUpstream(srv.Addr, testTLSClient(t, dir, false))
+
+	// pipeline concurrent queries with the same message ID over the pool
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name, answers := "api.domain.", 2
+			if i%2 == 0 {
+				name, answers = "blog.domain.", 1
+			}
+			m := new(dns.Msg)
+			m.SetQuestion(name, dns.TypeA)
+			m.Id = 42
+			r, err := u.Exchange(m, "tcp")
+			if err != nil {
+				errs <- err
+				return
+			}
+			if r.Id != 42 || len(r.Answer) != answers || r.Question[0].Name != name {
+				t.Errorf("unexpected response for %s: %v", name, r)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	u.m.Lock()
+	n := 0
+	for _, c := range u.conns {
+		if c != nil {
+			n++
+		}
+	}
+	u.m.Unlock()
+	if n != tlsPoolSize {
+		t.Fatalf("wrong number of pooled connections: %d", n)
+	}
+}
+
+func TestTLSUpstream_reconnects(t *testing.T) {
+	dir := testCerts(t)
+	defer os.RemoveAll(dir)
+
+	cfg, err := tlsconfig.Server(tlsconfig.Options{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := testTLSServer(t, cfg)
+	defer srv.Shutdown()
+
+	u := newTLSUpstream(srv.Addr, testTLSClient(t, dir, false))
+	m := new(dns.Msg)
+	m.SetQuestion("api.domain.", dns.TypeA)
+	for i := 0; i < tlsPoolSize; i++ {
+		if _, err := u.Exchange(m, "tcp"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// server hangs up on the pooled connections
+	srv.m.Lock()
+	for c := range srv.conns {
+		c.Close()
+	}
+	srv.m.Unlock()
+
+	// broken connections are detected and replaced
+	var err2 error
+	for i := 0; i < tlsPoolSize*2; i++ {
+		if _, err2 = u.Exchange(m, "tcp"); err2 == nil {
+			break
+		}
+	}
+	if err2 != nil {
+		t.Fatalf("could not recover from closed connections: %v", err2)
+	}
+}
+
+func TestTLSUpstream_dialsWithoutLock(t *testing.T) {
+	// nameserver accepting connections but never completing the handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			accepted <- c
+		}
+	}()
+
+	u := newTLSUpstream(l.Addr().String(), &tls.Config{ServerName: "localhost"})
+	m := new(dns.Msg)
+	m.SetQuestion("api.domain.", dns.TypeA)
+	go u.Exchange(m, "tcp")
+	c := <-accepted
+	defer c.Close()
+	if !u.m.TryLock() {
+		t.Fatal("pool is locked while dialing")
+	}
+	u.m.Unlock()
+}
+
+func TestPipeConn_idsInUse(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	p := newPipeConn(c1)
+	defer p.close(nil)
+	for id := 0; id <= 0xffff; id++ {
+		p.pending[uint16(id)] = make(chan []byte, 1)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("api.domain.", dns.TypeA)
+	if _, err := p.exchange(m, time.Second); err != errIDsInUse {
+		t.Fatalf("expected error when all the IDs are in use, got: %v", err)
+	}
+}
+
+func TestTLSUpstream_verifiesServerName(t *testing.T) {
+	dir := testCerts(t)
+	defer os.RemoveAll(dir)
+
+	cfg, err := tlsconfig.Server(tlsconfig.Options{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := testTLSServer(t, cfg)
+	defer srv.Shutdown()
+
+	cl := testTLSClient(t, dir, false)
+	cl.ServerName = "dns.example.com"
+	u := newTLSUpstream(srv.Addr, cl)
+
+	m := new(dns.Msg)
+	m.SetQuestion("api.domain.", dns.TypeA)
+	if _, err := u.Exchange(m, "tcp"); err == nil {
+		t.Fatal("expected certificate verification error")
+	}
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ahmetalpbalkan/wagl/rrstore"
+	"github.com/miekg/dns"
+)
+
+// logChanges logs the changes in the DNS records until ch is closed. Changed
+// records are logged at debug level.
+func logChanges(logger *slog.Logger, ch <-chan rrstore.Diff) {
+	for d := range ch {
+		logger.Info("DNS records changed", "diff", d.String())
+		for _, l := range [][]rrstore.Change{d.Added, d.Removed, d.Changed} {
+			for _, c := range l {
+				for _, r := range c.Added {
+					logger.Debug("DNS record added", "rr", formatRecord(c, r))
+				}
+				for _, r := range c.Removed {
+					logger.Debug("DNS record removed", "rr", formatRecord(c, r))
+				}
+			}
+		}
+	}
+}
+
+// formatRecord formats a changed record as "TYPE name value".
+func formatRecord(c rrstore.Change, r rrstore.Record) string {
+	rr := r.RR()
+	val := strings.TrimPrefix(rr.String(), rr.Header().String())
+	return dns.TypeToString[c.Type] + " " + c.Name + " " + val
+}
+
+// loadSnapshot loads the records saved to path into rr unless they are older
+// than maxAge, and returns the time until which they can be served.
+func loadSnapshot(logger *slog.Logger, rr rrstore.RRWriter, path string, maxAge time.Duration) time.Time {
+	gen, rl, saved, err := rrstore.ReadFile(path)
+	if os.IsNotExist(err) {
+		logger.Info("No saved DNS records found", "file", path)
+		return time.Time{}
+	} else if err != nil {
+		logger.Error("Error loading saved DNS records", "file", path, "error", err)
+		return time.Time{}
+	}
+	age := time.Since(saved)
+	if age > maxAge {
+		logger.Warn("Not serving saved DNS records, they are too old", "file", path, "age", age, "max_age", maxAge)
+		return time.Time{}
+	}
+	if err := rr.Set(gen, rl); err != nil {
+		logger.Error("Error loading saved DNS records", "file", path, "error", err)
+		return time.Time{}
+	}
+	logger.Info("Serving saved DNS records until records are refreshed", "file", path, "age", age)
+	return saved.Add(maxAge)
+}
+
+// saveSnapshot saves the records in rr to path, unless there are none yet.
+func saveSnapshot(logger *slog.Logger, rr rrstore.RRReader, path string) error {
+	gen, rl := rr.Records()
+	if gen == 0 {
+		return nil
+	}
+	if err := rrstore.WriteFile(path, gen, rl); err != nil {
+		return fmt.Errorf("error saving records: %v", err)
+	}
+	logger.Info("Saved DNS records", "file", path)
+	return nil
+}
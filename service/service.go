@@ -0,0 +1,503 @@
+// Package service runs the DNS service discovery of wagl: it keeps the DNS
+// records of a domain in sync with the tasks in a cluster and serves them,
+// forwarding the other queries to external nameservers. It is what the wagl
+// command runs, and can be embedded in other programs:
+//
+//	svc, err := service.New(service.Options{
+//		Domain:  "swarm.",
+//		Addr:    ":53",
+//		Cluster: driver,
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	return svc.Run(ctx) // until ctx is done
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ahmetalpbalkan/wagl/admin"
+	"github.com/ahmetalpbalkan/wagl/clusterdns"
+	"github.com/ahmetalpbalkan/wagl/clusterdns/staleness"
+	"github.com/ahmetalpbalkan/wagl/health"
+	"github.com/ahmetalpbalkan/wagl/metrics"
+	"github.com/ahmetalpbalkan/wagl/rrstore"
+	"github.com/ahmetalpbalkan/wagl/server"
+	"github.com/ahmetalpbalkan/wagl/server/dnstap"
+	"github.com/ahmetalpbalkan/wagl/server/rrl"
+)
+
+const (
+	DefaultDomain            = "swarm."
+	DefaultAddr              = ":53"
+	DefaultRefreshInterval   = time.Second * 15
+	DefaultRefreshTimeout    = time.Second * 10
+	DefaultRefreshMaxBackoff = time.Minute
+	DefaultStaleness         = time.Second * 60
+	DefaultSnapshotMaxAge    = time.Hour
+	DefaultShutdownTimeout   = time.Second * 10
+	DefaultMetricsInterval   = time.Second * 10
+
+	healthProbeTimeout = time.Second
+)
+
+// BeforeSync determines how the names in the domain are answered until the
+// records are first synced with the cluster.
+type BeforeSync string
+
+const (
+	BeforeSyncServFail BeforeSync = "servfail" // answer SERVFAIL
+	BeforeSyncWait     BeforeSync = "wait"     // do not listen for queries
+	BeforeSyncServe    BeforeSync = "serve"    // answer from the empty records (NXDOMAIN)
+)
+
+// Options configure a Service. Zero values are replaced with the defaults.
+type Options struct {
+	// Domain is the DNS domain (FQDN suffix) the service is authoritative
+	// for.
+	Domain string
+
+	// Addr is the host:port the DNS server listens on over UDP and TCP. If
+	// the port is 0, a free one is picked, given by Service.Addr.
+	Addr string
+
+	// TLSAddr and DoHAddr are the host:port DNS-over-TLS and
+	// DNS-over-HTTPS are served on using TLSConfig, if set.
+	TLSAddr   string
+	DoHAddr   string
+	TLSConfig *tls.Config
+
+	// Cluster provides the tasks the records are generated from. It is
+	// required.
+	Cluster clusterdns.ClusterDriver
+
+	// Config is the initial configuration, which can be changed while
+	// running with SetConfig.
+	Config Config
+
+	// RefreshInterval is how frequently the records are synced with the
+	// cluster, RefreshTimeout the time allotted to list the tasks and
+	// RefreshMaxBackoff the maximum time between syncs after consecutive
+	// failures.
+	RefreshInterval   time.Duration
+	RefreshTimeout    time.Duration
+	RefreshMaxBackoff time.Duration
+
+	// Staleness is how long the records can go without a sync before they
+	// are stale, and StalePolicy what happens then. With staleness.Exit,
+	// the default, Run returns an error.
+	Staleness   time.Duration
+	StalePolicy staleness.Policy
+
+	// BeforeSync determines how the names in the domain are answered until
+	// the records are first synced, BeforeSyncServFail by default.
+	BeforeSync BeforeSync
+
+	// SnapshotFile is the file the records are saved to after every sync
+	// and served from on startup until the cluster is reachable, unless
+	// they are older than SnapshotMaxAge. With SnapshotOnExit, the records
+	// are also saved when Run returns after ctx is done.
+	SnapshotFile   string
+	SnapshotMaxAge time.Duration
+	SnapshotOnExit bool
+
+	// ShutdownTimeout is the time allotted for the queries in flight to be
+	// answered and the listeners to shut down once ctx is done. Negative
+	// value means they are not waited for.
+	ShutdownTimeout time.Duration
+
+	// RRL rate limits the responses over UDP, if its ResponsesPerSecond is
+	// set.
+	RRL rrl.Config
+
+	// Tap records the client and forwarded queries as dnstap messages, if
+	// set. Its output is not closed.
+	Tap *dnstap.Tap
+
+	// Logger logs the events of the service, slog.Default() if nil.
+	Logger *slog.Logger
+
+	// Registry is the registry the metrics of the service are created in,
+	// a new one if nil. As the names of the metrics must be unique, it
+	// cannot be shared by several services.
+	Registry *metrics.Registry
+
+	// Metrics receives the metrics in the Registry every MetricsInterval
+	// while running and once more on shutdown, if set.
+	Metrics         metrics.Sink
+	MetricsInterval time.Duration
+}
+
+// Config is the configuration of a Service that can be changed while it is
+// running with SetConfig.
+type Config struct {
+	// Server is the configuration of the DNS server: the external
+	// nameservers, the forward zones and the ACLs.
+	Server server.Config
+
+	// Records is the configuration of the records: their TTL and the
+	// static records served in addition to the ones of the tasks.
+	Records clusterdns.Config
+}
+
+// Service keeps the DNS records in sync with the cluster and serves them.
+type Service struct {
+	opts    Options
+	logger  *slog.Logger
+	rrs     rrstore.RRStore
+	tracker *staleness.Tracker
+	dns     *clusterdns.ClusterDNS
+	srv     *server.DnsServer
+	loaded  bool // records are loaded from the snapshot file
+
+	m          sync.Mutex
+	started    bool
+	refreshing bool
+}
+
+// New creates a Service with the specified options, serving the records saved
+// to the snapshot file, if any, once it runs.
+func New(opts Options) (*Service, error) {
+	opts = opts.withDefaults()
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	s := &Service{
+		opts:    opts,
+		logger:  opts.Logger,
+		rrs:     rrstore.New(),
+		tracker: staleness.New(opts.Staleness),
+	}
+	if opts.SnapshotFile != "" {
+		until := loadSnapshot(s.logger, s.rrs, opts.SnapshotFile, opts.SnapshotMaxAge)
+		s.tracker.FreshUntil(until)
+		s.loaded = !until.IsZero()
+	}
+
+	s.dns = clusterdns.New(opts.Domain, s.rrs, opts.Cluster)
+	s.dns.SeedGeneration(s.rrs.Generation())
+	s.dns.SnapshotFile = opts.SnapshotFile
+	s.dns.Logger = s.logger
+	s.dns.Metrics = clusterdns.NewMetrics(opts.Registry)
+	s.dns.SetConfig(opts.Config.Records)
+
+	cfg := opts.Config.Server
+	s.srv = server.New(opts.Domain, opts.Addr, s.rrs, cfg.Recurse, cfg.Nameservers)
+	s.srv.Logger = s.logger
+	s.srv.Metrics = server.NewMetrics(opts.Registry)
+	s.srv.SetConfig(cfg)
+	if opts.Tap != nil {
+		s.srv.Tap = opts.Tap
+	}
+	return s, nil
+}
+
+func (o Options) withDefaults() Options {
+	if o.Domain == "" {
+		o.Domain = DefaultDomain
+	}
+	if o.Addr == "" {
+		o.Addr = DefaultAddr
+	}
+	if o.RefreshInterval == 0 {
+		o.RefreshInterval = DefaultRefreshInterval
+	}
+	if o.RefreshTimeout == 0 {
+		o.RefreshTimeout = DefaultRefreshTimeout
+	}
+	if o.RefreshMaxBackoff == 0 {
+		o.RefreshMaxBackoff = DefaultRefreshMaxBackoff
+	}
+	if o.Staleness == 0 {
+		o.Staleness = DefaultStaleness
+	}
+	if o.StalePolicy == "" {
+		o.StalePolicy = staleness.Exit
+	}
+	if o.BeforeSync == "" {
+		o.BeforeSync = BeforeSyncServFail
+	}
+	if o.SnapshotMaxAge == 0 {
+		o.SnapshotMaxAge = DefaultSnapshotMaxAge
+	}
+	if o.ShutdownTimeout == 0 {
+		o.ShutdownTimeout = DefaultShutdownTimeout
+	}
+	if o.MetricsInterval == 0 {
+		o.MetricsInterval = DefaultMetricsInterval
+	}
+	if o.Logger == nil {
+		o.Logger = slog.Default()
+	}
+	if o.Registry == nil {
+		o.Registry = metrics.NewRegistry()
+	}
+	return o
+}
+
+func (o Options) validate() error {
+	if o.Cluster == nil {
+		return errors.New("No cluster driver specified")
+	}
+	if (o.TLSAddr != "" || o.DoHAddr != "") && o.TLSConfig == nil {
+		return errors.New("DNS-over-TLS or DNS-over-HTTPS address specified; but not TLS config")
+	}
+	if o.RefreshTimeout >= o.RefreshInterval {
+		return fmt.Errorf("Refresh timeout (%v) should be less than refresh interval (%v)", o.RefreshTimeout, o.RefreshInterval)
+	}
+	if o.RefreshMaxBackoff < o.RefreshInterval {
+		return fmt.Errorf("Refresh max backoff (%v) should not be less than refresh interval (%v)", o.RefreshMaxBackoff, o.RefreshInterval)
+	}
+	if _, err := staleness.ParsePolicy(string(o.StalePolicy)); err != nil {
+		return err
+	}
+	switch o.BeforeSync {
+	case BeforeSyncServFail, BeforeSyncWait, BeforeSyncServe:
+	default:
+		return fmt.Errorf("Unknown before sync value: '%s'", o.BeforeSync)
+	}
+	if o.SnapshotOnExit && o.SnapshotFile == "" {
+		return errors.New("Snapshot on exit specified; but not snapshot file")
+	}
+	return nil
+}
+
+// SetConfig replaces the configuration of the service. The records are synced
+// right away to apply their configuration if the service is running.
+func (s *Service) SetConfig(c Config) {
+	s.srv.SetConfig(c.Server)
+	s.dns.SetConfig(c.Records)
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.refreshing {
+		s.dns.Refresh()
+	}
+}
+
+// Addr returns the address the DNS server listens on over UDP and TCP once the
+// service runs, with the port picked if the one of Options.Addr is 0.
+func (s *Service) Addr() string {
+	return s.srv.Addr()
+}
+
+// Synced returns a channel that is closed once the records are synced with the
+// cluster for the first time.
+func (s *Service) Synced() <-chan struct{} {
+	return s.dns.Ready()
+}
+
+// Listening returns if the DNS server has started listening for queries over
+// both UDP and TCP.
+func (s *Service) Listening() bool {
+	return s.srv.Listening()
+}
+
+// HealthHandler gives the HTTP handler serving /healthz and /readyz for the
+// service.
+func (s *Service) HealthHandler() http.Handler {
+	return health.NewHandler(s.tracker, s.srv.Listening, func() error {
+		return server.Probe(s.Addr(), s.opts.Domain, healthProbeTimeout)
+	})
+}
+
+// MetricsHandler gives the HTTP handler serving the metrics of the service to
+// Prometheus.
+func (s *Service) MetricsHandler() http.Handler {
+	return s.opts.Registry
+}
+
+// AdminHandler gives the HTTP handler serving the admin API of the service,
+// which must be protected by the caller, e.g. with admin.RequireToken.
+func (s *Service) AdminHandler() http.Handler {
+	return admin.NewHandler(s.rrs, s.dns, s.tracker, s.opts.StalePolicy)
+}
+
+// Run syncs the records and serves them until ctx is done, then shuts down
+// gracefully and returns nil. It returns an error once shut down if a DNS
+// server fails, or if the records go stale with the staleness.Exit policy.
+// Run can be called only once.
+func (s *Service) Run(ctx context.Context) error {
+	s.m.Lock()
+	if s.started {
+		s.m.Unlock()
+		return errors.New("service is already running")
+	}
+	s.started = true
+	s.m.Unlock()
+
+	o := s.opts
+	sd := &shutdown{logger: s.logger, timeout: o.ShutdownTimeout, drainer: new(server.Drainer)}
+
+	// Failures stop the service, the first one is returned.
+	failed := make(chan error, 1)
+	fail := func(err error) {
+		select {
+		case failed <- err:
+		default:
+		}
+	}
+
+	cancel := make(chan struct{})
+	go logChanges(s.logger, s.rrs.Watch(cancel))
+
+	errCh, okCh := s.dns.StartRefreshing(o.RefreshInterval, o.RefreshTimeout, o.RefreshMaxBackoff, cancel)
+	s.m.Lock()
+	s.refreshing = true
+	s.m.Unlock()
+	s.dns.Refresh() // do not wait an interval for the first refresh
+	sd.closer(func() error {
+		close(cancel)
+		<-s.dns.Stopped()
+		return nil
+	})
+	go s.watch(errCh, okCh, cancel, fail)
+
+	if o.Metrics != nil {
+		go s.collectMetrics(cancel)
+		sd.closer(func() error {
+			o.Registry.Collect(o.Metrics)
+			return nil
+		})
+	}
+
+	h := s.srv.Handler
+	if !s.loaded {
+		switch o.BeforeSync {
+		case BeforeSyncServFail:
+			h = s.dns.Handler(h)
+		case BeforeSyncWait:
+			s.logger.Info("Waiting for records to be refreshed before listening")
+			select {
+			case <-s.dns.Ready():
+			case err := <-failed:
+				return s.stop(sd, err)
+			case <-ctx.Done():
+				return s.stop(sd, nil)
+			}
+		}
+	}
+	h = s.tracker.Handler(o.StalePolicy, o.Domain, h)
+	h = rrl.New(o.RRL).Handler(h)
+	h = sd.drainer.Handler(h)
+	h = s.srv.Metrics.Instrument(o.Domain, h)
+	s.srv.Handler = o.Tap.Handler(h, 0)
+
+	if err := s.srv.Listen(); err != nil {
+		return s.stop(sd, fmt.Errorf("DNS server: %v", err))
+	}
+
+	// Servers stopping other than by shutting down are failures.
+	run := func(f func() error, name string) {
+		go func() {
+			if err := f(); err != nil {
+				fail(fmt.Errorf("%s stopped: %v", name, err))
+			} else {
+				fail(fmt.Errorf("%s stopped", name))
+			}
+		}()
+	}
+	if o.TLSAddr != "" {
+		tlsSrv := server.NewTLS(o.TLSAddr, o.TLSConfig, o.Tap.Handler(h, dnstap.DOT))
+		tlsSrv.Logger = s.logger
+		run(tlsSrv.ListenAndServe, "DNS-over-TLS server")
+		sd.listener(withContext(tlsSrv.Shutdown))
+	}
+	if o.DoHAddr != "" {
+		dohSrv := server.NewDoH(o.DoHAddr, o.TLSConfig, o.Tap.Handler(h, dnstap.DOH))
+		s.logger.Info("DNS-over-HTTPS server started listening", "addr", o.DoHAddr)
+		run(func() error { return dohSrv.ListenAndServeTLS("", "") }, "DNS-over-HTTPS server")
+		sd.listener(dohSrv.Shutdown)
+	}
+	run(s.srv.ListenAndServeTCP, "DNS server (tcp)")
+	run(s.srv.ListenAndServe, "DNS server (udp)")
+	sd.listener(withContext(s.srv.TCP.Shutdown))
+	sd.listener(withContext(s.srv.Shutdown))
+
+	select {
+	case err := <-failed:
+		return s.stop(sd, err)
+	case <-ctx.Done():
+		return s.stop(sd, nil)
+	}
+}
+
+// stop shuts down the service and returns err, the reason it is stopped. The
+// records are saved on a graceful shutdown if configured.
+func (s *Service) stop(sd *shutdown, err error) error {
+	sd.run()
+	if err == nil && s.opts.SnapshotOnExit {
+		err = saveSnapshot(s.logger, s.rrs, s.opts.SnapshotFile)
+	}
+	return err
+}
+
+// watch logs the results of the syncs and acts on stale records as the policy
+// specifies until cancel is closed. With the exit policy, we prefer
+// consistency over liveliness/availability and fail the service.
+func (s *Service) watch(errCh <-chan error, okCh <-chan struct{}, cancel <-chan struct{}, fail func(error)) {
+	o := s.opts
+	var stale = false
+
+	// Refreshes are less frequent while backing off, check staleness in
+	// between as well.
+	check := time.NewTicker(o.RefreshInterval)
+	defer check.Stop()
+
+	for {
+		if st := s.tracker.Stale(); st && o.StalePolicy == staleness.Exit {
+			fail(fmt.Errorf("records are stale, not refreshed within %v (last success: %s)", o.Staleness, lastSuccess(s.tracker)))
+			return
+		} else if st != stale {
+			stale = st
+			if stale {
+				s.logger.Warn("Records are stale", "policy", o.StalePolicy, "staleness", o.Staleness, "last_success", lastSuccess(s.tracker))
+			} else {
+				s.logger.Info("Records are no longer stale")
+			}
+		}
+
+		select {
+		case err := <-errCh:
+			s.logger.Error("Refresh error", "failures", s.dns.Status().Failures, "error", err)
+		case <-okCh:
+			s.tracker.Success()
+			s.logger.Info("Successfully refreshed records")
+		case <-check.C:
+		case <-cancel:
+			return
+		}
+	}
+}
+
+// collectMetrics sends the metrics to the sink every interval until cancel is
+// closed.
+func (s *Service) collectMetrics(cancel <-chan struct{}) {
+	t := time.NewTicker(s.opts.MetricsInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.opts.Registry.Collect(s.opts.Metrics)
+		case <-cancel:
+			return
+		}
+	}
+}
+
+// lastSuccess describes the time records are last refreshed.
+func lastSuccess(t *staleness.Tracker) string {
+	if last := t.LastSuccess(); !last.IsZero() {
+		return last.String()
+	}
+	return "never"
+}
@@ -0,0 +1,231 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ahmetalpbalkan/wagl/clusterdns"
+	"github.com/ahmetalpbalkan/wagl/clusterdns/clusterdnstest"
+	"github.com/ahmetalpbalkan/wagl/rrstore"
+	"github.com/miekg/dns"
+)
+
+// testAddr is the address of the services tested, on a port picked when they
+// run.
+const testAddr = "127.0.0.1:0"
+
+// start runs the service in the background until the returned function is
+// called, which returns the error returned by Run.
+func start(t *testing.T, s *Service) func() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	return func() error {
+		cancel()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("service is not shut down")
+			return nil
+		}
+	}
+}
+
+func waitListening(t *testing.T, s *Service) {
+	for i := 0; !s.Listening(); i++ {
+		if i == 100 {
+			t.Fatal("service is not listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func query(t *testing.T, s *Service, name string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	resp, err := dns.Exchange(m, s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestNew_errors(t *testing.T) {
+	cases := []struct {
+		opts     Options
+		expected string
+	}{
+		{Options{}, "No cluster driver"},
+		{Options{Cluster: clusterdnstest.New(nil, nil), TLSAddr: ":853"}, "TLS config"},
+		{Options{Cluster: clusterdnstest.New(nil, nil), RefreshInterval: time.Second, RefreshTimeout: time.Second}, "Refresh timeout"},
+		{Options{Cluster: clusterdnstest.New(nil, nil), BeforeSync: "never"}, "before sync"},
+		{Options{Cluster: clusterdnstest.New(nil, nil), SnapshotOnExit: true}, "Snapshot on exit"},
+	}
+	for _, c := range cases {
+		if _, err := New(c.opts); err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("%+v: expected error containing %q, got: %v", c.opts, c.expected, err)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshot := filepath.Join(dir, "records")
+
+	s, err := New(Options{
+		Domain:         "swarm.",
+		Addr:           testAddr,
+		Cluster:        clusterdnstest.New(clusterdnstest.APITasks("10.0.0.1"), nil),
+		SnapshotFile:   snapshot,
+		SnapshotOnExit: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := start(t, s)
+	select {
+	case <-s.Synced():
+	case <-time.After(5 * time.Second):
+		t.Fatal("records are not synced")
+	}
+	waitListening(t, s)
+
+	resp := query(t, s, "api.swarm.")
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Fatalf("wrong answer: %v", resp)
+	}
+	if _, port, _ := net.SplitHostPort(s.Addr()); port == "0" {
+		t.Fatalf("address of the DNS server is not given: %s", s.Addr())
+	}
+	for i := 0; ; i++ { // the refresh is tracked once the records are synced
+		w := httptest.NewRecorder()
+		s.HealthHandler().ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+		if w.Code == 200 {
+			break
+		} else if i == 100 {
+			t.Fatalf("service is not ready: %s", w.Body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	w := httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if m := `wagl_dns_queries_total{qtype="A",rcode="NOERROR",scope="internal"} 1`; !strings.Contains(w.Body.String(), m) {
+		t.Fatalf("metrics of the service do not contain %s:\n%s", m, w.Body)
+	}
+
+	os.Remove(snapshot) // saved by the sync
+	if err := stop(); err != nil {
+		t.Fatalf("error shutting down: %v", err)
+	}
+	if _, rl, _, err := rrstore.ReadFile(snapshot); err != nil {
+		t.Fatalf("records are not saved on exit: %v", err)
+	} else if len(rl[dns.TypeA]["api.swarm."]) != 1 {
+		t.Fatalf("wrong records saved: %v", rl)
+	}
+	if _, err := dns.Exchange(new(dns.Msg).SetQuestion("api.swarm.", dns.TypeA), s.Addr()); err == nil {
+		t.Fatal("query is answered after shutting down")
+	}
+}
+
+func TestRun_beforeSyncWait(t *testing.T) {
+	cluster := clusterdnstest.New(nil, errors.New("unreachable"))
+	s, err := New(Options{
+		Domain:            "swarm.",
+		Addr:              testAddr,
+		Cluster:           cluster,
+		BeforeSync:        BeforeSyncWait,
+		RefreshInterval:   20 * time.Millisecond,
+		RefreshTimeout:    10 * time.Millisecond,
+		RefreshMaxBackoff: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := start(t, s)
+	defer stop()
+
+	// Let a few syncs fail.
+	time.Sleep(100 * time.Millisecond)
+	if s.Listening() {
+		t.Fatal("service is listening before the records are synced")
+	}
+	if s.Addr() != testAddr {
+		t.Fatalf("DNS server is bound to %s before the records are synced", s.Addr())
+	}
+
+	cluster.Set(clusterdnstest.APITasks("10.0.0.1"), nil)
+	select {
+	case <-s.Synced():
+	case <-time.After(5 * time.Second):
+		t.Fatal("records are not synced")
+	}
+	waitListening(t, s)
+	resp := query(t, s, "api.swarm.")
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Fatalf("wrong answer: %v", resp)
+	}
+}
+
+func TestRun_setConfig(t *testing.T) {
+	s, err := New(Options{Addr: testAddr, Cluster: clusterdnstest.New(clusterdnstest.APITasks("10.0.0.1"), nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := start(t, s)
+	defer stop()
+	<-s.Synced()
+	waitListening(t, s)
+
+	static, _ := rrstore.NewRecord(&dns.A{
+		Hdr: dns.RR_Header{Name: "db.swarm.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("10.0.0.5"),
+	})
+	s.SetConfig(Config{Records: clusterdns.Config{
+		Static: rrstore.RRs{dns.TypeA: {"db.swarm.": {static}}},
+	}})
+	for i := 0; len(query(t, s, "db.swarm.").Answer) == 0; i++ {
+		if i == 100 {
+			t.Fatal("configuration is not applied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRun_stale(t *testing.T) {
+	s, err := New(Options{
+		Addr:            testAddr,
+		Cluster:         clusterdnstest.New(nil, errors.New("unreachable")),
+		RefreshInterval: 20 * time.Millisecond,
+		RefreshTimeout:  10 * time.Millisecond,
+		Staleness:       50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Run(context.Background()) }()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "stale") {
+			t.Fatalf("wrong error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("service is not stopped with stale records")
+	}
+	if err := s.Run(context.Background()); err == nil {
+		t.Fatal("service is run twice")
+	}
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ahmetalpbalkan/wagl/server"
+)
+
+// shutdown stops the server gracefully: it stops answering new queries, waits
+// for the queries being answered up to the timeout, shuts down the listeners
+// and then stops the other components in order.
+type shutdown struct {
+	logger  *slog.Logger
+	timeout time.Duration
+	drainer *server.Drainer
+
+	// listeners shut down the DNS listeners started, concurrently.
+	listeners []func(ctx context.Context) error
+
+	// closers stop the other components once the listeners are shut down,
+	// in order.
+	closers []func() error
+}
+
+func (s *shutdown) listener(f func(ctx context.Context) error) {
+	s.listeners = append(s.listeners, f)
+}
+
+func (s *shutdown) closer(f func() error) {
+	s.closers = append(s.closers, f)
+}
+
+// run shuts down the server. Draining the queries and shutting down the
+// listeners share the timeout, and the closers run even if the listeners have
+// not shut down by then.
+func (s *shutdown) run() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	if err := s.drainer.Drain(ctx); err != nil {
+		s.logger.Warn("Timed out waiting for the queries in flight to be answered", "timeout", s.timeout)
+	}
+
+	var wg sync.WaitGroup
+	for _, f := range s.listeners {
+		wg.Add(1)
+		go func(f func(ctx context.Context) error) {
+			defer wg.Done()
+			if err := f(ctx); err != nil {
+				s.logger.Warn("Error shutting down DNS listener", "error", err)
+			}
+		}(f)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.logger.Warn("Timed out waiting for the DNS listeners to shut down", "timeout", s.timeout)
+	}
+
+	for _, f := range s.closers {
+		if err := f(); err != nil {
+			s.logger.Error("Error shutting down", "error", err)
+		}
+	}
+}
+
+// withContext adapts a shutdown function which cannot be cancelled to return
+// once ctx is done, leaving it to finish in the background.
+func withContext(f func() error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		errCh := make(chan error, 1)
+		go func() { errCh <- f() }()
+		select {
+		case err := <-errCh:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
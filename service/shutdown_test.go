@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/ahmetalpbalkan/wagl/server"
+)
+
+func TestShutdown_hangingListener(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+
+	sd := &shutdown{
+		logger:  slog.New(slog.NewTextHandler(ioutil.Discard, nil)),
+		timeout: 50 * time.Millisecond,
+		drainer: new(server.Drainer),
+	}
+	var shutDown, closed bool
+	sd.listener(func(context.Context) error {
+		shutDown = true
+		return nil
+	})
+	sd.listener(withContext(func() error {
+		<-hang
+		return nil
+	}))
+	sd.closer(func() error {
+		closed = true
+		return errors.New("closer errors are logged")
+	})
+
+	done := make(chan struct{})
+	go func() {
+		sd.run()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown does not return with a hanging listener")
+	}
+	if !shutDown {
+		t.Fatal("listener is not shut down")
+	}
+	if !closed {
+		t.Fatal("closers are not run")
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	expected := errors.New("shutdown error")
+	f := withContext(func() error { return expected })
+	if err := f(context.Background()); err != expected {
+		t.Fatalf("wrong error. expected: %v got: %v", expected, err)
+	}
+
+	hang := make(chan struct{})
+	defer close(hang)
+	f = withContext(func() error {
+		<-hang
+		return nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := f(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("wrong error. expected: %v got: %v", context.DeadlineExceeded, err)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/ahmetalpbalkan/wagl/config"
+
+	"github.com/codegangsta/cli"
+)
+
+// setting is a setting of the configuration file. The settings of the flags
+// have the same names as the flags.
+type setting struct {
+	name string
+
+	// reloadable settings can be changed by reloading the configuration,
+	// the others require a restart.
+	reloadable bool
+
+	// set sets the value in the configuration file to the options.
+	set func(o *Options, v interface{}) error
+
+	// get gives the value in the options, to tell if it is changed.
+	get func(o *Options) interface{}
+}
+
+var settings = []setting{
+	stringSetting("bind", false, func(o *Options) *string { return &o.bindAddr }),
+	stringSetting("tls-bind", false, func(o *Options) *string { return &o.tlsBindAddr }),
+	stringSetting("doh-bind", false, func(o *Options) *string { return &o.dohBindAddr }),
+	stringSetting("tls-cert", false, func(o *Options) *string { return &o.tlsCert }),
+	stringSetting("tls-key", false, func(o *Options) *string { return &o.tlsKey }),
+	stringSetting("tls-ca", false, func(o *Options) *string { return &o.tlsCA }),
+	stringSetting("swarm", false, func(o *Options) *string { return &o.swarmAddr }),
+	stringSetting("swarm-cert-path", false, func(o *Options) *string { return &o.tlsDir }),
+	boolSetting("swarm-tlsverify", false, func(o *Options) *bool { return &o.tlsVerify }),
+	stringSetting("domain", false, func(o *Options) *string { return &o.domain }),
+	boolSetting("external", true, func(o *Options) *bool { return &o.recurse }),
+	stringsSetting("ns", true, func(o *Options) *[]string { return &o.nameservers }),
+	durationSetting("refresh", false, func(o *Options) *time.Duration { return &o.refreshInterval }),
+	durationSetting("refresh-timeout", false, func(o *Options) *time.Duration { return &o.refreshTimeout }),
+	durationSetting("refresh-max-backoff", false, func(o *Options) *time.Duration { return &o.refreshBackoff }),
+	durationSetting("staleness", false, func(o *Options) *time.Duration { return &o.stalenessPeriod }),
+	stringSetting("stale-policy", false, func(o *Options) *string { return &o.stalePolicy }),
+	stringSetting("before-sync", false, func(o *Options) *string { return &o.beforeSync }),
+	stringSetting("snapshot-file", false, func(o *Options) *string { return &o.snapshotFile }),
+	durationSetting("snapshot-max-age", false, func(o *Options) *time.Duration { return &o.snapshotMaxAge }),
+	boolSetting("snapshot-on-exit", false, func(o *Options) *bool { return &o.snapshotOnExit }),
+	durationSetting("shutdown-timeout", false, func(o *Options) *time.Duration { return &o.shutdownTimeout }),
+	intSetting("rrl", false, func(o *Options) *int { return &o.rrlRate }),
+	intSetting("rrl-slip", false, func(o *Options) *int { return &o.rrlSlip }),
+	stringSetting("metrics-bind", false, func(o *Options) *string { return &o.metricsAddr }),
+	stringSetting("health-bind", false, func(o *Options) *string { return &o.healthAddr }),
+	stringSetting("log-level", true, func(o *Options) *string { return &o.logLevel }),
+	stringSetting("log-format", false, func(o *Options) *string { return &o.logFormat }),
+	floatSetting("query-log-sample", true, func(o *Options) *float64 { return &o.queryLogSample }),
+	stringSetting("dnstap", false, func(o *Options) *string { return &o.dnstap }),
+	stringSetting("admin-bind", false, func(o *Options) *string { return &o.adminAddr }),
+	stringSetting("admin-token", false, func(o *Options) *string { return &o.adminToken }),
+	stringSetting("admin-tls-ca", false, func(o *Options) *string { return &o.adminCA }),
+
+	// Settings only in the configuration file
+	intSetting("ttl", true, func(o *Options) *int { return &o.ttl }),
+	stringsSetting("records", true, func(o *Options) *[]string { return &o.records }),
+	stringsSetting("acl.allow-query", true, func(o *Options) *[]string { return &o.allowQuery }),
+	stringsSetting("acl.allow-recursion", true, func(o *Options) *[]string { return &o.allowRecursion }),
+	{
+		name:       "forward-zones",
+		reloadable: true,
+		set: func(o *Options, v interface{}) error {
+			t, ok := v.(config.Table)
+			if !ok {
+				return typeError("a table", v)
+			}
+			o.forwardZones = make(map[string][]string, len(t))
+			for zone, ns := range t {
+				l, err := toStrings(ns)
+				if err != nil {
+					return fmt.Errorf("zone '%s': %v", zone, err)
+				}
+				o.forwardZones[zone] = l
+			}
+			return nil
+		},
+		get: func(o *Options) interface{} { return o.forwardZones },
+	},
+	stringsSetting("plugins", true, func(o *Options) *[]string { return &o.plugins }),
+	{
+		name:       "plugin",
+		reloadable: true,
+		set: func(o *Options, v interface{}) error {
+			t, ok := v.(config.Table)
+			if !ok {
+				return typeError("a table", v)
+			}
+			o.pluginSettings = make(map[string]map[string]interface{}, len(t))
+			for name, pt := range t {
+				pt, ok := pt.(config.Table)
+				if !ok {
+					return fmt.Errorf("plugin '%s': %v", name, typeError("a table", pt))
+				}
+				o.pluginSettings[name] = plainTable(pt)
+			}
+			return nil
+		},
+		get: func(o *Options) interface{} { return o.pluginSettings },
+	},
+}
+
+func stringSetting(name string, reloadable bool, field func(*Options) *string) setting {
+	return setting{name, reloadable,
+		func(o *Options, v interface{}) error {
+			s, ok := v.(string)
+			if !ok {
+				return typeError("a string", v)
+			}
+			*field(o) = s
+			return nil
+		},
+		func(o *Options) interface{} { return *field(o) }}
+}
+
+func stringsSetting(name string, reloadable bool, field func(*Options) *[]string) setting {
+	return setting{name, reloadable,
+		func(o *Options, v interface{}) error {
+			l, err := toStrings(v)
+			if err != nil {
+				return err
+			}
+			*field(o) = l
+			return nil
+		},
+		func(o *Options) interface{} { return *field(o) }}
+}
+
+func boolSetting(name string, reloadable bool, field func(*Options) *bool) setting {
+	return setting{name, reloadable,
+		func(o *Options, v interface{}) error {
+			b, ok := v.(bool)
+			if !ok {
+				return typeError("true or false", v)
+			}
+			*field(o) = b
+			return nil
+		},
+		func(o *Options) interface{} { return *field(o) }}
+}
+
+func intSetting(name string, reloadable bool, field func(*Options) *int) setting {
+	return setting{name, reloadable,
+		func(o *Options, v interface{}) error {
+			i, ok := v.(int64)
+			if !ok {
+				return typeError("an integer", v)
+			}
+			*field(o) = int(i)
+			return nil
+		},
+		func(o *Options) interface{} { return *field(o) }}
+}
+
+func floatSetting(name string, reloadable bool, field func(*Options) *float64) setting {
+	return setting{name, reloadable,
+		func(o *Options, v interface{}) error {
+			switch f := v.(type) {
+			case float64:
+				*field(o) = f
+			case int64:
+				*field(o) = float64(f)
+			default:
+				return typeError("a number", v)
+			}
+			return nil
+		},
+		func(o *Options) interface{} { return *field(o) }}
+}
+
+// durationSetting is a setting of a duration written as a string, e.g. "15s".
+func durationSetting(name string, reloadable bool, field func(*Options) *time.Duration) setting {
+	return setting{name, reloadable,
+		func(o *Options, v interface{}) error {
+			s, ok := v.(string)
+			if !ok {
+				return typeError(`a duration such as "15s"`, v)
+			}
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return err
+			}
+			*field(o) = d
+			return nil
+		},
+		func(o *Options) interface{} { return *field(o) }}
+}
+
+// toStrings converts an array of strings in the configuration file.
+func toStrings(v interface{}) ([]string, error) {
+	l, ok := v.([]interface{})
+	if !ok {
+		return nil, typeError("an array of strings", v)
+	}
+	out := make([]string, len(l))
+	for i, e := range l {
+		s, ok := e.(string)
+		if !ok {
+			return nil, typeError("an array of strings", v)
+		}
+		out[i] = s
+	}
+	return out, nil
+}
+
+// plainTable converts the table and its subtables to plain maps, which the
+// plugins get their settings as.
+func plainTable(t config.Table) map[string]interface{} {
+	out := make(map[string]interface{}, len(t))
+	for k, v := range t {
+		if sub, ok := v.(config.Table); ok {
+			v = plainTable(sub)
+		}
+		out[k] = v
+	}
+	return out
+}
+
+func typeError(expected string, v interface{}) error {
+	return fmt.Errorf("expected %s, got %v", expected, v)
+}
+
+func findSetting(name string) (setting, bool) {
+	for _, s := range settings {
+		if s.name == name {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// applyConfig sets the settings in the configuration table t to the options,
+// except the ones isSet returns true for, i.e. the flags set on the command
+// line. Settings in tables are named as table.setting.
+func applyConfig(o *Options, t config.Table, prefix string, isSet func(string) bool) error {
+	keys := make([]string, 0, len(t))
+	for k := range t {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name, v := prefix+k, t[k]
+		s, ok := findSetting(name)
+		if !ok {
+			if sub, ok := v.(config.Table); ok {
+				if err := applyConfig(o, sub, name+".", isSet); err != nil {
+					return err
+				}
+				continue
+			}
+			return fmt.Errorf("Unknown setting '%s'", name)
+		}
+		if isSet(name) {
+			continue
+		}
+		if err := s.set(o, v); err != nil {
+			return fmt.Errorf("Invalid '%s' setting: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// loadOptions gives the validated options specified with the flags and in the
+// configuration file, if any. Flags set on the command line, before or after
+// the command, take precedence over the configuration file.
+func loadOptions(c *cli.Context) (*Options, error) {
+	opts := flagOptions(c)
+	if opts.configFile != "" {
+		t, err := config.ReadFile(opts.configFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read configuration file: %v", err)
+		}
+		if err := applyConfig(opts, t, "", commandFlags{c}.IsSet); err != nil {
+			return nil, fmt.Errorf("%s: %v", opts.configFile, err)
+		}
+	}
+	if err := validate(opts); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// restartRequired returns an error if the settings changed from old to new
+// cannot be changed without a restart.
+func restartRequired(old, new *Options) error {
+	for _, s := range settings {
+		if !s.reloadable && !reflect.DeepEqual(s.get(old), s.get(new)) {
+			return fmt.Errorf("Changing '%s' requires a restart", s.name)
+		}
+	}
+	return nil
+}
+
+// reloadOnSignal loads the configuration with load whenever a signal is
+// received on ch, and applies it with apply if it is valid and only the
+// reloadable settings are changed. The current configuration is kept
+// otherwise. It blocks.
+func reloadOnSignal(ch <-chan os.Signal, current *Options, load func() (*Options, error), apply func(*Options)) {
+	for range ch {
+		o, err := load()
+		if err == nil {
+			err = restartRequired(current, o)
+		}
+		if err != nil {
+			slog.Error("Not reloading invalid configuration, keeping the current one", "error", err)
+			continue
+		}
+		apply(o)
+		current = o
+		slog.Info("Reloaded configuration")
+		slog.Info(o.String())
+	}
+}
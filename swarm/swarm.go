@@ -3,10 +3,12 @@
 package swarm
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
@@ -28,6 +30,9 @@ var (
 type Swarm struct {
 	client *http.Client
 	url    *url.URL
+
+	// Logger logs the requests to the Docker API.
+	Logger *slog.Logger
 }
 
 // container represents a container item in /containers/json Endpoint of Docker
@@ -73,28 +78,33 @@ func New(swarmUrl string, tlsConfig *tls.Config) (*Swarm, error) {
 	return &Swarm{
 		client: cl,
 		url:    u,
+		Logger: slog.Default(),
 	}, nil
 }
 
+// Close closes the idle connections to the Docker API.
+func (s *Swarm) Close() {
+	s.client.CloseIdleConnections()
+}
+
 // httpClient provides an HTTP client to make requests to the Docker API.
 // The code is mostly copied from https://github.com/samalba/dockerclient/
 // instead of copying the entire package for one method. Please check the
 // project's license at: https://github.com/samalba/dockerclient/blob/master/LICENSE
 func httpClient(u *url.URL, tlsConfig *tls.Config) (*http.Client, error) {
 	httpTransport := &http.Transport{TLSClientConfig: tlsConfig}
+	dialer := &net.Dialer{Timeout: defaultTimeout}
 
 	// Choose between Unix and TCP clients
 	switch u.Scheme {
 	default:
-		httpTransport.Dial = func(proto, addr string) (net.Conn, error) {
-			return net.DialTimeout(proto, addr, defaultTimeout)
-		}
+		httpTransport.DialContext = dialer.DialContext
 	case "unix":
 		socketPath := u.Path
-		unixDial := func(proto, addr string) (net.Conn, error) {
-			return net.DialTimeout("unix", socketPath, defaultTimeout)
+		unixDial := func(ctx context.Context, proto, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socketPath)
 		}
-		httpTransport.Dial = unixDial
+		httpTransport.DialContext = unixDial
 		// Override the main URL object so the HTTP lib won't complain
 		u.Scheme = "http"
 		u.Host = "unix.sock"
@@ -103,12 +113,15 @@ func httpClient(u *url.URL, tlsConfig *tls.Config) (*http.Client, error) {
 	return &http.Client{Transport: httpTransport}, nil
 }
 
-// Tasks provides running containers in a Swarm cluster.
-func (s *Swarm) Tasks() (task.ClusterState, error) {
-	ll, err := s.listContainers()
+// Tasks provides running containers in a Swarm cluster. The request to the
+// Docker API is aborted once ctx is done.
+func (s *Swarm) Tasks(ctx context.Context) (task.ClusterState, error) {
+	start := time.Now()
+	ll, err := s.listContainers(ctx)
 	if err != nil {
 		return nil, err
 	}
+	s.Logger.Debug("Listed containers", "containers", len(ll), "duration", time.Since(start))
 
 	out, err := containersToTasks(ll)
 	if err != nil {
@@ -118,9 +131,9 @@ func (s *Swarm) Tasks() (task.ClusterState, error) {
 }
 
 // listContainers returns list of running containers from Docker API
-func (s *Swarm) listContainers() ([]container, error) {
+func (s *Swarm) listContainers(ctx context.Context) ([]container, error) {
 	url := strings.TrimSuffix(s.url.String(), "/")
-	req, err := http.NewRequest("GET", url+"/containers/json?all=false", nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url+"/containers/json?all=false", nil)
 	if err != nil {
 		return nil, fmt.Errorf("error creating the HTTP request: %v", err)
 	}
@@ -135,7 +148,7 @@ func (s *Swarm) listContainers() ([]container, error) {
 	}
 
 	if resp.StatusCode >= 400 {
-		return nil, fmt.Errorf("Docker API error (Status: %d) Body: %q", resp.Status, data)
+		return nil, fmt.Errorf("Docker API error (Status: %d) Body: %q", resp.StatusCode, data)
 	}
 
 	var ll []container
@@ -1,12 +1,15 @@
 package swarm
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/ahmetalpbalkan/wagl/task"
 )
@@ -53,7 +56,7 @@ func TestGetTasks(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	out, err := sw.Tasks()
+	out, err := sw.Tasks(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -102,7 +105,7 @@ func Test_isMappedPort(t *testing.T) {
 
 	for i, c := range cases {
 		if o := isMappedPort(c.in); o != c.out {
-			t.Fatal("wrong value for case %d", i)
+			t.Fatalf("wrong value for case %d", i)
 		}
 	}
 }
@@ -132,7 +135,7 @@ func Test_mappedPorts(t *testing.T) {
 		HostPort: 8000,
 		Proto:    "tcp",
 	}}) {
-		t.Fatal("got wrong mappings: %#v", o)
+		t.Fatalf("got wrong mappings: %#v", o)
 	}
 }
 
@@ -154,7 +157,7 @@ func Test_toPort(t *testing.T) {
 	}
 
 	if !reflect.DeepEqual(p, expected) { // deep equal required: net.IP is []byte
-		t.Fatal("got wrong value: %#v", p)
+		t.Fatalf("got wrong value: %#v", p)
 	}
 }
 
@@ -201,6 +204,48 @@ func Test_containerSrvNames(t *testing.T) {
 
 }
 
+func TestTasks_cancellation(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	aborted := make(chan struct{}, 1)
+	srv := testServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select { // hang until the client gives up
+		case <-r.Context().Done():
+			aborted <- struct{}{}
+		case <-time.After(time.Second * 5):
+		}
+	}))
+
+	sw, err := New(srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	start := time.Now()
+	if _, err := sw.Tasks(ctx); err == nil {
+		t.Fatal("no error after timeout")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("request is not aborted on timeout, took %v", d)
+	}
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatal("request is not cancelled on the server")
+	}
+	srv.Close()
+
+	var cur int
+	for i := 0; i < 200; i++ {
+		if cur = runtime.NumGoroutine(); cur <= before {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("goroutines leaked: %d, expected: %d", cur, before)
+}
+
 func testServer(handler http.Handler) *httptest.Server {
 	s := httptest.NewServer(handler)
 	return s
@@ -1,22 +1,25 @@
 package main
 
 // Changes:
-// - removed '[argument...]' at the end of USAGE line
-// - changed '[global options]' with '[options]'
-// - changed 'GLOBAL OPTIONS' with 'OPTIONS'
-// - removed 'COMMANDS' section entirely (was showing only 'help,h' anyway)
+// - replaced the USAGE line with the commands and the default command
+// - changed 'GLOBAL OPTIONS' with 'OPTIONS' (of the default command)
+// - removed 'help, h' from the COMMANDS section
 const usageTemplate = `NAME:
    {{.Name}} - {{.Usage}}
 
 USAGE:
-   {{.Name}} {{if .Flags}}[options]{{end}}{{if .Commands}} command [command options]{{end}}
+   {{.Name}} command [command options]
+   {{.Name}} [options] (same as '{{.Name}} serve [options]')
    {{if .Version}}
 VERSION:
    {{.Version}}
    {{end}}{{if len .Authors}}
 AUTHOR(S):
    {{range .Authors}}{{ . }}{{end}}
-   {{end}}{{if .Flags}}
+   {{end}}{{if .Commands}}
+COMMANDS:
+   {{range .Commands}}{{if ne .Name "help"}}{{.Name}}{{ "\t" }}{{.Usage}}
+   {{end}}{{end}}{{end}}{{if .Flags}}
 OPTIONS:
    {{range .Flags}}{{.}}
    {{end}}{{end}}{{if .Copyright }}
@@ -24,3 +27,19 @@ COPYRIGHT:
    {{.Copyright}}
    {{end}}
 `
+
+// Changes:
+// - removed '[arguments...]' from USAGE line of commands without arguments
+const commandUsageTemplate = `NAME:
+   {{.HelpName}} - {{.Usage}}
+
+USAGE:
+   {{.HelpName}}{{if .Flags}} [command options]{{end}}{{if .ArgsUsage}} {{.ArgsUsage}}{{end}}{{if .Description}}
+
+DESCRIPTION:
+   {{.Description}}{{end}}{{if .Flags}}
+
+OPTIONS:
+   {{range .Flags}}{{.}}
+   {{end}}{{ end }}
+`
@@ -1,9 +1,28 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/ahmetalpbalkan/wagl/admin"
+	"github.com/ahmetalpbalkan/wagl/clusterdns"
+	"github.com/ahmetalpbalkan/wagl/clusterdns/staleness"
+	"github.com/ahmetalpbalkan/wagl/rrstore"
+	"github.com/ahmetalpbalkan/wagl/rrtype"
+	"github.com/ahmetalpbalkan/wagl/server"
+	"github.com/ahmetalpbalkan/wagl/server/dnstap"
+	"github.com/ahmetalpbalkan/wagl/server/rrl"
+	"github.com/ahmetalpbalkan/wagl/service"
 	"github.com/ahmetalpbalkan/wagl/tlsconfig"
 	"github.com/miekg/dns"
 )
@@ -23,6 +42,160 @@ func tlsConfig(certDir string, verify bool) (*tls.Config, error) {
 	})
 }
 
+// serverTLSConfig constructs the TLS configuration of the DNS-over-TLS server.
+// If caFile is specified, clients are required to present a certificate signed
+// by this CA.
+func serverTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	opts := tlsconfig.Options{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	}
+	if caFile != "" {
+		opts.CAFile = caFile
+		opts.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsconfig.Server(opts)
+}
+
+// serveAdmin starts the admin API server in the background and gives it, to be
+// shut down with shutdownHTTP. The API is served over HTTPS if a TLS
+// certificate is specified, only to the clients with certificates if a client
+// CA is specified as well. fail is called with the error of the server if it
+// stops other than by being shut down.
+func serveAdmin(opt *Options, h http.Handler, fail func(error)) *http.Server {
+	var cfg *tls.Config
+	if opt.tlsCert != "" {
+		c, err := serverTLSConfig(opt.tlsCert, opt.tlsKey, opt.adminCA)
+		if err != nil {
+			fatal("Error establishing admin TLS config", "error", err)
+		}
+		cfg = c
+	}
+	srv := admin.New(opt.adminAddr, cfg, opt.adminToken, h)
+	go func() {
+		slog.Info("Admin server started listening", "addr", opt.adminAddr, "tls", cfg != nil)
+		var err error
+		if cfg != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			fail(fmt.Errorf("Admin server stopped: %v", err))
+		}
+	}()
+	return srv
+}
+
+// isLoopback returns if the host:port address is on a loopback interface
+// only, so that the plain HTTP traffic to it does not leave the host.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// httpMuxes are the muxes of the HTTP servers by their addresses, so that the
+// endpoints configured on the same address are served together.
+type httpMuxes map[string]*http.ServeMux
+
+// at gives the mux for the address, creating it if it does not exist.
+func (m httpMuxes) at(addr string) *http.ServeMux {
+	mux, ok := m[addr]
+	if !ok {
+		mux = http.NewServeMux()
+		m[addr] = mux
+	}
+	return mux
+}
+
+// Timeouts of the HTTP servers, so that slow or idle clients cannot hold on to
+// their connections.
+const (
+	httpReadHeaderTimeout = 5 * time.Second
+	httpReadTimeout       = 10 * time.Second
+	httpWriteTimeout      = 30 * time.Second
+	httpIdleTimeout       = 60 * time.Second
+	httpShutdownTimeout   = 5 * time.Second
+)
+
+// serve starts the HTTP servers in the background and gives them, to be shut
+// down with shutdownHTTP. fail is called with the error of a server that stops
+// other than by being shut down.
+func (m httpMuxes) serve(fail func(error)) []*http.Server {
+	var servers []*http.Server
+	for addr, mux := range m {
+		srv := &http.Server{
+			Addr:              addr,
+			Handler:           mux,
+			ReadHeaderTimeout: httpReadHeaderTimeout,
+			ReadTimeout:       httpReadTimeout,
+			WriteTimeout:      httpWriteTimeout,
+			IdleTimeout:       httpIdleTimeout,
+		}
+		servers = append(servers, srv)
+		go func(srv *http.Server) {
+			slog.Info("HTTP server started listening", "addr", srv.Addr)
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				fail(fmt.Errorf("HTTP server at %s stopped: %v", srv.Addr, err))
+			}
+		}(srv)
+	}
+	return servers
+}
+
+// shutdownHTTP shuts the HTTP servers down, waiting for the requests in
+// progress for up to httpShutdownTimeout.
+func shutdownHTTP(servers []*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Error("Error shutting down HTTP server", "addr", srv.Addr, "error", err)
+		}
+	}
+}
+
+// newLogger creates a logger writing to w in the specified format, text
+// (logfmt) or json, the logs at or above the specified level.
+func newLogger(w io.Writer, format string, level slog.Leveler) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case logFormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case logFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("Unknown --log-format value: '%s'", format)
+}
+
+// parseLogLevel parses a log level: debug, info, warn or error.
+func parseLogLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return l, fmt.Errorf("Unknown --log-level value: '%s'", s)
+	}
+	return l, nil
+}
+
+// logLevel gives the log level of a validated configuration.
+func logLevel(s string) slog.Level {
+	l, _ := parseLogLevel(s)
+	return l
+}
+
+// fatal logs the error message with the key-value pairs and exits.
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
 // localNameservers returns list of local nameservers.
 func localNameservers() ([]string, error) {
 	c, err := dns.ClientConfigFromFile("/etc/resolv.conf")
@@ -31,3 +204,205 @@ func localNameservers() ([]string, error) {
 	}
 	return c.Servers, nil
 }
+
+// dnstapTap gives the tap writing dnstap messages to the file or the
+// unix:// socket at target and its output, or nil if target is empty. The
+// messages are counted in m.
+func dnstapTap(target string, logger *slog.Logger, m *dnstap.Metrics) (*dnstap.Tap, *dnstap.Output) {
+	if target == "" {
+		return nil, nil
+	}
+	var out *dnstap.Output
+	if path := strings.TrimPrefix(target, "unix://"); path != target {
+		out = dnstap.DialUnix(path, logger, m)
+	} else {
+		o, err := dnstap.OpenFile(target, logger, m)
+		if err != nil {
+			fatal("Error opening dnstap file", "error", err)
+		}
+		out = o
+	}
+	tap := dnstap.New(out)
+	if host, err := os.Hostname(); err == nil {
+		tap.Identity = []byte(host)
+	}
+	tap.Version = []byte("wagl " + version)
+	return tap, out
+}
+
+// serviceOptions gives the options of the service based on the options, other
+// than the ones of its cluster, TLS, dnstap and logging.
+func serviceOptions(opt *Options) service.Options {
+	slip := opt.rrlSlip
+	if slip == 0 {
+		slip = -1 // never slip
+	}
+	timeout := opt.shutdownTimeout
+	if timeout == 0 {
+		timeout = -1 // do not wait
+	}
+	return service.Options{
+		Domain:            opt.domain,
+		Addr:              opt.bindAddr,
+		Config:            serviceConfig(opt),
+		RefreshInterval:   opt.refreshInterval,
+		RefreshTimeout:    opt.refreshTimeout,
+		RefreshMaxBackoff: opt.refreshBackoff,
+		Staleness:         opt.stalenessPeriod,
+		StalePolicy:       staleness.Policy(opt.stalePolicy),
+		BeforeSync:        service.BeforeSync(opt.beforeSync),
+		SnapshotFile:      opt.snapshotFile,
+		SnapshotMaxAge:    opt.snapshotMaxAge,
+		SnapshotOnExit:    opt.snapshotOnExit,
+		ShutdownTimeout:   timeout,
+		RRL: rrl.Config{
+			ResponsesPerSecond: opt.rrlRate,
+			Slip:               slip,
+		},
+	}
+}
+
+// serviceConfig gives the reloadable configuration of the service: the one of
+// the DNS server and the one of the records.
+func serviceConfig(opt *Options) service.Config {
+	return service.Config{
+		Server: server.Config{
+			Recurse:        opt.recurse,
+			Nameservers:    opt.upstreams,
+			ForwardZones:   opt.forwardUpstreams,
+			AllowQuery:     opt.allowQueryNets,
+			AllowRecursion: opt.allowRecursionNets,
+			QueryLogSample: opt.queryLogSample,
+			Plugins:        opt.pluginChain,
+		},
+		Records: clusterdns.Config{TTL: uint32(opt.ttl), Static: opt.staticRecords},
+	}
+}
+
+// parseForwardZones parses the nameservers of the forward zones, which must be
+// outside the domain, by the zones as lowercase FQDNs.
+func parseForwardZones(domain string, zones map[string][]string) (map[string][]server.Upstream, error) {
+	if len(zones) == 0 {
+		return nil, nil
+	}
+	domain = strings.ToLower(dns.Fqdn(domain))
+	out := make(map[string][]server.Upstream, len(zones))
+	for zone, l := range zones {
+		z := strings.ToLower(dns.Fqdn(zone))
+		if dns.IsSubDomain(domain, z) {
+			return nil, fmt.Errorf("Forward zone '%s' is in the domain", zone)
+		}
+		if len(l) == 0 {
+			return nil, fmt.Errorf("No nameservers specified for forward zone '%s'", zone)
+		}
+		for _, v := range l {
+			ns, err := server.ParseUpstream(v)
+			if err != nil {
+				return nil, err
+			}
+			out[z] = append(out[z], ns)
+		}
+	}
+	return out, nil
+}
+
+// newPluginChain creates the middlewares of the plugins, in order, with their
+// settings. Settings of plugins not in the list are rejected, as they would be
+// silently ignored otherwise.
+func newPluginChain(names []string, settings map[string]map[string]interface{}) ([]server.Middleware, error) {
+	used := make(map[string]bool, len(names))
+	var chain []server.Middleware
+	for _, name := range names {
+		if used[name] {
+			return nil, fmt.Errorf("Plugin '%s' specified more than once", name)
+		}
+		used[name] = true
+		m, err := server.NewMiddleware(name, settings[name])
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, m)
+	}
+	for name := range settings {
+		if !used[name] {
+			return nil, fmt.Errorf("Settings specified for plugin '%s'; but it is not in 'plugins'", name)
+		}
+	}
+	return chain, nil
+}
+
+// parseNets parses the networks in CIDR notation, or IPs as networks of a
+// single address. It gives nil if l is nil.
+func parseNets(l []string) ([]*net.IPNet, error) {
+	if l == nil {
+		return nil, nil
+	}
+	nets := []*net.IPNet{}
+	for _, v := range l {
+		if ip := net.ParseIP(v); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network in ACL: '%s'", v)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// parseRecords parses the static records in zone file format, such as
+// "db.swarm. 60 IN A 10.0.0.5", which must be A, SRV or TXT records in the
+// domain. Records that do not specify their TTL get the specified TTL.
+func parseRecords(domain string, ttl uint32, l []string) (rrstore.RRs, error) {
+	domain = strings.ToLower(dns.Fqdn(domain))
+	rl := make(rrstore.RRs)
+	for _, s := range l {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid record '%s': %v", s, err)
+		} else if rr == nil {
+			return nil, fmt.Errorf("Invalid record '%s'", s)
+		}
+		h := rr.Header()
+		h.Name = strings.ToLower(h.Name)
+		if !dns.IsSubDomain(domain, h.Name) {
+			return nil, fmt.Errorf("Record '%s' is not in the domain", s)
+		}
+		if !rrtype.IsSupported(h.Rrtype) {
+			return nil, fmt.Errorf("Record '%s' is not of a supported type (A, SRV, TXT)", s)
+		}
+		if !hasTTL(s) {
+			h.Ttl = ttl
+		}
+		rec, err := rrstore.NewRecord(rr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid record '%s': %v", s, err)
+		}
+		if rl[h.Rrtype] == nil {
+			rl[h.Rrtype] = make(map[string][]rrstore.Record)
+		}
+		rl[h.Rrtype][h.Name] = append(rl[h.Rrtype][h.Name], rec)
+	}
+	return rl, nil
+}
+
+// hasTTL returns if the record in zone file format specifies its TTL, which
+// comes before its type along with its class.
+func hasTTL(s string) bool {
+	f := strings.Fields(s)
+	for i := 1; i < len(f); i++ {
+		if _, ok := dns.StringToType[strings.ToUpper(f[i])]; ok {
+			return false
+		}
+		if _, err := strconv.ParseUint(f[i], 10, 32); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestIsLoopback(t *testing.T) {
+	cases := []struct {
+		addr     string
+		expected bool
+	}{
+		{"127.0.0.1:8080", true},
+		{"127.1.2.3:8080", true},
+		{"[::1]:8080", true},
+		{"localhost:8080", true},
+		{":8080", false},
+		{"0.0.0.0:8080", false},
+		{"10.0.0.1:8080", false},
+		{"admin.example.com:8080", false},
+		{"127.0.0.1", false},
+	}
+	for _, c := range cases {
+		if got := isLoopback(c.addr); got != c.expected {
+			t.Errorf("%q: expected %v, got %v", c.addr, c.expected, got)
+		}
+	}
+}
+
+func TestParseRecords(t *testing.T) {
+	rl, err := parseRecords("swarm", 30, []string{
+		"db.swarm. A 10.0.0.5",
+		"_db._tcp.swarm. 300 SRV 1 1 5432 db.swarm.",
+		`DB.swarm. TXT "owner=team-a" "tier=db"`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := rl[dns.TypeA]["db.swarm."]; len(a) != 1 || a[0].Addr.String() != "10.0.0.5" || a[0].TTL != 30 {
+		t.Fatalf("wrong A records: %+v", a)
+	}
+	if srv := rl[dns.TypeSRV]["_db._tcp.swarm."]; len(srv) != 1 || srv[0].Port != 5432 || srv[0].TTL != 300 {
+		t.Fatalf("wrong SRV records: %+v", srv)
+	}
+	if txt := rl[dns.TypeTXT]["db.swarm."]; len(txt) != 1 || !reflect.DeepEqual(txt[0].Text, []string{"owner=team-a", "tier=db"}) {
+		t.Fatalf("wrong TXT records: %+v", txt)
+	}
+
+	cases := []struct {
+		record   string
+		expected string
+	}{
+		{"db.swarm. A 10.0.0", "Invalid record"},
+		{"db.example.com. A 10.0.0.5", "not in the domain"},
+		{"db.swarm. MX 10 mail.swarm.", "not of a supported type"},
+	}
+	for _, c := range cases {
+		if _, err := parseRecords("swarm", 30, []string{c.record}); err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("%q: expected error containing %q, got: %v", c.record, c.expected, err)
+		}
+	}
+}